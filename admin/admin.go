@@ -0,0 +1,147 @@
+// Package admin serves the admin API, which inspects and controls a running
+// backend. It is served on its own listener, apart from the public engine.
+package admin
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"PiliPili_Backend/streamer"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// dashboardFiles holds the dashboard page, which reads the event stream of the API.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// NewEngine returns the gin engine of the admin API, which requires token as
+// a bearer token on every request, and of the dashboard page.
+func NewEngine(token string) (*gin.Engine, error) {
+	if token == "" {
+		return nil, errors.New("Admin.token is required when the admin API is enabled")
+	}
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	dashboard, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		return nil, err
+	}
+	r.StaticFS("/dashboard", http.FS(dashboard))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+	go events.run()
+
+	api := r.Group("/api", requireToken(token))
+	api.GET("/streams", listStreams)
+	api.DELETE("/streams/:id", killStream)
+	api.POST("/config/reload", reloadConfig)
+	api.GET("/loglevel", getLogLevel)
+	api.PUT("/loglevel", setLogLevel)
+	api.GET("/cache", cacheStats)
+	api.POST("/signatures/revoke", revokeSignature)
+	api.GET("/events", streamEvents)
+	return r, nil
+}
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logger.Warn("Admin API request with an invalid token", "path", c.Request.URL.Path, "clientIP", c.ClientIP())
+			c.Header("WWW-Authenticate", `Bearer realm="pilipili-admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// listStreams serves the active streams.
+func listStreams(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"streams":  streamer.ActiveStreams(),
+		"draining": streamer.IsDraining(),
+	})
+}
+
+// killStream stops the stream with the id path parameter.
+func killStream(c *gin.Context) {
+	id := c.Param("id")
+	if !streamer.KillStream(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	logger.Info("Stream killed through the admin API", "id", id)
+	c.Status(http.StatusNoContent)
+}
+
+// reloadConfig reads the config file again. The config subscribers apply
+// the settings that can change at runtime.
+func reloadConfig(c *gin.Context) {
+	if err := config.Reload(); err != nil {
+		logger.Error("Rejected config reload, keeping the current config", "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot reload config: " + err.Error()})
+		return
+	}
+	logger.Info("Config reloaded through the admin API")
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
+
+// getLogLevel serves the current log level.
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
+
+// setLogLevel changes the log level until the next restart or reload.
+func setLogLevel(c *gin.Context) {
+	var body struct {
+		Level string `json:"level" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected {\"level\": \"DEBUG|INFO|WARN|ERROR\"}"})
+		return
+	}
+	if err := logger.SetLevel(body.Level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Log level changed through the admin API", "level", logger.Level())
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
+
+// cacheStats serves the statistics of the block cache and the in-memory caches.
+func cacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"blockCache": storage.BlockCacheStatistics(),
+		"caches":     streamer.CacheStatistics(),
+	})
+}
+
+// revokeSignature refuses a signature from now on and stops the streams using it.
+func revokeSignature(c *gin.Context) {
+	var body struct {
+		Signature string `json:"signature" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected {\"signature\": \"...\"}"})
+		return
+	}
+	stopped, err := streamer.RevokeSignature(body.Signature)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature: " + err.Error()})
+		return
+	}
+	logger.Info("Signature revoked through the admin API", "streamsStopped", stopped)
+	c.JSON(http.StatusOK, gin.H{"revoked": true, "streamsStopped": stopped, "revokedSignatures": streamer.RevokedSignatureCount()})
+}
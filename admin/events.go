@@ -0,0 +1,194 @@
+package admin
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"PiliPili_Backend/streamer"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sampleInterval is the period of dashboard snapshots.
+const sampleInterval = time.Second
+
+// maxSamples bounds the throughput history sent to new dashboards.
+const maxSamples = 300
+
+// maxSnapshotAuthFailures bounds the authentication failures in a snapshot.
+const maxSnapshotAuthFailures = 20
+
+// throughputSample is the throughput of every stream over one interval.
+type throughputSample struct {
+	Time           int64 `json:"t"` // Unix milliseconds
+	BytesPerSecond int64 `json:"bps"`
+}
+
+// clientBandwidth is the throughput of the streams of one client.
+type clientBandwidth struct {
+	ClientIP       string `json:"clientIp"`
+	Streams        int    `json:"streams"`
+	BytesPerSecond int64  `json:"bps"`
+	Bytes          int64  `json:"bytes"`
+}
+
+// liveStream is an active stream with its throughput over the last interval.
+type liveStream struct {
+	streamer.StreamInfo
+	BytesPerSecond int64 `json:"bps"`
+}
+
+// snapshot is the state of the backend sent to dashboards every interval.
+type snapshot struct {
+	Throughput   throughputSample        `json:"throughput"`
+	Streams      []liveStream            `json:"streams"`
+	Clients      []clientBandwidth       `json:"clients"`
+	AuthFailures []streamer.AuthFailure  `json:"authFailures"`
+	BlockCache   storage.BlockCacheStats `json:"blockCache"`
+	Draining     bool                    `json:"draining"`
+	LogLevel     string                  `json:"logLevel"`
+}
+
+// sampler takes a snapshot every interval and broadcasts it to the connected dashboards.
+type sampler struct {
+	mu          sync.Mutex
+	history     []throughputSample
+	subscribers map[chan []byte]struct{}
+
+	// State of the previous sample, only used by run.
+	lastServed int64
+	lastBytes  map[string]int64
+	lastTime   time.Time
+}
+
+// events is the sampler of the admin engine.
+var events = &sampler{subscribers: make(map[chan []byte]struct{})}
+
+// run samples until the process exits.
+func (s *sampler) run() {
+	s.lastServed, s.lastBytes, s.lastTime = streamer.BytesServed(), make(map[string]int64), time.Now()
+	for range time.Tick(sampleInterval) {
+		data, err := json.Marshal(s.sample())
+		if err != nil {
+			logger.Error("Failed to encode dashboard snapshot", "error", err)
+			continue
+		}
+		s.mu.Lock()
+		for ch := range s.subscribers {
+			select {
+			case ch <- data:
+			default:
+				// A slow dashboard skips a snapshot rather than delaying the others.
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sample takes a snapshot and appends its throughput to the history.
+func (s *sampler) sample() snapshot {
+	now := time.Now()
+	elapsed := now.Sub(s.lastTime).Seconds()
+	served := streamer.BytesServed()
+	snap := snapshot{
+		Throughput: throughputSample{Time: now.UnixMilli(), BytesPerSecond: int64(float64(served-s.lastServed) / elapsed)},
+		Streams:    []liveStream{},
+		Clients:    []clientBandwidth{},
+		BlockCache: storage.BlockCacheStatistics(),
+		Draining:   streamer.IsDraining(),
+		LogLevel:   logger.Level(),
+	}
+	s.lastServed, s.lastTime = served, now
+
+	clients := make(map[string]*clientBandwidth)
+	bytes := make(map[string]int64)
+	for _, info := range streamer.ActiveStreams() {
+		stream := liveStream{StreamInfo: info, BytesPerSecond: int64(float64(info.Bytes-s.lastBytes[info.ID]) / elapsed)}
+		bytes[info.ID] = info.Bytes
+		snap.Streams = append(snap.Streams, stream)
+
+		client, ok := clients[info.ClientIP]
+		if !ok {
+			client = &clientBandwidth{ClientIP: info.ClientIP}
+			clients[info.ClientIP] = client
+		}
+		client.Streams++
+		client.BytesPerSecond += stream.BytesPerSecond
+		client.Bytes += info.Bytes
+	}
+	s.lastBytes = bytes
+	for _, client := range clients {
+		snap.Clients = append(snap.Clients, *client)
+	}
+	sort.Slice(snap.Clients, func(i, j int) bool { return snap.Clients[i].BytesPerSecond > snap.Clients[j].BytesPerSecond })
+
+	failures := streamer.RecentAuthFailures()
+	snap.AuthFailures = failures[:min(len(failures), maxSnapshotAuthFailures)]
+
+	s.mu.Lock()
+	s.history = append(s.history, snap.Throughput)
+	if len(s.history) > maxSamples {
+		s.history = s.history[len(s.history)-maxSamples:]
+	}
+	s.mu.Unlock()
+	return snap
+}
+
+// subscribe registers a dashboard and returns the throughput history so far.
+func (s *sampler) subscribe() (chan []byte, []throughputSample) {
+	ch := make(chan []byte, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers[ch] = struct{}{}
+	return ch, append([]throughputSample{}, s.history...)
+}
+
+// unsubscribe unregisters a dashboard.
+func (s *sampler) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	delete(s.subscribers, ch)
+	s.mu.Unlock()
+}
+
+// streamEvents sends the throughput history as a history event, then a
+// snapshot event every interval until the dashboard disconnects.
+func streamEvents(c *gin.Context) {
+	ch, history := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return
+	}
+	if writeEvent(c, "history", data) != nil {
+		return
+	}
+	for {
+		select {
+		case data := <-ch:
+			if writeEvent(c, "snapshot", data) != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes one server-sent event and flushes it.
+func writeEvent(c *gin.Context, event string, data []byte) error {
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/health"
+	"PiliPili_Backend/streamer"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// commands are the subcommands accepted in place of the configuration file.
+// Each returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"probe":  probeCommand,
+	"config": configCommand,
+	"health": healthCommand,
+}
+
+// probeCommand prints the container, duration and tracks of media files as JSON.
+func probeCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: pilipili probe <file>...")
+		return 2
+	}
+
+	status := 0
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for _, file := range args {
+		result, err := streamer.ProbeFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			status = 1
+			continue
+		}
+		if err := encoder.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// configCommand runs the config subcommands, which take the same config
+// file, environment variables and flags as the server. "config check"
+// validates the configuration without starting the server, for use before a
+// deploy or a reload, and "config print" shows the effective configuration
+// with secrets redacted.
+func configCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "print") {
+		fmt.Fprintln(os.Stderr, "Usage: pilipili config check|print [flags] [file]")
+		return 2
+	}
+	configFile, flags, err := parseArgs("pilipili config "+args[0], args[1:])
+	if err != nil {
+		return 2
+	}
+
+	if args[0] == "print" {
+		out, err := config.Print(configFile, flags)
+		fmt.Print(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	warnings, err := config.Check(configFile, flags)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning: "+warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("The configuration is valid")
+	return 0
+}
+
+// healthCommand checks that the server running with the given config file,
+// environment variables and flags answers its liveness ("health live") or
+// readiness ("health ready") endpoint, for container healthchecks. The exit
+// code is 0 when it does and 1 otherwise.
+func healthCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "live" && args[0] != "ready") {
+		fmt.Fprintln(os.Stderr, "Usage: pilipili health live|ready [flags] [file]")
+		return 2
+	}
+	configFile, flags, err := parseArgs("pilipili health "+args[0], args[1:])
+	if err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(configFile, flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := health.Probe(cfg, args[0] == "ready"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -2,64 +2,346 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Config holds all configuration values.
 type Config struct {
-	Encipher        string // Key used for encryption and obfuscation
+	Encipher        string // Key used for encryption and obfuscation, or a reference to its source (see package secret)
 	StorageBasePath string // Prefix for storage paths, used to form full file paths
 	Port            int    // Server port
 	LogLevel        string // Log level (e.g., INFO, DEBUG, ERROR)
+
+	ReadinessTimeout time.Duration // Latency budget for each readiness check
+	ReadTimeout      time.Duration // Maximum duration for reading an entire request
+	WriteTimeout     time.Duration // Maximum duration before timing out writes of a response (0 disables it)
+	IdleTimeout      time.Duration // Maximum time to wait for the next request on a keep-alive connection
+	DrainTimeout     time.Duration // How long in-flight streams may run after a shutdown signal
+
+	TLSEnabled   bool   // Serve HTTPS directly instead of relying on a reverse proxy
+	TLSCertFile  string // Path to the PEM certificate chain, reloaded when it changes
+	TLSKeyFile   string // Path to the PEM private key, reloaded when it changes
+	HTTP2        bool   // Negotiate HTTP/2 over TLS
+	RedirectHTTP bool   // Run a plain HTTP listener that redirects to HTTPS
+	RedirectPort int    // Port of the HTTP redirect listener
+
+	HTTP3Enabled bool // Serve HTTP/3 over QUIC alongside the TCP listener
+	HTTP3Port    int  // UDP port of the HTTP/3 listener, defaults to the server port
+
+	TrustedProxies  []string // CIDRs or IPs of reverse proxies whose forwarding headers are trusted
+	RemoteIPHeaders []string // Headers carrying the client IP, checked in order
+	ProxyProtocol   bool     // Accept PROXY protocol v1/v2 headers from trusted proxies
+
+	MimeTypes map[string]string // Content type overrides keyed by file extension (e.g. ".sup")
+
+	SubtitleCacheSize int64 // Maximum bytes of converted subtitles kept in memory
+
+	FontsDirectory string // Directory of fonts served to subtitle renderers alongside Matroska attachments
+	FontSubset     bool   // Subset served fonts to the characters the subtitles draw
+	FontCacheSize  int64  // Maximum bytes of subset fonts kept in memory
+
+	HLSSegmentDuration time.Duration // Target duration of HLS segments, cut at the next keyframe
+
+	Faststart          bool  // Serve MP4 files with the moov box at the end as if it were at the front
+	FaststartCacheSize int64 // Maximum bytes of relocated moov boxes kept in memory
+
+	FFmpegPath string // ffmpeg binary, looked up in PATH when not absolute
+
+	ThumbnailCacheDirectory string        // Directory of extracted thumbnails and trickplay images
+	ThumbnailWidth          int           // Width of thumbnails and trickplay images
+	ThumbnailConcurrency    int           // Maximum number of concurrent ffmpeg extractions
+	TrickplayInterval       time.Duration // Time between trickplay images
+	TrickplayColumns        int           // Images per row of a sprite sheet
+	TrickplayRows           int           // Rows of a sprite sheet
+
+	TranscodeEnabled       bool          // Serve the /transcode endpoints, which encode with a local ffmpeg
+	TranscodeMaxConcurrent int           // Maximum number of concurrent transcodes
+	TranscodeIdleTimeout   time.Duration // Time after which an unrequested HLS transcode session is stopped
+	TranscodeDirectory     string        // Directory of HLS transcode output
+
+	BlockCacheEnabled   bool     // Read media files through a block cache on a local disk
+	BlockCacheDirectory string   // Directory of cached blocks, ideally on an SSD
+	BlockCacheSize      int64    // Maximum bytes of cached blocks
+	BlockCacheBlockSize int64    // Size of cached blocks
+	BlockCacheRoots     []string // Directories of cached files, every file when empty
+
+	ReadAheadWindow time.Duration // Playback time of data read ahead of each stream, 0 disables read-ahead
+	ReadAheadSize   int64         // Maximum bytes read ahead of each stream
+
+	PrewarmEnabled   bool    // Read the start of the next file of a directory while the current one plays
+	PrewarmThreshold float64 // Fraction of the current file a stream must reach to prewarm the next one
+	PrewarmSize      int64   // Bytes read from the start of the next file
+
+	AdminEnabled bool   // Serve the admin API on a separate listener
+	AdminAddress string // Address of the admin listener, localhost only by default
+	AdminToken   string // Bearer token required by the admin API
+}
+
+// globalConfig stores the loaded configuration, guarded by configMu since it can be reloaded.
+var (
+	globalConfig Config
+	warnings     []string
+	configMu     sync.RWMutex
+)
+
+// configFile is the path of the loaded config file, empty when the
+// configuration only comes from the environment and flags.
+var configFile string
+
+// flagOverrides are the settings given as command-line flags, kept for reloads.
+var flagOverrides map[string]string
+
+// loaded reports whether the configuration was loaded.
+var loaded bool
+
+// loadResult is a configuration loaded from a config file and its overrides.
+type loadResult struct {
+	cfg       Config
+	v         *viper.Viper
+	locations map[string]keyLocation // keys of the config file, lower-cased
+	sources   map[string]string      // where the overridden settings came from, such as $PILIPILI_SERVER_PORT
+	warnings  []string
 }
 
-// globalConfig stores the loaded configuration.
-var globalConfig Config
+// inFile reports whether the config file sets key.
+func (r *loadResult) inFile(key string) bool {
+	_, ok := r.locations[strings.ToLower(key)]
+	return ok
+}
+
+// Initialize loads and validates the configuration from the provided config
+// file, which may be empty, overridden by PILIPILI_* environment variables
+// and then by flags, the values of the flags registered by RegisterFlags. A
+// missing, unreadable or invalid config file is an error listing every
+// problem with its line in the file.
+func Initialize(file string, flags map[string]string) error {
+	result, err := load(file, flags)
+	if err != nil {
+		return err
+	}
+	configFile, flagOverrides = file, flags
+	setConfig(result.cfg, result.warnings)
+	loaded = true
+
+	// The global viper instance only watches the file, see Watch.
+	if file != "" {
+		viper.SetConfigFile(file)
+	}
+	return nil
+}
 
-// Initialize loads the configuration from the provided config file and initializes the logger.
-func Initialize(configFile string, loglevel string) error {
-	viper.SetConfigType("yaml")
+// Load reads a config file and its overrides like Initialize, for commands
+// that only need to know how the server is configured, such as the
+// healthcheck. It neither validates the settings nor reads the secrets they
+// refer to, so that frequent runs do not execute secret commands or touch
+// the storage, and does not replace the global configuration. Settings of
+// the wrong type read as their zero value.
+func Load(file string, flags map[string]string) (Config, error) {
+	result, err := read(file, flags)
+	if err != nil {
+		return Config{}, err
+	}
+	return result.cfg, nil
+}
 
-	if configFile != "" {
-		viper.SetConfigFile(configFile)
+// Check loads and validates a config file and its overrides without
+// applying them. It returns the warnings about the file, such as unknown
+// keys, and an error listing every invalid setting.
+func Check(file string, flags map[string]string) ([]string, error) {
+	result, err := load(file, flags)
+	if result == nil {
+		return nil, err
 	}
+	return result.warnings, err
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		globalConfig = Config{
-			Encipher:        "",
-			StorageBasePath: "",
-			Port:            60002,
-			LogLevel:        defaultLogLevel(loglevel),
+// load reads a config file, applies the overrides, then type-checks and
+// validates the result. The result is returned along with validation
+// errors, but is nil when the file cannot be read or parsed.
+func load(file string, flags map[string]string) (*loadResult, error) {
+	result, err := read(file, flags)
+	if err != nil {
+		return nil, err
+	}
+	v, locations, sources := result.v, result.locations, result.sources
+	var errs []*settingError
+	for key, s := range settings {
+		if (result.inFile(key) || sources[key] != "") && !checkKind(s.kind, v.Get(key)) {
+			errs = append(errs, &settingError{key: key, msg: "must be " + kindNames[s.kind]})
 		}
-	} else {
-		globalConfig = Config{
-			Encipher:        viper.GetString("Encipher"),
-			StorageBasePath: viper.GetString("StorageBasePath"),
-			Port:            viper.GetInt("Server.port"),
-			LogLevel:        getLogLevel(loglevel),
+	}
+	if len(errs) == 0 {
+		errs = append(checkSecrets(result.cfg), validate(result.cfg)...)
+	}
+	if len(errs) == 0 {
+		return result, nil
+	}
+
+	// Report the problems in the order of the file, overrides and missing keys last.
+	for _, err := range errs {
+		switch location, inFile := locations[strings.ToLower(err.key)]; {
+		case sources[err.key] != "":
+			err.location = sources[err.key]
+		case inFile:
+			err.location, err.line = fmt.Sprintf("%s:%d", file, location.line), location.line
+		default:
+			err.location = file
 		}
 	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].line != 0 && (errs[j].line == 0 || errs[i].line < errs[j].line)
+	})
+	joined := make([]error, len(errs))
+	for i, err := range errs {
+		joined[i] = err
+	}
+	return result, errors.Join(joined...)
+}
 
-	return nil
+// read reads a config file and applies the overrides, without checking
+// the result.
+func read(file string, flags map[string]string) (*loadResult, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	locations := map[string]keyLocation{}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read config file: %w", err)
+		}
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		locations = keyLocations(&root)
+		if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for key, s := range settings {
+		if s.defaultValue != nil {
+			v.SetDefault(key, s.defaultValue)
+		}
+	}
+	sources, err := applyOverrides(v, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &loadResult{
+		cfg:       readConfig(v),
+		v:         v,
+		locations: locations,
+		sources:   sources,
+		warnings:  unknownKeys(file, locations),
+	}, nil
+}
+
+// readConfig builds the configuration from a config file read by v.
+func readConfig(v *viper.Viper) Config {
+	return Config{
+		Encipher:        v.GetString("Encipher"),
+		StorageBasePath: v.GetString("StorageBasePath"),
+		Port:            v.GetInt("Server.port"),
+		LogLevel:        v.GetString("LogLevel"),
+
+		ReadinessTimeout: v.GetDuration("Server.readinessTimeout"),
+		ReadTimeout:      v.GetDuration("Server.readTimeout"),
+		WriteTimeout:     v.GetDuration("Server.writeTimeout"),
+		IdleTimeout:      v.GetDuration("Server.idleTimeout"),
+		DrainTimeout:     v.GetDuration("Server.drainTimeout"),
+
+		TLSEnabled:   v.GetBool("TLS.enabled"),
+		TLSCertFile:  v.GetString("TLS.certFile"),
+		TLSKeyFile:   v.GetString("TLS.keyFile"),
+		HTTP2:        v.GetBool("TLS.http2"),
+		RedirectHTTP: v.GetBool("TLS.redirectHTTP"),
+		RedirectPort: v.GetInt("TLS.redirectPort"),
+
+		HTTP3Enabled: v.GetBool("HTTP3.enabled"),
+		HTTP3Port:    v.GetInt("HTTP3.port"),
+
+		TrustedProxies:  v.GetStringSlice("Proxy.trustedProxies"),
+		RemoteIPHeaders: v.GetStringSlice("Proxy.remoteIPHeaders"),
+		ProxyProtocol:   v.GetBool("Proxy.proxyProtocol"),
+
+		MimeTypes: v.GetStringMapString("MimeTypes"),
+
+		SubtitleCacheSize: int64(v.GetInt("Subtitle.cacheSizeMB")) << 20,
+
+		FontsDirectory: v.GetString("Fonts.directory"),
+		FontSubset:     v.GetBool("Fonts.subset"),
+		FontCacheSize:  int64(v.GetInt("Fonts.cacheSizeMB")) << 20,
+
+		HLSSegmentDuration: v.GetDuration("HLS.segmentDuration"),
+
+		Faststart:          v.GetBool("Faststart.enabled"),
+		FaststartCacheSize: int64(v.GetInt("Faststart.cacheSizeMB")) << 20,
+
+		FFmpegPath: v.GetString("FFmpeg.path"),
+
+		ThumbnailCacheDirectory: v.GetString("Thumbnails.cacheDirectory"),
+		ThumbnailWidth:          v.GetInt("Thumbnails.width"),
+		ThumbnailConcurrency:    v.GetInt("Thumbnails.maxConcurrent"),
+		TrickplayInterval:       v.GetDuration("Thumbnails.trickplayInterval"),
+		TrickplayColumns:        v.GetInt("Thumbnails.spriteColumns"),
+		TrickplayRows:           v.GetInt("Thumbnails.spriteRows"),
+
+		TranscodeEnabled:       v.GetBool("Transcode.enabled"),
+		TranscodeMaxConcurrent: v.GetInt("Transcode.maxConcurrent"),
+		TranscodeIdleTimeout:   v.GetDuration("Transcode.idleTimeout"),
+		TranscodeDirectory:     v.GetString("Transcode.directory"),
+
+		BlockCacheEnabled:   v.GetBool("BlockCache.enabled"),
+		BlockCacheDirectory: v.GetString("BlockCache.directory"),
+		BlockCacheSize:      int64(v.GetInt("BlockCache.sizeGB")) << 30,
+		BlockCacheBlockSize: int64(v.GetInt("BlockCache.blockSizeMB")) << 20,
+		BlockCacheRoots:     v.GetStringSlice("BlockCache.roots"),
+
+		ReadAheadWindow: v.GetDuration("ReadAhead.window"),
+		ReadAheadSize:   int64(v.GetInt("ReadAhead.maxSizeMB")) << 20,
+
+		PrewarmEnabled:   v.GetBool("Prewarm.enabled"),
+		PrewarmThreshold: v.GetFloat64("Prewarm.threshold"),
+		PrewarmSize:      int64(v.GetInt("Prewarm.sizeMB")) << 20,
+
+		AdminEnabled: v.GetBool("Admin.enabled"),
+		AdminAddress: v.GetString("Admin.address"),
+		AdminToken:   v.GetString("Admin.token"),
+	}
 }
 
 // GetConfig returns the global configuration.
 func GetConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	return globalConfig
 }
 
-// defaultLogLevel returns the default log level if no log level is specified.
-func defaultLogLevel(loglevel string) string {
-	if loglevel != "" {
-		return loglevel
-	}
-	return "info"
+// Warnings returns the warnings about the loaded config file, such as unknown keys.
+func Warnings() []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return warnings
 }
 
-// getLogLevel returns the log level from either the parameter or the config file.
-func getLogLevel(loglevel string) string {
-	if loglevel != "" {
-		return loglevel
-	}
-	return viper.GetString("LogLevel")
+// setConfig replaces the global configuration and its warnings.
+func setConfig(cfg Config, fileWarnings []string) {
+	configMu.Lock()
+	globalConfig = cfg
+	warnings = fileWarnings
+	configMu.Unlock()
+}
+
+// IsLoaded reports whether the configuration was successfully loaded.
+func IsLoaded() bool {
+	return loaded
 }
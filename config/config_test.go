@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadSkipsSecretsAndValidation checks that Load, which the healthcheck
+// runs every 30 seconds, neither runs secret commands nor validates, while
+// Check does both.
+func TestLoadSkipsSecretsAndValidation(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "secret-read")
+	file := filepath.Join(dir, "config.yaml")
+	content := "Encipher: \"cmd:touch " + marker + "\"\n" +
+		"StorageBasePath: \"" + filepath.Join(dir, "missing") + "/\"\n" +
+		"Server:\n  port: 60123\nTLS:\n  enabled: true\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(file, map[string]string{"Server.port": "60124"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != 60124 || !cfg.TLSEnabled {
+		t.Errorf("Load read port %d and TLS %v, want 60124 and true", cfg.Port, cfg.TLSEnabled)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("Load ran the secret command: %v", err)
+	}
+
+	if _, err := Check(file, nil); err == nil {
+		t.Error("Check accepted a key of the wrong length")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Check did not run the secret command: %v", err)
+	}
+}
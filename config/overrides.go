@@ -0,0 +1,180 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// envPrefix starts the names of the environment variables overriding settings.
+const envPrefix = "PILIPILI_"
+
+// secretSettings are the settings redacted when the configuration is
+// printed, unless they refer to the source of the secret.
+var secretSettings = map[string]bool{
+	"Encipher":    true,
+	"Admin.token": true,
+}
+
+// keyWords splits a setting key into words at its dots and at the case
+// changes of its camel case parts: Proxy.remoteIPHeaders becomes Proxy,
+// remote, IP and Headers.
+func keyWords(key string) []string {
+	var words []string
+	for _, part := range strings.Split(key, ".") {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			if !unicode.IsUpper(runes[i]) {
+				continue
+			}
+			afterLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			// The last capital of an acronym of two or more letters starts the next word (IPHeaders), but FFmpeg is one word.
+			acronymEnd := i >= 2 && unicode.IsUpper(runes[i-1]) && unicode.IsUpper(runes[i-2]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if afterLower || acronymEnd {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+// EnvName returns the environment variable overriding the setting key,
+// such as PILIPILI_SERVER_PORT for Server.port.
+func EnvName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Join(keyWords(key), "_"))
+}
+
+// FlagName returns the command-line flag overriding the setting key, such
+// as server-port for Server.port.
+func FlagName(key string) string {
+	return strings.ToLower(strings.Join(keyWords(key), "-"))
+}
+
+// settingFlag collects the value of the flag of a setting.
+type settingFlag struct {
+	key    string
+	isBool bool
+	values map[string]string
+}
+
+func (f *settingFlag) String() string { return "" }
+
+func (f *settingFlag) Set(value string) error {
+	f.values[f.key] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be set with a bare flag such as --tls-enabled.
+func (f *settingFlag) IsBoolFlag() bool { return f.isBool }
+
+// RegisterFlags defines a flag on fs for every setting, named by FlagName,
+// and returns the map the values of the flags set are stored in, keyed by
+// setting, once fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		usage := fmt.Sprintf("%s, also set by $%s", key, EnvName(key))
+		fs.Var(&settingFlag{key: key, isBool: settings[key].kind == boolKind, values: values}, FlagName(key), usage)
+	}
+	return values
+}
+
+// HasEnv reports whether any setting is overridden by the environment.
+func HasEnv() bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOverrides sets the settings given by environment variables, then by
+// flags, on v, so that flags take precedence over the environment and both
+// over the config file. It returns where each overridden setting came from.
+func applyOverrides(v *viper.Viper, flags map[string]string) (map[string]string, error) {
+	sources := make(map[string]string)
+	for key, s := range settings {
+		value, source, ok, err := envValue(key)
+		if err != nil {
+			return nil, err
+		}
+		if flagValue, set := flags[key]; set {
+			value, source, ok = flagValue, "--"+FlagName(key), true
+		}
+		if !ok {
+			continue
+		}
+		parsed, err := parseOverride(s.kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", source, key, err)
+		}
+		v.Set(key, parsed)
+		sources[key] = source
+	}
+	return sources, nil
+}
+
+// envValue returns the value of the environment variable of key, or of the
+// file named by its _FILE variant, as used for Docker secrets.
+func envValue(key string) (value, source string, ok bool, err error) {
+	name := EnvName(key)
+	value, ok = os.LookupEnv(name)
+	file, fromFile := os.LookupEnv(name + "_FILE")
+	switch {
+	case ok && fromFile:
+		return "", "", false, fmt.Errorf("both $%s and $%s_FILE are set", name, name)
+	case fromFile:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", "", false, fmt.Errorf("$%s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), "$" + name + "_FILE", true, nil
+	case ok:
+		return value, "$" + name, true, nil
+	}
+	return "", "", false, nil
+}
+
+// parseOverride converts the text of an override to the form YAML decoding
+// gives a setting of kind k. Lists are comma-separated and maps are
+// comma-separated key=value pairs; other kinds are checked later like
+// values of the config file.
+func parseOverride(k kind, value string) (interface{}, error) {
+	switch k {
+	case stringListKind:
+		list := []interface{}{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case stringMapKind:
+		m := map[string]interface{}{}
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected key=value pairs separated by commas, got %q", pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		return m, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"PiliPili_Backend/secret"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+)
+
+// redacted replaces the value of secret settings when the configuration is printed.
+const redacted = "<redacted>"
+
+// Print loads a config file and its overrides like Initialize and returns
+// the effective configuration as YAML in the layout of the config file,
+// with secrets redacted and the origin of every value not from the file as
+// a comment. Validation errors are returned along with the YAML.
+func Print(file string, flags map[string]string) (string, error) {
+	result, err := load(file, flags)
+	if result == nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := map[string]*yaml.Node{}
+	for _, key := range keys {
+		parent, name := root, key
+		if section, field, ok := strings.Cut(key, "."); ok {
+			if sections[section] == nil {
+				sections[section] = &yaml.Node{Kind: yaml.MappingNode}
+				root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: section}, sections[section])
+			}
+			parent, name = sections[section], field
+		}
+
+		var value yaml.Node
+		if encodeErr := value.Encode(effectiveValue(result, key)); encodeErr != nil {
+			return "", encodeErr
+		}
+		// Comments of block lists and maps only stay on their line when set on
+		// the key; empty ones are written inline like scalars.
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+		commented := &value
+		if value.Kind != yaml.ScalarNode && len(value.Content) > 0 {
+			commented = keyNode
+		}
+		switch {
+		case result.sources[key] != "":
+			commented.LineComment = "from " + result.sources[key]
+		case !result.inFile(key):
+			commented.LineComment = "default"
+		}
+		parent.Content = append(parent.Content, keyNode, &value)
+	}
+
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if encodeErr := encoder.Encode(root); encodeErr != nil {
+		return "", encodeErr
+	}
+	encoder.Close()
+	return b.String(), err
+}
+
+// effectiveValue returns the value of the setting key in result, in the
+// form it is written in the config file.
+func effectiveValue(result *loadResult, key string) interface{} {
+	v := result.v
+	if secretSettings[key] && v.GetString(key) != "" && secret.IsLiteral(v.GetString(key)) {
+		return redacted
+	}
+	switch settings[key].kind {
+	case intKind:
+		return v.GetInt(key)
+	case boolKind:
+		return v.GetBool(key)
+	case floatKind:
+		return v.GetFloat64(key)
+	case durationKind:
+		return v.GetDuration(key).String()
+	case stringListKind:
+		return v.GetStringSlice(key)
+	case stringMapKind:
+		return v.GetStringMapString(key)
+	}
+	return v.GetString(key)
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadDebounce groups the burst of file events produced by an editor
+// saving the config file into one reload.
+const reloadDebounce = 500 * time.Millisecond
+
+// Subscriber is called after every reload, with the previous and the new
+// configuration. Both may be equal: a setting naming a secret source is
+// unchanged when the secret it returns changes.
+type Subscriber func(old, cfg Config)
+
+// reloadMu serializes reloads, so subscribers see every change exactly once
+// and in order.
+var (
+	reloadMu    sync.Mutex
+	subscribers []Subscriber
+)
+
+// restartFields are the settings read once at startup, by the listeners or
+// to size caches and worker pools. Changing them takes a restart.
+var restartFields = []string{
+	"Port", "ReadTimeout", "WriteTimeout", "IdleTimeout", "DrainTimeout",
+	"TLSEnabled", "TLSCertFile", "TLSKeyFile", "HTTP2", "RedirectHTTP", "RedirectPort",
+	"HTTP3Enabled", "HTTP3Port", "TrustedProxies", "RemoteIPHeaders", "ProxyProtocol",
+	"SubtitleCacheSize", "FontCacheSize", "FaststartCacheSize", "ThumbnailConcurrency",
+	"TranscodeMaxConcurrent", "BlockCacheEnabled", "BlockCacheDirectory", "BlockCacheSize",
+	"BlockCacheBlockSize", "BlockCacheRoots", "AdminEnabled", "AdminAddress", "AdminToken",
+}
+
+// Subscribe registers fn to be called after every reload.
+func Subscribe(fn Subscriber) {
+	reloadMu.Lock()
+	subscribers = append(subscribers, fn)
+	reloadMu.Unlock()
+}
+
+// Reload reads the config file again and, if it is valid, replaces the
+// global configuration and notifies the subscribers. An invalid config file
+// is an error and leaves the current configuration in place.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if !loaded {
+		return errors.New("the configuration was not initialized")
+	}
+	result, err := load(configFile, flagOverrides)
+	if err != nil {
+		return err
+	}
+	cfg := result.cfg
+	old := GetConfig()
+	setConfig(cfg, result.warnings)
+	for _, fn := range subscribers {
+		fn(old, cfg)
+	}
+	return nil
+}
+
+// RestartRequired returns the names of the settings changed between old and
+// cfg that only take effect after a restart.
+func RestartRequired(old, cfg Config) []string {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(cfg)
+	var changed []string
+	for _, name := range restartFields {
+		if !reflect.DeepEqual(oldValue.FieldByName(name).Interface(), newValue.FieldByName(name).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Watch reloads the configuration when the config file changes or the
+// process receives SIGHUP, and passes the trigger and the outcome of every
+// reload to report. The file is not watched when the configuration only
+// comes from the environment and flags.
+func Watch(report func(trigger string, err error)) {
+	if !loaded {
+		return
+	}
+
+	if configFile != "" {
+		var mu sync.Mutex
+		var timer *time.Timer
+		viper.OnConfigChange(func(fsnotify.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(reloadDebounce, func() {
+				report("config file change", Reload())
+			})
+		})
+		viper.WatchConfig()
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			report("SIGHUP", Reload())
+		}
+	}()
+}
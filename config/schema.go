@@ -0,0 +1,249 @@
+package config
+
+import (
+	"fmt"
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kind is the type of the value of a config file key.
+type kind int
+
+const (
+	stringKind kind = iota
+	intKind
+	boolKind
+	floatKind
+	durationKind
+	stringListKind
+	stringMapKind
+)
+
+// kindNames describe the kinds in error messages.
+var kindNames = map[kind]string{
+	stringKind:     "a string",
+	intKind:        "an integer",
+	boolKind:       "true or false",
+	floatKind:      "a number",
+	durationKind:   `a duration such as "30s" or "5m"`,
+	stringListKind: "a list of strings",
+	stringMapKind:  "a map of strings",
+}
+
+// setting describes a key of the config file.
+type setting struct {
+	kind         kind
+	defaultValue interface{} // used when the key is missing, nil for none
+}
+
+// settings is the schema of the config file. Keys missing from the file take
+// their default value; keys the file sets are checked against their kind.
+var settings = map[string]setting{
+	"LogLevel":        {stringKind, "INFO"},
+	"Encipher":        {stringKind, nil},
+	"StorageBasePath": {stringKind, nil},
+
+	"Server.port":             {intKind, 60002},
+	"Server.readinessTimeout": {durationKind, 2 * time.Second},
+	"Server.readTimeout":      {durationKind, 30 * time.Second},
+	// Disabled by default because a single stream response can legitimately last for hours.
+	"Server.writeTimeout": {durationKind, time.Duration(0)},
+	"Server.idleTimeout":  {durationKind, 120 * time.Second},
+	"Server.drainTimeout": {durationKind, 30 * time.Second},
+
+	"TLS.enabled":      {boolKind, false},
+	"TLS.certFile":     {stringKind, ""},
+	"TLS.keyFile":      {stringKind, ""},
+	"TLS.http2":        {boolKind, true},
+	"TLS.redirectHTTP": {boolKind, false},
+	"TLS.redirectPort": {intKind, 80},
+
+	"HTTP3.enabled": {boolKind, false},
+	"HTTP3.port":    {intKind, 0}, // the server port
+
+	// Defaults matching the shipped nginx configuration, which proxies from the same host.
+	"Proxy.trustedProxies":  {stringListKind, []string{"127.0.0.1", "::1"}},
+	"Proxy.remoteIPHeaders": {stringListKind, []string{"X-Forwarded-For", "X-Real-IP"}},
+	"Proxy.proxyProtocol":   {boolKind, false},
+
+	"MimeTypes": {stringMapKind, map[string]string{}},
+
+	"Subtitle.cacheSizeMB": {intKind, 64},
+
+	"Fonts.directory":   {stringKind, ""},
+	"Fonts.subset":      {boolKind, false},
+	"Fonts.cacheSizeMB": {intKind, 64},
+
+	"HLS.segmentDuration": {durationKind, 6 * time.Second},
+
+	"Faststart.enabled":     {boolKind, true},
+	"Faststart.cacheSizeMB": {intKind, 64},
+
+	"FFmpeg.path": {stringKind, "ffmpeg"},
+
+	// The 10 second interval and 320 pixel width Emby and Jellyfin use for their own trickplay images.
+	"Thumbnails.cacheDirectory":    {stringKind, ""},
+	"Thumbnails.width":             {intKind, 320},
+	"Thumbnails.maxConcurrent":     {intKind, 2},
+	"Thumbnails.trickplayInterval": {durationKind, 10 * time.Second},
+	"Thumbnails.spriteColumns":     {intKind, 10},
+	"Thumbnails.spriteRows":        {intKind, 10},
+
+	// Software encoding takes several cores per stream.
+	"Transcode.enabled":       {boolKind, false},
+	"Transcode.maxConcurrent": {intKind, 2},
+	"Transcode.idleTimeout":   {durationKind, 60 * time.Second},
+	"Transcode.directory":     {stringKind, ""},
+
+	// 4MB blocks match the chunk size of rclone mounts.
+	"BlockCache.enabled":     {boolKind, false},
+	"BlockCache.directory":   {stringKind, ""},
+	"BlockCache.sizeGB":      {intKind, 20},
+	"BlockCache.blockSizeMB": {intKind, 4},
+	"BlockCache.roots":       {stringListKind, []string{}},
+
+	// Enough to ride out a multi-second stall of a network mount.
+	"ReadAhead.window":    {durationKind, 10 * time.Second},
+	"ReadAhead.maxSizeMB": {intKind, 32},
+
+	// 64MB covers the first minute of a typical 1080p episode.
+	"Prewarm.enabled":   {boolKind, false},
+	"Prewarm.threshold": {floatKind, 0.75},
+	"Prewarm.sizeMB":    {intKind, 64},
+
+	"Admin.enabled": {boolKind, false},
+	"Admin.address": {stringKind, "127.0.0.1:60003"}, // reachable from the host only
+	"Admin.token":   {stringKind, ""},
+}
+
+// settingNames maps the lower-cased keys of settings to their canonical
+// spelling, since keys are case-insensitive.
+var settingNames = func() map[string]string {
+	names := make(map[string]string, len(settings))
+	for name := range settings {
+		names[strings.ToLower(name)] = name
+	}
+	return names
+}()
+
+// settingError is a problem with the value of a setting.
+type settingError struct {
+	location string // file:line, file, or the overriding variable or flag
+	line     int    // 0 when the value is not from the file
+	key      string
+	msg      string
+}
+
+func (e *settingError) Error() string {
+	if e.location != "" {
+		return fmt.Sprintf("%s: %s: %s", e.location, e.key, e.msg)
+	}
+	return fmt.Sprintf("%s: %s", e.key, e.msg)
+}
+
+// keyLocation is where a key appears in the config file.
+type keyLocation struct {
+	path string // dotted path as spelled in the file
+	line int
+}
+
+// keyLocations returns the location of every key of the YAML document
+// root, keyed by its lower-cased dotted path.
+func keyLocations(root *yaml.Node) map[string]keyLocation {
+	locations := make(map[string]keyLocation)
+	var walk func(node *yaml.Node, prefix string)
+	walk = func(node *yaml.Node, prefix string) {
+		if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+			walk(node.Content[0], prefix)
+			return
+		}
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			path := prefix + node.Content[i].Value
+			locations[strings.ToLower(path)] = keyLocation{path: path, line: node.Content[i].Line}
+			walk(node.Content[i+1], path+".")
+		}
+	}
+	walk(root, "")
+	return locations
+}
+
+// unknownKeys returns the warnings about keys of the file that are neither
+// settings, sections of settings, nor entries of a map setting.
+func unknownKeys(file string, locations map[string]keyLocation) []string {
+	var unknown []keyLocation
+	for key, location := range locations {
+		if !isKnownKey(key) {
+			unknown = append(unknown, location)
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].line < unknown[j].line })
+	warnings := make([]string, len(unknown))
+	for i, location := range unknown {
+		warnings[i] = fmt.Sprintf("%s:%d: unknown key %s, ignored", file, location.line, location.path)
+	}
+	return warnings
+}
+
+// isKnownKey reports whether the lower-cased path is a setting, a section
+// of settings or an entry of a map setting.
+func isKnownKey(path string) bool {
+	if _, ok := settingNames[path]; ok {
+		return true
+	}
+	for key, name := range settingNames {
+		if strings.HasPrefix(key, path+".") {
+			return true
+		}
+		if settings[name].kind == stringMapKind && strings.HasPrefix(path, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKind reports whether value, as decoded from YAML, can be read as k.
+// Numbers are accepted as quoted strings.
+func checkKind(k kind, value interface{}) bool {
+	var err error
+	switch k {
+	case stringKind:
+		_, err = cast.ToStringE(value)
+	case intKind:
+		_, err = cast.ToIntE(value)
+	case boolKind:
+		_, err = cast.ToBoolE(value)
+	case floatKind:
+		_, err = cast.ToFloat64E(value)
+	case durationKind:
+		switch v := value.(type) {
+		case string:
+			_, err = time.ParseDuration(v)
+		case int:
+			if v != 0 {
+				return false // a bare number has no unit
+			}
+		default:
+			return false
+		}
+	case stringListKind:
+		_, ok := value.([]interface{})
+		return ok
+	case stringMapKind:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range m {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+	}
+	return err == nil
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"PiliPili_Backend/secret"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// logLevels are the accepted values of LogLevel, matched case-insensitively.
+var logLevels = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// validate checks cfg for values the backend cannot run with and returns
+// every problem found, keyed by the config file key at fault.
+func validate(cfg Config) []*settingError {
+	var errs []*settingError
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, &settingError{key: key, msg: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	check(cfg.LogLevel == "" || isLogLevel(cfg.LogLevel), "LogLevel", "must be one of %s, got %q", strings.Join(logLevels, ", "), cfg.LogLevel)
+	if cfg.StorageBasePath == "" {
+		check(false, "StorageBasePath", "is required")
+	} else if err := checkDirectory(cfg.StorageBasePath); err != nil {
+		check(false, "StorageBasePath", "%v", err)
+	}
+	check(validPort(cfg.Port), "Server.port", "must be between 1 and 65535, got %d", cfg.Port)
+	check(cfg.WriteTimeout >= 0, "Server.writeTimeout", "must not be negative, got %s", cfg.WriteTimeout)
+
+	if cfg.TLSEnabled {
+		check(cfg.TLSCertFile != "", "TLS.certFile", "is required when TLS is enabled")
+		check(cfg.TLSKeyFile != "", "TLS.keyFile", "is required when TLS is enabled")
+		if cfg.TLSCertFile != "" {
+			check(isReadable(cfg.TLSCertFile), "TLS.certFile", "cannot read %s", cfg.TLSCertFile)
+		}
+		if cfg.TLSKeyFile != "" {
+			check(isReadable(cfg.TLSKeyFile), "TLS.keyFile", "cannot read %s", cfg.TLSKeyFile)
+		}
+		check(!cfg.RedirectHTTP || validPort(cfg.RedirectPort), "TLS.redirectPort", "must be between 1 and 65535, got %d", cfg.RedirectPort)
+	}
+	if cfg.HTTP3Enabled {
+		check(cfg.TLSEnabled, "HTTP3.enabled", "requires TLS.enabled, QUIC is always encrypted")
+		check(cfg.HTTP3Port == 0 || validPort(cfg.HTTP3Port), "HTTP3.port", "must be between 1 and 65535, got %d", cfg.HTTP3Port)
+	}
+
+	for ext := range cfg.MimeTypes {
+		check(strings.HasPrefix(ext, "."), "MimeTypes", "keys must be file extensions starting with a dot, got %q", ext)
+	}
+
+	check(cfg.SubtitleCacheSize > 0, "Subtitle.cacheSizeMB", "must be positive")
+	if cfg.FontsDirectory != "" {
+		if err := checkDirectory(cfg.FontsDirectory); err != nil {
+			check(false, "Fonts.directory", "%v", err)
+		}
+	}
+	check(cfg.FontCacheSize > 0, "Fonts.cacheSizeMB", "must be positive")
+	check(cfg.HLSSegmentDuration > 0, "HLS.segmentDuration", "must be positive")
+	check(cfg.FaststartCacheSize > 0, "Faststart.cacheSizeMB", "must be positive")
+
+	check(cfg.ThumbnailWidth > 0, "Thumbnails.width", "must be positive, got %d", cfg.ThumbnailWidth)
+	check(cfg.ThumbnailConcurrency > 0, "Thumbnails.maxConcurrent", "must be positive, got %d", cfg.ThumbnailConcurrency)
+	check(cfg.TrickplayInterval > 0, "Thumbnails.trickplayInterval", "must be positive")
+	check(cfg.TrickplayColumns > 0, "Thumbnails.spriteColumns", "must be positive, got %d", cfg.TrickplayColumns)
+	check(cfg.TrickplayRows > 0, "Thumbnails.spriteRows", "must be positive, got %d", cfg.TrickplayRows)
+
+	check(cfg.TranscodeMaxConcurrent > 0, "Transcode.maxConcurrent", "must be positive, got %d", cfg.TranscodeMaxConcurrent)
+	check(cfg.TranscodeIdleTimeout > 0, "Transcode.idleTimeout", "must be positive")
+
+	check(cfg.BlockCacheSize > 0, "BlockCache.sizeGB", "must be positive")
+	check(cfg.BlockCacheBlockSize > 0, "BlockCache.blockSizeMB", "must be positive")
+	check(cfg.BlockCacheBlockSize < cfg.BlockCacheSize, "BlockCache.blockSizeMB", "must be smaller than BlockCache.sizeGB")
+
+	check(cfg.ReadAheadWindow >= 0, "ReadAhead.window", "must not be negative, 0 disables read-ahead")
+	check(cfg.ReadAheadSize > 0, "ReadAhead.maxSizeMB", "must be positive")
+
+	check(cfg.PrewarmThreshold > 0 && cfg.PrewarmThreshold <= 1, "Prewarm.threshold", "must be a fraction between 0 and 1, got %v", cfg.PrewarmThreshold)
+	check(cfg.PrewarmSize > 0, "Prewarm.sizeMB", "must be positive")
+
+	check(!cfg.AdminEnabled || cfg.AdminToken != "", "Admin.token", "is required when the admin API is enabled")
+
+	return errs
+}
+
+// checkSecrets reads the secrets cfg refers to from their sources, such as
+// a file or a command, so that a failing source rejects the config. The
+// secrets are not kept: their users read them again when they apply the
+// config, so they never sit in the config that is passed around.
+func checkSecrets(cfg Config) []*settingError {
+	key, err := secret.Resolve(cfg.Encipher)
+	switch {
+	case err != nil:
+		return []*settingError{{key: "Encipher", msg: err.Error()}}
+	case len(key) != 16:
+		return []*settingError{{key: "Encipher", msg: fmt.Sprintf("must be 16 bytes long for AES-128, got %d", len(key))}}
+	}
+	return nil
+}
+
+// isLogLevel reports whether name is one of logLevels.
+func isLogLevel(name string) bool {
+	for _, level := range logLevels {
+		if strings.EqualFold(name, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPort reports whether port is a valid TCP or UDP port.
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// checkDirectory returns an error unless dir is a directory that can be listed.
+func checkDirectory(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// isReadable reports whether file can be opened for reading.
+func isReadable(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
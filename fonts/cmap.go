@@ -0,0 +1,168 @@
+package fonts
+
+import (
+	"encoding/binary"
+)
+
+// cmapSubtable is a decoded character to glyph mapping.
+type cmapSubtable func(r rune) uint16
+
+// cmapPreference lists the (platform, encoding) pairs consulted, best first.
+var cmapPreference = [][2]uint16{{3, 10}, {0, 6}, {0, 4}, {3, 1}, {0, 3}, {0, 2}, {0, 1}, {0, 0}, {3, 0}}
+
+// newCmapLookup returns a function mapping a character to its glyph ID, or 0
+// when the font has no glyph for it. Every usable subtable is consulted in
+// order of preference. Symbol fonts map characters to the U+F000 block.
+func newCmapLookup(cmap []byte) cmapSubtable {
+	if len(cmap) < 4 {
+		return func(rune) uint16 { return 0 }
+	}
+
+	type record struct {
+		platform, encoding uint16
+		offset             uint32
+	}
+	count := int(binary.BigEndian.Uint16(cmap[2:]))
+	var records []record
+	for i := 0; i < count && 4+8*i+8 <= len(cmap); i++ {
+		entry := cmap[4+8*i:]
+		records = append(records, record{
+			platform: binary.BigEndian.Uint16(entry),
+			encoding: binary.BigEndian.Uint16(entry[2:]),
+			offset:   binary.BigEndian.Uint32(entry[4:]),
+		})
+	}
+
+	var subtables []cmapSubtable
+	symbol := false
+	for _, preferred := range cmapPreference {
+		for _, rec := range records {
+			if rec.platform != preferred[0] || rec.encoding != preferred[1] || int64(rec.offset) >= int64(len(cmap)) {
+				continue
+			}
+			if subtable := parseCmapSubtable(cmap[rec.offset:]); subtable != nil {
+				subtables = append(subtables, subtable)
+				symbol = symbol || (rec.platform == 3 && rec.encoding == 0)
+			}
+		}
+	}
+
+	return func(r rune) uint16 {
+		for _, subtable := range subtables {
+			if gid := subtable(r); gid != 0 {
+				return gid
+			}
+			if symbol && r < 0x100 {
+				if gid := subtable(0xF000 + r); gid != 0 {
+					return gid
+				}
+			}
+		}
+		return 0
+	}
+}
+
+// parseCmapSubtable decodes a format 4 or format 12 subtable.
+func parseCmapSubtable(data []byte) cmapSubtable {
+	if len(data) < 2 {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(data) {
+	case 4:
+		return parseCmapFormat4(data)
+	case 12:
+		return parseCmapFormat12(data)
+	}
+	return nil
+}
+
+// parseCmapFormat4 decodes a segment mapping to delta values subtable (BMP only).
+func parseCmapFormat4(data []byte) cmapSubtable {
+	if len(data) < 14 {
+		return nil
+	}
+	segCount := int(binary.BigEndian.Uint16(data[6:])) / 2
+	endCodes := 14
+	startCodes := endCodes + 2*segCount + 2
+	idDeltas := startCodes + 2*segCount
+	idRangeOffsets := idDeltas + 2*segCount
+	if idRangeOffsets+2*segCount > len(data) {
+		return nil
+	}
+	u16 := func(pos int) uint16 {
+		if pos < 0 || pos+2 > len(data) {
+			return 0
+		}
+		return binary.BigEndian.Uint16(data[pos:])
+	}
+
+	return func(r rune) uint16 {
+		if r < 0 || r > 0xFFFF {
+			return 0
+		}
+		c := uint16(r)
+		// Segments are sorted by end code.
+		lo, hi := 0, segCount
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if u16(endCodes+2*mid) < c {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == segCount || u16(startCodes+2*lo) > c {
+			return 0
+		}
+		delta := u16(idDeltas + 2*lo)
+		rangeOffsetPos := idRangeOffsets + 2*lo
+		rangeOffset := u16(rangeOffsetPos)
+		if rangeOffset == 0 {
+			return c + delta
+		}
+		gid := u16(rangeOffsetPos + int(rangeOffset) + 2*int(c-u16(startCodes+2*lo)))
+		if gid == 0 {
+			return 0
+		}
+		return gid + delta
+	}
+}
+
+// parseCmapFormat12 decodes a segmented coverage subtable.
+func parseCmapFormat12(data []byte) cmapSubtable {
+	if len(data) < 16 {
+		return nil
+	}
+	groups := int(binary.BigEndian.Uint32(data[12:]))
+	if groups < 0 || 16+12*groups > len(data) {
+		return nil
+	}
+	group := func(i int) (uint32, uint32, uint32) {
+		g := data[16+12*i:]
+		return binary.BigEndian.Uint32(g), binary.BigEndian.Uint32(g[4:]), binary.BigEndian.Uint32(g[8:])
+	}
+
+	return func(r rune) uint16 {
+		if r < 0 {
+			return 0
+		}
+		c := uint32(r)
+		lo, hi := 0, groups
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if _, end, _ := group(mid); end < c {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == groups {
+			return 0
+		}
+		start, _, startGlyph := group(lo)
+		if c < start {
+			return 0
+		}
+		return uint16(startGlyph + c - start)
+	}
+}
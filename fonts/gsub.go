@@ -0,0 +1,284 @@
+package fonts
+
+import (
+	"encoding/binary"
+)
+
+// GSUB lookup types whose outputs are followed.
+const (
+	gsubSingle    = 1
+	gsubMultiple  = 2
+	gsubAlternate = 3
+	gsubLigature  = 4
+	gsubExtension = 7
+)
+
+// maxGSUBPasses bounds the fixed point iteration over the GSUB lookups.
+const maxGSUBPasses = 8
+
+// maxGSUBWork bounds the subtable references, coverage entries and
+// substitution records visited while closing over a GSUB table, summed over
+// all passes. Real fonts, CJK ones included, stay far below it; a crafted
+// table that references the same data over and over is given up on and
+// the font is served whole.
+const maxGSUBWork = 1 << 22
+
+// otReader reads big-endian values from an OpenType layout table, returning
+// zero for out-of-bounds reads instead of panicking on malformed fonts.
+type otReader []byte
+
+func (d otReader) u16(pos int) uint16 {
+	if pos < 0 || pos+2 > len(d) {
+		return 0
+	}
+	return binary.BigEndian.Uint16(d[pos:])
+}
+
+func (d otReader) u32(pos int) uint32 {
+	if pos < 0 || pos+4 > len(d) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(d[pos:])
+}
+
+// sub returns the data starting at offset, or nil when it is out of bounds.
+func (d otReader) sub(offset int) otReader {
+	if offset <= 0 || offset >= len(d) {
+		return nil
+	}
+	return d[offset:]
+}
+
+// gsubSubtable is a lookup subtable, with extension subtables resolved to
+// the subtable they wrap.
+type gsubSubtable struct {
+	lookupType int
+	offset     int // from the start of the GSUB table
+}
+
+// gsubClosure collects the glyphs reachable through a GSUB table and the
+// work spent doing so.
+type gsubClosure struct {
+	table otReader
+	keep  map[uint16]bool
+	work  int
+}
+
+// closeOverGSUB adds to keep every glyph that a GSUB substitution can produce
+// from kept glyphs. Contexts are ignored, which may keep a few glyphs too many
+// but never drops one the shaper could select. It returns ErrUnsupportedFont
+// when the table takes more than maxGSUBWork to walk.
+func closeOverGSUB(gsub []byte, keep map[uint16]bool) error {
+	c := &gsubClosure{table: otReader(gsub), keep: keep}
+	subtables, ok := c.subtables()
+	if !ok {
+		return ErrUnsupportedFont
+	}
+
+	for pass := 0; pass < maxGSUBPasses; pass++ {
+		before := len(keep)
+		for _, st := range subtables {
+			if !c.apply(st) {
+				return ErrUnsupportedFont
+			}
+		}
+		if len(keep) == before {
+			return nil
+		}
+	}
+	return nil
+}
+
+// spend accounts for n units of work and reports whether the budget allows it.
+func (c *gsubClosure) spend(n int) bool {
+	c.work += n
+	return c.work <= maxGSUBWork
+}
+
+// subtables returns every distinct subtable of the lookup list, in lookup
+// order. Lookups and subtables referenced several times are listed once.
+func (c *gsubClosure) subtables() ([]gsubSubtable, bool) {
+	listOffset := int(c.table.u16(8))
+	lookupList := c.table.sub(listOffset)
+	if lookupList == nil {
+		return nil, true
+	}
+
+	seenLookups := make(map[int]bool)
+	seen := make(map[gsubSubtable]bool)
+	var subtables []gsubSubtable
+	count := int(lookupList.u16(0))
+	for i := 0; i < count; i++ {
+		offset := int(lookupList.u16(2 + 2*i))
+		lookup := lookupList.sub(offset)
+		if lookup == nil || seenLookups[offset] {
+			continue
+		}
+		seenLookups[offset] = true
+
+		lookupType := int(lookup.u16(0))
+		n := int(lookup.u16(4))
+		if !c.spend(n) {
+			return nil, false
+		}
+		for j := 0; j < n; j++ {
+			st, ok := c.resolve(lookupType, lookup, listOffset+offset, int(lookup.u16(6+2*j)))
+			if ok && !seen[st] {
+				seen[st] = true
+				subtables = append(subtables, st)
+			}
+		}
+	}
+	return subtables, true
+}
+
+// resolve returns the subtable at offset from the lookup starting at
+// lookupOffset in the table, following extension subtables.
+func (c *gsubClosure) resolve(lookupType int, lookup otReader, lookupOffset, offset int) (gsubSubtable, bool) {
+	st := lookup.sub(offset)
+	if st == nil {
+		return gsubSubtable{}, false
+	}
+	offset += lookupOffset
+	if lookupType == gsubExtension {
+		lookupType = int(st.u16(2))
+		extension := st.u32(4)
+		if extension > uint32(len(st)) || st.sub(int(extension)) == nil || lookupType == gsubExtension {
+			return gsubSubtable{}, false
+		}
+		offset += int(extension)
+	}
+	return gsubSubtable{lookupType: lookupType, offset: offset}, true
+}
+
+// apply applies one lookup subtable to keep. It returns false when the work
+// budget runs out.
+func (c *gsubClosure) apply(s gsubSubtable) bool {
+	st := c.table.sub(s.offset)
+	coverage := st.sub(int(st.u16(2)))
+	count := int(st.u16(4))
+	switch s.lookupType {
+	case gsubSingle:
+		switch st.u16(0) {
+		case 1:
+			delta := st.u16(4)
+			return c.forEachCovered(coverage, func(gid uint16, _ int) bool {
+				c.keep[gid+delta] = true
+				return true
+			})
+		case 2:
+			return c.forEachCovered(coverage, func(_ uint16, index int) bool {
+				if index < count {
+					c.keep[st.u16(6+2*index)] = true
+				}
+				return true
+			})
+		}
+	case gsubMultiple, gsubAlternate:
+		return c.forEachCovered(coverage, func(_ uint16, index int) bool {
+			if index >= count {
+				return true
+			}
+			sequence := st.sub(int(st.u16(6 + 2*index)))
+			glyphs := int(sequence.u16(0))
+			if !c.spend(glyphs) {
+				return false
+			}
+			for k := 0; k < glyphs; k++ {
+				c.keep[sequence.u16(2+2*k)] = true
+			}
+			return true
+		})
+	case gsubLigature:
+		return c.forEachCovered(coverage, func(_ uint16, index int) bool {
+			if index >= count {
+				return true
+			}
+			set := st.sub(int(st.u16(6 + 2*index)))
+			ligatures := int(set.u16(0))
+			if !c.spend(ligatures) {
+				return false
+			}
+			for k := 0; k < ligatures; k++ {
+				ligature := set.sub(int(set.u16(2 + 2*k)))
+				components := int(ligature.u16(2))
+				if !c.spend(components) {
+					return false
+				}
+				complete := components > 0
+				for n := 1; n < components; n++ {
+					if !c.keep[ligature.u16(2+2*n)] {
+						complete = false
+						break
+					}
+				}
+				if complete {
+					c.keep[ligature.u16(0)] = true
+				}
+			}
+			return true
+		})
+	}
+	return true
+}
+
+// forEachCovered calls fn with every kept glyph listed in a coverage table and
+// its coverage index, and returns false as soon as fn does or the work budget
+// runs out. Matches are collected first because fn may grow keep.
+func (c *gsubClosure) forEachCovered(coverage otReader, fn func(gid uint16, index int) bool) bool {
+	if coverage == nil {
+		return true
+	}
+	type match struct {
+		gid   uint16
+		index int
+	}
+	var matches []match
+	switch coverage.u16(0) {
+	case 1:
+		n := int(coverage.u16(2))
+		if !c.spend(n) {
+			return false
+		}
+		for i := 0; i < n; i++ {
+			if gid := coverage.u16(4 + 2*i); c.keep[gid] {
+				matches = append(matches, match{gid, i})
+			}
+		}
+	case 2:
+		n := int(coverage.u16(2))
+		for i := 0; i < n; i++ {
+			record := 4 + 6*i
+			start, end, index := uint32(coverage.u16(record)), uint32(coverage.u16(record+2)), int(coverage.u16(record+4))
+			if end < start {
+				continue
+			}
+			// Walk whichever is smaller, the range or the kept glyphs.
+			if span := int(end - start + 1); span <= len(c.keep) {
+				if !c.spend(span) {
+					return false
+				}
+				for gid := start; gid <= end; gid++ {
+					if c.keep[uint16(gid)] {
+						matches = append(matches, match{uint16(gid), index + int(gid-start)})
+					}
+				}
+			} else {
+				if !c.spend(len(c.keep)) {
+					return false
+				}
+				for gid := range c.keep {
+					if uint32(gid) >= start && uint32(gid) <= end {
+						matches = append(matches, match{gid, index + int(uint32(gid)-start)})
+					}
+				}
+			}
+		}
+	}
+	for _, m := range matches {
+		if !fn(m.gid, m.index) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package fonts
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// buildGSUB returns a GSUB table whose lookup list refers lookups times to
+// one lookup of single substitutions with delta 1. The lookup refers
+// references times to each of its distinct subtables, which all cover
+// glyphs 0 to 0xFFFF with a single range.
+func buildGSUB(lookups, references, distinct int) []byte {
+	var b []byte
+	u16 := func(v int) { b = binary.BigEndian.AppendUint16(b, uint16(v)) }
+
+	u16(1) // version 1.0
+	u16(0)
+	u16(0) // ScriptList
+	u16(0) // FeatureList
+	u16(10)
+
+	u16(lookups)
+	for i := 0; i < lookups; i++ {
+		u16(2 + 2*lookups)
+	}
+
+	subtableCount := references * distinct
+	subtablesStart := 6 + 2*subtableCount
+	u16(gsubSingle)
+	u16(0)
+	u16(subtableCount)
+	for r := 0; r < references; r++ {
+		for d := 0; d < distinct; d++ {
+			u16(subtablesStart + 6*d)
+		}
+	}
+	coverageStart := 6 * distinct
+	for d := 0; d < distinct; d++ {
+		u16(1)
+		u16(coverageStart - 6*d)
+		u16(1) // delta
+	}
+	u16(2)
+	u16(1)
+	u16(0)
+	u16(0xFFFF)
+	u16(0)
+	return b
+}
+
+// TestCloseOverGSUBRepeatedReferences checks that lookups and subtables
+// referenced many times are only walked once.
+func TestCloseOverGSUBRepeatedReferences(t *testing.T) {
+	gsub := buildGSUB(200, 200, 1)
+	keep := map[uint16]bool{0: true, 100: true}
+
+	startTime := time.Now()
+	if err := closeOverGSUB(gsub, keep); err != nil {
+		t.Fatalf("closeOverGSUB: %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Fatalf("closeOverGSUB took %s", elapsed)
+	}
+	for _, gid := range []uint16{1, 101, 108} {
+		if !keep[gid] {
+			t.Errorf("glyph %d reachable through the substitution is not kept", gid)
+		}
+	}
+}
+
+// TestCloseOverGSUBWorkBudget checks that a table too expensive to walk is
+// given up on, so the font is served whole.
+func TestCloseOverGSUBWorkBudget(t *testing.T) {
+	gsub := buildGSUB(1, 1, 2000)
+	keep := make(map[uint16]bool)
+	for gid := 0; gid < 4096; gid++ {
+		keep[uint16(gid)] = true
+	}
+
+	startTime := time.Now()
+	if err := closeOverGSUB(gsub, keep); !errors.Is(err, ErrUnsupportedFont) {
+		t.Fatalf("closeOverGSUB = %v, want ErrUnsupportedFont", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 5*time.Second {
+		t.Fatalf("closeOverGSUB took %s before giving up", elapsed)
+	}
+}
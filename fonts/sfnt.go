@@ -0,0 +1,216 @@
+// Package fonts reads the names of TrueType and OpenType fonts and subsets
+// them to the characters a subtitle actually draws.
+package fonts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Font file signatures.
+const (
+	sfntTrueType   = 0x00010000
+	sfntAppleTrue  = 0x74727565 // "true"
+	sfntOpenType   = 0x4F54544F // "OTTO"
+	sfntCollection = 0x74746366 // "ttcf"
+)
+
+// maxNameTableSize bounds the name table loaded from a font.
+const maxNameTableSize = 1 << 20
+
+// Name IDs of the name table entries describing the font family.
+const (
+	nameIDFamily            = 1
+	nameIDFullName          = 4
+	nameIDTypographicFamily = 16
+)
+
+// ErrNotFont is returned for data that is not a TrueType or OpenType font.
+var ErrNotFont = errors.New("not a TrueType or OpenType font")
+
+// table locates one table of an sfnt font.
+type table struct {
+	tag    string
+	offset uint32
+	length uint32
+}
+
+// IsFont reports whether header starts with a TrueType, OpenType or font collection signature.
+func IsFont(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(header) {
+	case sfntTrueType, sfntAppleTrue, sfntOpenType, sfntCollection:
+		return true
+	}
+	return false
+}
+
+// Families returns the family and full names of the font read from r, which
+// is how ASS scripts refer to fonts. Every font of a collection is included.
+func Families(r io.ReaderAt) ([]string, error) {
+	var header [12]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+
+	offsets := []uint32{0}
+	if binary.BigEndian.Uint32(header[:]) == sfntCollection {
+		count := binary.BigEndian.Uint32(header[8:])
+		if count == 0 || count > 256 {
+			return nil, fmt.Errorf("%w: bad collection size %d", ErrNotFont, count)
+		}
+		buf := make([]byte, 4*count)
+		if _, err := r.ReadAt(buf, 12); err != nil {
+			return nil, err
+		}
+		offsets = offsets[:0]
+		for i := uint32(0); i < count; i++ {
+			offsets = append(offsets, binary.BigEndian.Uint32(buf[4*i:]))
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, offset := range offsets {
+		tables, err := readTableDirectory(r, int64(offset))
+		if err != nil {
+			return nil, err
+		}
+		name, ok := findTable(tables, "name")
+		if !ok || name.length > maxNameTableSize {
+			continue
+		}
+		data := make([]byte, name.length)
+		if _, err := r.ReadAt(data, int64(name.offset)); err != nil {
+			return nil, err
+		}
+		for _, n := range parseNames(data) {
+			if key := strings.ToLower(n); !seen[key] {
+				seen[key] = true
+				names = append(names, n)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: no family name", ErrNotFont)
+	}
+	return names, nil
+}
+
+// readTableDirectory reads the table directory of the font starting at offset.
+func readTableDirectory(r io.ReaderAt, offset int64) ([]table, error) {
+	var header [12]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	if !IsFont(header[:]) || binary.BigEndian.Uint32(header[:]) == sfntCollection {
+		return nil, ErrNotFont
+	}
+
+	count := int(binary.BigEndian.Uint16(header[4:]))
+	buf := make([]byte, 16*count)
+	if _, err := r.ReadAt(buf, offset+12); err != nil {
+		return nil, err
+	}
+	tables := make([]table, count)
+	for i := range tables {
+		record := buf[16*i:]
+		tables[i] = table{
+			tag:    string(record[:4]),
+			offset: binary.BigEndian.Uint32(record[8:]),
+			length: binary.BigEndian.Uint32(record[12:]),
+		}
+	}
+	return tables, nil
+}
+
+// findTable returns the table with the given tag.
+func findTable(tables []table, tag string) (table, bool) {
+	for _, t := range tables {
+		if t.tag == tag {
+			return t, true
+		}
+	}
+	return table{}, false
+}
+
+// parseNames returns the distinct family names stored in a name table.
+func parseNames(data []byte) []string {
+	if len(data) < 6 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	storage := int(binary.BigEndian.Uint16(data[4:]))
+
+	type entry struct {
+		nameID int
+		value  string
+	}
+	var entries []entry
+	for i := 0; i < count; i++ {
+		record := 6 + 12*i
+		if record+12 > len(data) {
+			break
+		}
+		platform := binary.BigEndian.Uint16(data[record:])
+		encoding := binary.BigEndian.Uint16(data[record+2:])
+		nameID := int(binary.BigEndian.Uint16(data[record+6:]))
+		length := int(binary.BigEndian.Uint16(data[record+8:]))
+		start := storage + int(binary.BigEndian.Uint16(data[record+10:]))
+		if start+length > len(data) {
+			continue
+		}
+		switch nameID {
+		case nameIDFamily, nameIDFullName, nameIDTypographicFamily:
+		default:
+			continue
+		}
+
+		raw := data[start : start+length]
+		var value string
+		switch {
+		case platform == 0 || (platform == 3 && (encoding == 0 || encoding == 1 || encoding == 10)):
+			value = decodeUTF16BE(raw)
+		case platform == 1 && encoding == 0:
+			decoded, err := charmap.Macintosh.NewDecoder().Bytes(raw)
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		default:
+			continue
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			entries = append(entries, entry{nameID, value})
+		}
+	}
+
+	// Family names first: they are what style definitions normally use.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].nameID < entries[j].nameID })
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range entries {
+		if !seen[e.value] {
+			seen[e.value] = true
+			names = append(names, e.value)
+		}
+	}
+	return names
+}
+
+// decodeUTF16BE decodes big-endian UTF-16 text.
+func decodeUTF16BE(raw []byte) string {
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(raw[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
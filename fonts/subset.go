@@ -0,0 +1,240 @@
+package fonts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// checksumMagic is the constant the head table checksum adjustment is computed from.
+const checksumMagic = 0xB1B0AFBA
+
+// Composite glyph flags.
+const (
+	argsAreWords      = 0x0001
+	weHaveAScale      = 0x0008
+	moreComponents    = 0x0020
+	weHaveXAndYScale  = 0x0040
+	weHaveATwoByTwo   = 0x0080
+	maxCompositeDepth = 16
+)
+
+// ErrUnsupportedFont is returned by Subset for fonts it cannot subset, such
+// as CFF-flavoured OpenType fonts and collections. They are served whole.
+var ErrUnsupportedFont = errors.New("font cannot be subset")
+
+// Subset returns a copy of the TrueType font data in which every glyph that
+// is not needed to draw runes is emptied. Glyph IDs are preserved, so cmap,
+// metrics and layout tables stay valid and only glyf and loca shrink. Glyphs
+// reachable through GSUB substitutions (ligatures, vertical forms, shaping)
+// and composite glyph components are kept.
+func Subset(data []byte, runes []rune) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, ErrNotFont
+	}
+	switch binary.BigEndian.Uint32(data) {
+	case sfntTrueType, sfntAppleTrue:
+	case sfntOpenType, sfntCollection:
+		return nil, ErrUnsupportedFont
+	default:
+		return nil, ErrNotFont
+	}
+
+	tables, err := readTableDirectory(bytes.NewReader(data), 0)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string][]byte, len(tables))
+	for _, t := range tables {
+		end := uint64(t.offset) + uint64(t.length)
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: table %q out of bounds", ErrNotFont, t.tag)
+		}
+		raw[t.tag] = data[t.offset:end]
+	}
+
+	head, maxp, loca, glyf, cmap := raw["head"], raw["maxp"], raw["loca"], raw["glyf"], raw["cmap"]
+	if len(head) < 54 || len(maxp) < 6 || loca == nil || glyf == nil || cmap == nil {
+		return nil, ErrUnsupportedFont
+	}
+
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	offsets, err := parseLoca(loca, numGlyphs, int16(binary.BigEndian.Uint16(head[50:])))
+	if err != nil {
+		return nil, err
+	}
+	glyph := func(gid uint16) []byte {
+		if int(gid) >= numGlyphs {
+			return nil
+		}
+		start, end := offsets[gid], offsets[gid+1]
+		if start >= end || end > uint32(len(glyf)) {
+			return nil
+		}
+		return glyf[start:end]
+	}
+
+	keep := map[uint16]bool{0: true}
+	lookup := newCmapLookup(cmap)
+	for _, r := range runes {
+		if gid := lookup(r); gid != 0 {
+			keep[gid] = true
+		}
+	}
+	if gsub := raw["GSUB"]; gsub != nil {
+		if err := closeOverGSUB(gsub, keep); err != nil {
+			return nil, err
+		}
+	}
+	for gid := range keep {
+		addComponents(glyph, gid, keep, 0)
+	}
+
+	// Rebuild glyf and a long-format loca with only the kept outlines.
+	var newGlyf bytes.Buffer
+	newLoca := make([]byte, 4*(numGlyphs+1))
+	for gid := 0; gid < numGlyphs; gid++ {
+		binary.BigEndian.PutUint32(newLoca[4*gid:], uint32(newGlyf.Len()))
+		if keep[uint16(gid)] {
+			newGlyf.Write(glyph(uint16(gid)))
+			for newGlyf.Len()%4 != 0 {
+				newGlyf.WriteByte(0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[4*numGlyphs:], uint32(newGlyf.Len()))
+
+	newHead := append([]byte(nil), head...)
+	binary.BigEndian.PutUint32(newHead[8:], 0)  // checkSumAdjustment
+	binary.BigEndian.PutUint16(newHead[50:], 1) // indexToLocFormat: long
+
+	raw["glyf"] = newGlyf.Bytes()
+	raw["loca"] = newLoca
+	raw["head"] = newHead
+	// The digital signature no longer matches the modified font.
+	delete(raw, "DSIG")
+
+	return assemble(binary.BigEndian.Uint32(data), raw), nil
+}
+
+// parseLoca decodes the glyph offsets of a loca table in short or long format.
+func parseLoca(loca []byte, numGlyphs int, format int16) ([]uint32, error) {
+	offsets := make([]uint32, numGlyphs+1)
+	switch format {
+	case 0:
+		if len(loca) < 2*(numGlyphs+1) {
+			return nil, fmt.Errorf("%w: short loca table", ErrNotFont)
+		}
+		for i := range offsets {
+			offsets[i] = 2 * uint32(binary.BigEndian.Uint16(loca[2*i:]))
+		}
+	case 1:
+		if len(loca) < 4*(numGlyphs+1) {
+			return nil, fmt.Errorf("%w: short loca table", ErrNotFont)
+		}
+		for i := range offsets {
+			offsets[i] = binary.BigEndian.Uint32(loca[4*i:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown loca format %d", ErrNotFont, format)
+	}
+	return offsets, nil
+}
+
+// addComponents marks the components of a composite glyph as kept.
+func addComponents(glyph func(uint16) []byte, gid uint16, keep map[uint16]bool, depth int) {
+	data := glyph(gid)
+	if len(data) < 10 || int16(binary.BigEndian.Uint16(data)) >= 0 || depth > maxCompositeDepth {
+		return
+	}
+	for pos := 10; pos+4 <= len(data); {
+		flags := binary.BigEndian.Uint16(data[pos:])
+		component := binary.BigEndian.Uint16(data[pos+2:])
+		if !keep[component] {
+			keep[component] = true
+			addComponents(glyph, component, keep, depth+1)
+		}
+
+		pos += 4
+		if flags&argsAreWords != 0 {
+			pos += 4
+		} else {
+			pos += 2
+		}
+		switch {
+		case flags&weHaveAScale != 0:
+			pos += 2
+		case flags&weHaveXAndYScale != 0:
+			pos += 4
+		case flags&weHaveATwoByTwo != 0:
+			pos += 8
+		}
+		if flags&moreComponents == 0 {
+			break
+		}
+	}
+}
+
+// assemble writes an sfnt font from its tables, recomputing the table
+// checksums and the head checksum adjustment.
+func assemble(version uint32, tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	count := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= count {
+		entrySelector++
+	}
+	searchRange := (1 << entrySelector) * 16
+
+	out := make([]byte, 12+16*count)
+	binary.BigEndian.PutUint32(out, version)
+	binary.BigEndian.PutUint16(out[4:], uint16(count))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(count*16-searchRange))
+
+	headOffset := -1
+	for i, tag := range tags {
+		data := tables[tag]
+		if tag == "head" {
+			headOffset = len(out)
+		}
+		record := out[12+16*i:]
+		copy(record, tag)
+		binary.BigEndian.PutUint32(record[4:], checksum(data))
+		binary.BigEndian.PutUint32(record[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(data)))
+
+		out = append(out, data...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+
+	if headOffset >= 0 {
+		binary.BigEndian.PutUint32(out[headOffset+8:], checksumMagic-checksum(out))
+	}
+	return out
+}
+
+// checksum computes the sfnt checksum of data, zero padded to a multiple of four bytes.
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for len(data) >= 4 {
+		sum += binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+	if len(data) > 0 {
+		var tail [4]byte
+		copy(tail[:], data)
+		sum += binary.BigEndian.Uint32(tail[:])
+	}
+	return sum
+}
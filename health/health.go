@@ -0,0 +1,150 @@
+// Package health provides the liveness, readiness and version endpoints used by
+// container healthchecks and load balancers.
+package health
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/streamer"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Check is the result of a single readiness check.
+type Check struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Elapsed string `json:"elapsed,omitempty"`
+}
+
+// pendingChecks tracks storage checks that are still running so a hung mount
+// does not accumulate one goroutine per probe.
+var (
+	pendingMu     sync.Mutex
+	pendingChecks = make(map[string]bool)
+)
+
+// Liveness reports that the process is up and able to serve HTTP requests.
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness reports whether the backend is able to serve streams: the config
+// is loaded, the Signature is initialized and every storage root is readable
+// within the configured latency budget.
+func Readiness(c *gin.Context) {
+	checks := map[string]Check{
+		"config":    checkConfig(),
+		"signature": checkSignature(),
+		"draining":  checkDraining(),
+	}
+	timeout := config.GetConfig().ReadinessTimeout
+	for _, root := range storageRoots() {
+		checks["storage:"+root] = checkStorageRoot(root, timeout)
+	}
+
+	status := http.StatusOK
+	result := "ok"
+	for name, check := range checks {
+		if check.Status != "ok" {
+			logger.Warn("Readiness check failed", "check", name, "error", check.Error)
+			status = http.StatusServiceUnavailable
+			result = "unavailable"
+		}
+	}
+
+	c.JSON(status, gin.H{"status": result, "checks": checks})
+}
+
+// checkConfig verifies that the configuration was read from a config file.
+func checkConfig() Check {
+	if !config.IsLoaded() {
+		return Check{Status: "fail", Error: "configuration file not loaded"}
+	}
+	return Check{Status: "ok"}
+}
+
+// checkSignature verifies that the global Signature instance is initialized.
+func checkSignature() Check {
+	if _, err := streamer.GetSignatureInstance(); err != nil {
+		return Check{Status: "fail", Error: err.Error()}
+	}
+	return Check{Status: "ok"}
+}
+
+// checkDraining fails once a shutdown has started so load balancers stop routing new streams here.
+func checkDraining() Check {
+	if streamer.IsDraining() {
+		return Check{Status: "fail", Error: "server is draining"}
+	}
+	return Check{Status: "ok"}
+}
+
+// storageRoots returns the storage directories that must be readable for the backend to be ready.
+func storageRoots() []string {
+	if root := config.GetConfig().StorageBasePath; root != "" {
+		return []string{root}
+	}
+	return nil
+}
+
+// checkStorageRoot verifies that root can be opened and listed within timeout.
+func checkStorageRoot(root string, timeout time.Duration) Check {
+	pendingMu.Lock()
+	if pendingChecks[root] {
+		pendingMu.Unlock()
+		return Check{Status: "fail", Error: "previous check still pending"}
+	}
+	pendingChecks[root] = true
+	pendingMu.Unlock()
+
+	startTime := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			pendingMu.Lock()
+			delete(pendingChecks, root)
+			pendingMu.Unlock()
+		}()
+		done <- readDir(root)
+	}()
+
+	select {
+	case err := <-done:
+		elapsed := time.Since(startTime).String()
+		if err != nil {
+			return Check{Status: "fail", Error: err.Error(), Elapsed: elapsed}
+		}
+		return Check{Status: "ok", Elapsed: elapsed}
+	case <-time.After(timeout):
+		return Check{Status: "fail", Error: "timed out after " + timeout.String(), Elapsed: timeout.String()}
+	}
+}
+
+// readDir opens root and reads a single directory entry from it.
+func readDir(root string) error {
+	dir, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	info, err := dir.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	// An empty directory is still readable, so io.EOF is not an error here.
+	if _, err := dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"PiliPili_Backend/config"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// probeTimeout bounds a healthcheck request, within the timeout of the
+// Docker healthcheck.
+const probeTimeout = 4 * time.Second
+
+// Probe requests the liveness endpoint, or the readiness endpoint when ready
+// is set, of the server listening on the loopback interface with cfg, and
+// returns an error unless it answers 200 OK. It backs the "pilipili health"
+// command used by container healthchecks, so they follow the configured
+// port and TLS setting.
+func Probe(cfg config.Config, ready bool) error {
+	scheme, path := "http", "/healthz"
+	if cfg.TLSEnabled {
+		scheme = "https"
+	}
+	if ready {
+		path = "/readyz"
+	}
+	url := scheme + "://127.0.0.1:" + strconv.Itoa(cfg.Port) + path
+
+	client := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			// The certificate names the public host rather than the loopback address.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build information, overridden at build time with
+// -ldflags "-X PiliPili_Backend/health.Version=v1.2.3 -X PiliPili_Backend/health.Commit=abc123".
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+// startTime records when the process started, used to report uptime.
+var startTime = time.Now()
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	Uptime    string `json:"uptime"`
+}
+
+// GetBuildInfo returns the build information of the running binary, falling
+// back to the VCS details embedded by the Go toolchain when no ldflags were set.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// VersionInfo returns the build information of the running binary.
+func VersionInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, GetBuildInfo())
+}
@@ -1,10 +1,12 @@
 package logger
 
 import (
+	"PiliPili_Backend/config"
 	"fmt"
 	"github.com/fatih/color"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,7 +20,7 @@ const (
 
 // Logger struct to hold the current log level
 type Logger struct {
-	level int
+	level atomic.Int32 // changed at runtime through SetLevel
 }
 
 // Global logger instance (accessible across the app)
@@ -31,15 +33,16 @@ var (
 // It only initializes the logger once
 func New(level int) *Logger {
 	once.Do(func() {
-		loggerInstance = &Logger{level: level}
+		loggerInstance = &Logger{}
+		loggerInstance.level.Store(int32(level))
 		fmt.Printf("Logger initialized with level: %d\n", level)
 	})
 	return loggerInstance
 }
 
 // log is an internal function to print messages with a specific log level and color
-func (l *Logger) log(level int, format string, args ...interface{}) {
-	if level < l.level {
+func (l *Logger) log(level int, msg string, args ...interface{}) {
+	if int32(level) < l.level.Load() {
 		return
 	}
 
@@ -65,35 +68,100 @@ func (l *Logger) log(level int, format string, args ...interface{}) {
 	}
 
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	msg := fmt.Sprintf(format, args...)
-	fmt.Printf("%s %s %s\n", colorFunc(timestamp), colorFunc(levelStr), msg)
+	fmt.Printf("%s %s %s\n", colorFunc(timestamp), colorFunc(levelStr), formatMessage(msg, args))
+}
+
+// formatMessage renders a log message followed by args as key=value pairs,
+// as in logger.Info("File opened", "path", path). The message is never used
+// as a format string.
+func formatMessage(msg string, args []interface{}) string {
+	if len(args) == 0 {
+		return msg
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", args[i])
+		}
+	}
+	return b.String()
 }
 
 // InitializeLogger creates a global logger instance based on the provided log level.
 // This is an internal method, so it uses a lowercase name.
 func InitializeLogger(level string) {
-	if level == "" {
-		level = "INFO"
-	}
-	level = strings.ToUpper(level)
-
-	var logLevel int
-	switch level {
-	case "WARN":
-		logLevel = WARN
-	case "INFO":
-		logLevel = INFO
-	case "DEBUG":
-		logLevel = DEBUG
-	case "ERROR":
-		logLevel = ERROR
-	default:
+	logLevel, ok := parseLevel(level)
+	if !ok {
 		logLevel = INFO
 	}
 
 	loggerInstance = New(logLevel)
-	loggerInstance.level = logLevel
-	loggerInstance.log(INFO, "Initialized logger with level: %d\n", logLevel)
+	loggerInstance.level.Store(int32(logLevel))
+	loggerInstance.log(INFO, "Initialized logger", "level", logLevel)
+}
+
+// levelNames maps level names to levels.
+var levelNames = map[string]int{
+	"WARN":  WARN,
+	"INFO":  INFO,
+	"DEBUG": DEBUG,
+	"ERROR": ERROR,
+}
+
+// parseLevel returns the level called name, INFO when name is empty.
+func parseLevel(name string) (int, bool) {
+	if name == "" {
+		return INFO, true
+	}
+	level, ok := levelNames[strings.ToUpper(name)]
+	return level, ok
+}
+
+// SetLevel changes the level of the global logger at runtime.
+func SetLevel(name string) error {
+	level, ok := parseLevel(name)
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	if loggerInstance == nil {
+		InitializeLogger(name)
+		return nil
+	}
+	loggerInstance.level.Store(int32(level))
+	return nil
+}
+
+// Level returns the name of the current level of the global logger.
+func Level() string {
+	if loggerInstance == nil {
+		return ""
+	}
+	level := int(loggerInstance.level.Load())
+	for name, l := range levelNames {
+		if l == level {
+			return name
+		}
+	}
+	return ""
+}
+
+// WatchConfig keeps the level of the global logger in sync with the LogLevel
+// setting when the config is reloaded.
+func WatchConfig() {
+	config.Subscribe(func(old, cfg config.Config) {
+		if strings.EqualFold(old.LogLevel, cfg.LogLevel) {
+			return
+		}
+		if err := SetLevel(cfg.LogLevel); err != nil {
+			Warn("Keeping the current log level", "error", err)
+			return
+		}
+		Info("Log level changed", "level", Level())
+	})
 }
 
 // SetDefaultLogger initializes the global logger with the default log level "WARN".
@@ -103,33 +171,33 @@ func SetDefaultLogger() {
 }
 
 // Warn logs an info level message
-func Warn(format string, args ...interface{}) {
+func Warn(msg string, args ...interface{}) {
 	if loggerInstance == nil {
 		return
 	}
-	loggerInstance.log(WARN, format, args...)
+	loggerInstance.log(WARN, msg, args...)
 }
 
 // Info logs an info level message
-func Info(format string, args ...interface{}) {
+func Info(msg string, args ...interface{}) {
 	if loggerInstance == nil {
 		return
 	}
-	loggerInstance.log(INFO, format, args...)
+	loggerInstance.log(INFO, msg, args...)
 }
 
 // Debug logs a debug level message
-func Debug(format string, args ...interface{}) {
+func Debug(msg string, args ...interface{}) {
 	if loggerInstance == nil {
 		return
 	}
-	loggerInstance.log(DEBUG, format, args...)
+	loggerInstance.log(DEBUG, msg, args...)
 }
 
 // Error logs an error level message
-func Error(format string, args ...interface{}) {
+func Error(msg string, args ...interface{}) {
 	if loggerInstance == nil {
 		return
 	}
-	loggerInstance.log(ERROR, format, args...)
+	loggerInstance.log(ERROR, msg, args...)
 }
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"PiliPili_Backend/admin"
 	"PiliPili_Backend/config" // Import config package
+	"PiliPili_Backend/health"
 	"PiliPili_Backend/logger"
 	"PiliPili_Backend/middleware" // Import middleware package
-	"PiliPili_Backend/streamer"   // Import streamer package
+	"PiliPili_Backend/server"
+	"PiliPili_Backend/streamer" // Import streamer package
+	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net/http"
 	"os"
-	"strconv"
+	"strings"
 )
 
-// initializeConfig initializes the configuration from the config file.
-func initializeConfig(configFile string) error {
+// initializeConfig initializes the configuration from the config file, the environment and flags.
+func initializeConfig(configFile string, flags map[string]string) error {
 	logger.Info("Initializing config...")
 
-	err := config.Initialize(configFile, "")
+	err := config.Initialize(configFile, flags)
 	if err != nil {
 		log.Printf("Error initializing config: %v", err)
 		return err
@@ -27,6 +32,9 @@ func initializeConfig(configFile string) error {
 	// LogLevel is now part of the config package
 	loglevel := config.GetConfig().LogLevel
 	logger.InitializeLogger(loglevel)
+	for _, warning := range config.Warnings() {
+		logger.Warn(warning)
+	}
 
 	// Initialize the Signature instance
 	encipher := config.GetConfig().Encipher
@@ -36,51 +44,126 @@ func initializeConfig(configFile string) error {
 	}
 	logger.Info("Signature initialized successfully")
 
+	streamer.InitializeMimeTypes(config.GetConfig().MimeTypes)
+
 	return nil
 }
 
+// watchConfig reloads the configuration when the config file changes or on
+// SIGHUP, applying it to the logger and the streamer.
+func watchConfig() {
+	logger.WatchConfig()
+	streamer.WatchConfig()
+	config.Subscribe(func(old, cfg config.Config) {
+		if changed := config.RestartRequired(old, cfg); len(changed) > 0 {
+			logger.Warn("Some changed settings only take effect after a restart", "settings", strings.Join(changed, ", "))
+		}
+	})
+	config.Watch(func(trigger string, err error) {
+		if err != nil {
+			logger.Error("Rejected config reload, keeping the current config", "trigger", trigger, "error", err)
+			return
+		}
+		logger.Info("Config reloaded", "trigger", trigger)
+	})
+}
+
 // initializeGinEngine initializes the Gin engine with the necessary middlewares and routes.
-func initializeGinEngine() *gin.Engine {
+func initializeGinEngine() (*gin.Engine, error) {
 	logger.Info("Initializing Gin engine...")
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
-	r.Use(middleware.CorsMiddleware())
+
+	// Only trust forwarding headers from the configured reverse proxies so that
+	// c.ClientIP() resolves the real viewer instead of the proxy address.
+	cfg := config.GetConfig()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Error("Invalid trusted proxies", "error", err)
+		return nil, err
+	}
+	r.RemoteIPHeaders = cfg.RemoteIPHeaders
+
+	// Probe endpoints are registered before the CORS middleware so that
+	// healthchecks do not flood the request logs.
+	r.GET("/healthz", health.Liveness)
+	r.GET("/readyz", health.Readiness)
+	r.GET("/version", health.VersionInfo)
+
+	// Media endpoints are counted by the drain on shutdown.
+	r.Use(middleware.CorsMiddleware(), streamer.Drain())
 	r.GET("/stream", streamer.Remote)
+	r.GET("/subtitle", streamer.Subtitle)
+	r.GET("/mkv/tracks", streamer.MkvTracks)
+	r.GET("/mkv/subtitle", streamer.MkvSubtitle)
+	r.GET("/mkv/attachment", streamer.MkvAttachment)
+	r.GET("/fonts", streamer.Fonts)
+	r.GET("/fonts/file", streamer.FontFile)
+	r.GET("/hls/master.m3u8", streamer.HLSMaster)
+	r.GET("/hls/playlist.m3u8", streamer.HLSPlaylist)
+	r.GET("/hls/init.mp4", streamer.HLSInit)
+	r.GET("/hls/segment.m4s", streamer.HLSSegment)
+	r.GET("/dash/manifest.mpd", streamer.DashManifest)
+	r.GET("/probe", streamer.Probe)
+	r.GET("/thumbnail", streamer.Thumbnail)
+	r.GET("/trickplay/index.bif", streamer.TrickplayBIF)
+	r.GET("/trickplay/sprites.vtt", streamer.TrickplaySprites)
+	r.GET("/trickplay/sprite.jpg", streamer.TrickplaySprite)
+	r.GET("/transcode", streamer.Transcode)
+	r.GET("/transcode/hls", streamer.TranscodeHLS)
+	r.GET("/transcode/hls/:session/:file", streamer.TranscodeHLSFile)
 
 	logger.Info("Gin engine initialized successfully")
-	return r
+	return r, nil
 }
 
-// startServer starts the Gin server on the configured port.
-func startServer(r *gin.Engine) error {
-	logger.Info("Starting the server...")
-
-	port := config.GetConfig().Port
-	if port == 0 {
-		port = 60002
+// initializeAdminEngine initializes the admin API engine, or returns nil when the admin API is disabled.
+func initializeAdminEngine() (http.Handler, error) {
+	cfg := config.GetConfig()
+	if !cfg.AdminEnabled {
+		return nil, nil
 	}
-	err := r.Run("0.0.0.0:" + strconv.Itoa(port))
+	engine, err := admin.NewEngine(cfg.AdminToken)
 	if err != nil {
-		logger.Error("Error starting server: %v", err)
+		logger.Error("Failed to initialize admin API", "error", err)
+		return nil, err
+	}
+	logger.Info("Admin API initialized successfully")
+	return engine, nil
+}
+
+// startServer starts the HTTP server on the configured port and blocks until it has shut down.
+func startServer(r *gin.Engine, adminEngine http.Handler) error {
+	logger.Info("Starting the server...")
+
+	if err := server.Run(r, adminEngine); err != nil {
+		logger.Error("Error running server", "error", err)
 		return err
 	}
 
-	logger.Info("Server started successfully on port", port)
+	logger.Info("Server stopped")
 	return nil
 }
 
 // handleRequest processes the entire request handling flow.
-func handleRequest(configFile string) error {
+func handleRequest(configFile string, flags map[string]string) error {
 	logger.SetDefaultLogger()
 	logger.Info("\n-----------------------------------------------\n")
 	logger.Info("Start request handle.")
 
-	if err := initializeConfig(configFile); err != nil {
+	if err := initializeConfig(configFile, flags); err != nil {
 		return err
 	}
-	r := initializeGinEngine()
-	if err := startServer(r); err != nil {
+	watchConfig()
+	r, err := initializeGinEngine()
+	if err != nil {
+		return err
+	}
+	adminEngine, err := initializeAdminEngine()
+	if err != nil {
+		return err
+	}
+	if err := startServer(r, adminEngine); err != nil {
 		return err
 	}
 
@@ -89,15 +172,48 @@ func handleRequest(configFile string) error {
 	return nil
 }
 
+// parseArgs splits args into the config file, which may be omitted when
+// the environment provides the configuration, and the values of the setting
+// flags, given before or after the file. Errors are reported on stderr.
+func parseArgs(name string, args []string) (string, map[string]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if fs.NArg() == 0 {
+		return "", flags, nil
+	}
+	configFile := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", nil, err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument %q", fs.Arg(0))
+		fmt.Fprintln(fs.Output(), err)
+		return "", nil, err
+	}
+	return configFile, flags, nil
+}
+
 func main() {
 	args := os.Args[1:]
-	if len(args) == 0 {
-		fmt.Println("Please provide the configuration file as an argument.")
+	if len(args) == 0 && !config.HasEnv() {
+		fmt.Println("Please provide the configuration file as an argument, or a command: probe <file>, config check|print [file], health live|ready [file].")
+		fmt.Println("Settings can be overridden with PILIPILI_* environment variables and flags, see -h.")
 		return
 	}
-	configFile := args[0]
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			os.Exit(command(args[1:]))
+		}
+	}
+	configFile, flags, err := parseArgs("pilipili", args)
+	if err != nil {
+		os.Exit(2)
+	}
 
-	if err := handleRequest(configFile); err != nil {
+	if err := handleRequest(configFile, flags); err != nil {
 		log.Fatalf("Request handling failed: %v", err)
 	}
 }
@@ -11,17 +11,18 @@ import (
 func CorsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		logger.Info("Incoming request details:")
-		logger.Info("Request Method: %s", c.Request.Method)
-		logger.Info("Request Path: %s", c.Request.URL.Path)
-		logger.Info("Request Headers: %v", c.Request.Header)
+		logger.Info("Request Method", "method", c.Request.Method)
+		logger.Info("Request Path", "path", c.Request.URL.Path)
+		logger.Info("Client IP", "ip", c.ClientIP())
+		logger.Info("Request Headers", "headers", c.Request.Header)
 
 		if c.Request.Method == "POST" || c.Request.Method == "PUT" {
 			body, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				logger.Error("Error reading request body: %v", err)
+				logger.Error("Error reading request body", "error", err)
 			} else {
 				c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
-				logger.Info("Request Body: %s", body)
+				logger.Info("Request Body", "body", string(body))
 			}
 		}
 
@@ -29,8 +30,8 @@ func CorsMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
-		logger.Info("Setting CORS headers for request: %s %s", c.Request.Method, c.Request.URL.Path)
-		logger.Info("Response Headers: %v", c.Writer.Header())
+		logger.Info("Setting CORS headers for request", "method", c.Request.Method, "path", c.Request.URL.Path)
+		logger.Info("Response Headers", "headers", c.Writer.Header())
 
 		if c.Request.Method == "OPTIONS" {
 			logger.Error("OPTIONS request received, aborting with status 204")
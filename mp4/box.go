@@ -0,0 +1,202 @@
+// Package mp4 reads the sample tables of ISO base media (MP4/MOV) files and
+// writes fragmented MP4 initialization and media segments.
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxBoxLoad bounds the size of a box loaded into memory, such as moov.
+const maxBoxLoad = 256 * 1024 * 1024
+
+// ErrInvalidBox is returned for truncated or malformed boxes.
+var ErrInvalidBox = errors.New("invalid MP4 box")
+
+// BoxHeader locates a box within a file.
+type BoxHeader struct {
+	Type       string
+	Offset     int64 // offset of the box header
+	Size       int64 // total size, header included
+	HeaderSize int64
+}
+
+// DataOffset returns the offset of the box payload.
+func (h BoxHeader) DataOffset() int64 {
+	return h.Offset + h.HeaderSize
+}
+
+// End returns the offset just past the box.
+func (h BoxHeader) End() int64 {
+	return h.Offset + h.Size
+}
+
+// ReadBoxHeader reads the header of the box at offset. A size of zero, which
+// extends the box to the end of its container, is resolved against limit.
+func ReadBoxHeader(r io.ReaderAt, offset, limit int64) (BoxHeader, error) {
+	var buf [16]byte
+	n, err := r.ReadAt(buf[:], offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return BoxHeader{}, err
+	}
+
+	h := BoxHeader{
+		Type:       string(buf[4:8]),
+		Offset:     offset,
+		Size:       int64(binary.BigEndian.Uint32(buf[:])),
+		HeaderSize: 8,
+	}
+	switch h.Size {
+	case 0:
+		h.Size = limit - offset
+	case 1:
+		if n < 16 {
+			return BoxHeader{}, io.ErrUnexpectedEOF
+		}
+		h.Size = int64(binary.BigEndian.Uint64(buf[8:]))
+		h.HeaderSize = 16
+	}
+	if h.Size < h.HeaderSize || h.End() > limit {
+		return BoxHeader{}, fmt.Errorf("%w: %q at %d has size %d", ErrInvalidBox, h.Type, offset, h.Size)
+	}
+	return h, nil
+}
+
+// ReadTopLevel lists the top-level boxes of a file of the given size.
+func ReadTopLevel(r io.ReaderAt, size int64) ([]BoxHeader, error) {
+	var boxes []BoxHeader
+	for offset := int64(0); offset+8 <= size; {
+		h, err := ReadBoxHeader(r, offset, size)
+		if err != nil {
+			if len(boxes) > 0 {
+				// Trailing garbage after the last complete box is common and harmless.
+				break
+			}
+			return nil, err
+		}
+		boxes = append(boxes, h)
+		offset = h.End()
+	}
+	return boxes, nil
+}
+
+// LoadBox reads the payload of the box described by h.
+func LoadBox(r io.ReaderAt, h BoxHeader) ([]byte, error) {
+	size := h.Size - h.HeaderSize
+	if size > maxBoxLoad {
+		return nil, fmt.Errorf("%w: %q is too large to load (%d bytes)", ErrInvalidBox, h.Type, size)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, h.DataOffset()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Box is a box parsed from an in-memory container payload.
+type Box struct {
+	Type string
+	Data []byte // payload
+	Raw  []byte // header and payload
+}
+
+// ParseBoxes splits a container payload into its child boxes.
+func ParseBoxes(data []byte) ([]Box, error) {
+	var boxes []Box
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		header := 8
+		switch size {
+		case 0:
+			size = uint64(len(data) - pos)
+		case 1:
+			if pos+16 > len(data) {
+				return boxes, fmt.Errorf("%w: truncated large box", ErrInvalidBox)
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			header = 16
+		}
+		if size < uint64(header) || uint64(pos)+size > uint64(len(data)) {
+			return boxes, fmt.Errorf("%w: %q has size %d", ErrInvalidBox, data[pos+4:pos+8], size)
+		}
+		end := pos + int(size)
+		boxes = append(boxes, Box{Type: string(data[pos+4 : pos+8]), Data: data[pos+header : end], Raw: data[pos:end]})
+		pos = end
+	}
+	return boxes, nil
+}
+
+// FindBox returns the payload of the first box reached through path, such as
+// "mdia", "minf", "stbl", or nil when there is none.
+func FindBox(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		boxes, _ := ParseBoxes(data)
+		found := false
+		for _, box := range boxes {
+			if box.Type == boxType {
+				data, found = box.Data, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+// Writer builds nested boxes in memory.
+type Writer struct {
+	buf   bytes.Buffer
+	stack []int
+}
+
+// StartBox opens a box; it must be closed with EndBox.
+func (w *Writer) StartBox(boxType string) {
+	w.stack = append(w.stack, w.buf.Len())
+	w.U32(0)
+	w.buf.WriteString(boxType)
+}
+
+// StartFullBox opens a box with a version and flags header.
+func (w *Writer) StartFullBox(boxType string, version uint8, flags uint32) {
+	w.StartBox(boxType)
+	w.U32(uint32(version)<<24 | flags&0xFFFFFF)
+}
+
+// EndBox closes the innermost open box, writing its size.
+func (w *Writer) EndBox() {
+	start := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.buf.Bytes()[start:], uint32(w.buf.Len()-start))
+}
+
+// U8 writes a byte.
+func (w *Writer) U8(v uint8) { w.buf.WriteByte(v) }
+
+// U16 writes a big-endian 16-bit value.
+func (w *Writer) U16(v uint16) { w.buf.Write(binary.BigEndian.AppendUint16(nil, v)) }
+
+// U32 writes a big-endian 32-bit value.
+func (w *Writer) U32(v uint32) { w.buf.Write(binary.BigEndian.AppendUint32(nil, v)) }
+
+// U64 writes a big-endian 64-bit value.
+func (w *Writer) U64(v uint64) { w.buf.Write(binary.BigEndian.AppendUint64(nil, v)) }
+
+// Write appends raw bytes.
+func (w *Writer) Write(p []byte) { w.buf.Write(p) }
+
+// Zeros appends n zero bytes.
+func (w *Writer) Zeros(n int) { w.buf.Write(make([]byte, n)) }
+
+// Len returns the number of bytes written so far.
+func (w *Writer) Len() int { return w.buf.Len() }
+
+// Bytes returns the written data.
+func (w *Writer) Bytes() []byte { return w.buf.Bytes() }
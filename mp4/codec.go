@@ -0,0 +1,255 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Sizes of the fixed fields of sample entries, header excluded.
+const (
+	visualEntryFields = 78
+	audioEntryFields  = 28
+)
+
+// VideoSampleEntry builds a visual sample entry of type format ("avc1" or
+// "hvc1") carrying the decoder configuration record config in a box of type
+// configType ("avcC" or "hvcC").
+func VideoSampleEntry(format string, width, height uint16, configType string, config []byte) []byte {
+	var w Writer
+	w.StartBox(format)
+	w.Zeros(6)
+	w.U16(1) // data reference index
+	w.Zeros(16)
+	w.U16(width)
+	w.U16(height)
+	w.U32(0x00480000) // 72 dpi
+	w.U32(0x00480000)
+	w.U32(0)
+	w.U16(1) // frame count
+	w.Zeros(32)
+	w.U16(0x0018)
+	w.U16(0xFFFF)
+	w.StartBox(configType)
+	w.Write(config)
+	w.EndBox()
+	w.EndBox()
+	return w.Bytes()
+}
+
+// AudioSampleEntry builds an audio sample entry of type format whose decoder
+// configuration is the given box (header included).
+func AudioSampleEntry(format string, channels uint16, sampleRate uint32, config []byte) []byte {
+	var w Writer
+	w.StartBox(format)
+	w.Zeros(6)
+	w.U16(1)
+	w.Zeros(8)
+	w.U16(channels)
+	w.U16(16)
+	w.U32(0)
+	if sampleRate > 0xFFFF {
+		sampleRate = 0
+	}
+	w.U32(sampleRate << 16)
+	w.Write(config)
+	w.EndBox()
+	return w.Bytes()
+}
+
+// ESDSBox builds the esds box of an AAC sample entry from its AudioSpecificConfig.
+func ESDSBox(audioSpecificConfig []byte) []byte {
+	decoderSpecific := descriptor(0x05, audioSpecificConfig)
+	decoderConfig := descriptor(0x04, append([]byte{
+		0x40,    // MPEG-4 audio
+		0x15,    // audio stream
+		0, 0, 0, // buffer size
+		0, 0, 0, 0, // max bitrate
+		0, 0, 0, 0, // average bitrate
+	}, decoderSpecific...))
+	es := descriptor(0x03, append(append([]byte{0, 1, 0}, decoderConfig...), descriptor(0x06, []byte{0x02})...))
+
+	var w Writer
+	w.StartFullBox("esds", 0, 0)
+	w.Write(es)
+	w.EndBox()
+	return w.Bytes()
+}
+
+// descriptor encodes an MPEG-4 descriptor with a four byte length.
+func descriptor(tag byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{tag, byte(n>>21) | 0x80, byte(n>>14) | 0x80, byte(n>>7) | 0x80, byte(n) & 0x7F}, payload...)
+}
+
+// ConfigBox wraps a decoder configuration payload, such as dac3, in a box.
+func ConfigBox(boxType string, payload []byte) []byte {
+	var w Writer
+	w.StartBox(boxType)
+	w.Write(payload)
+	w.EndBox()
+	return w.Bytes()
+}
+
+// FullConfigBox wraps a decoder configuration payload in a version 0 full box.
+func FullConfigBox(boxType string, payload []byte) []byte {
+	var w Writer
+	w.StartFullBox(boxType, 0, 0)
+	w.Write(payload)
+	w.EndBox()
+	return w.Bytes()
+}
+
+// sampleEntryChildren returns the boxes following the fixed fields of a sample entry.
+func sampleEntryChildren(entry []byte) []Box {
+	if len(entry) < 8 {
+		return nil
+	}
+	format := string(entry[4:8])
+	offset := 8
+	switch format {
+	case "avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "av01", "vp09":
+		offset += visualEntryFields
+	default:
+		offset += audioEntryFields
+		if len(entry) >= 18 {
+			// QuickTime sound description versions 1 and 2 carry extra fields.
+			switch binary.BigEndian.Uint16(entry[16:]) {
+			case 1:
+				offset += 16
+			case 2:
+				offset += 36
+			}
+		}
+	}
+	if offset > len(entry) {
+		return nil
+	}
+	boxes, _ := ParseBoxes(entry[offset:])
+	return boxes
+}
+
+// findChild returns the payload of the child box of a sample entry with the given type.
+func findChild(entry []byte, boxType string) []byte {
+	for _, box := range sampleEntryChildren(entry) {
+		if box.Type == boxType {
+			return box.Data
+		}
+	}
+	return nil
+}
+
+// CodecString returns the RFC 6381 codec string of a sample entry, as used
+// in the CODECS attribute of HLS playlists.
+func CodecString(entry []byte) string {
+	if len(entry) < 8 {
+		return ""
+	}
+	format := string(entry[4:8])
+	switch format {
+	case "avc1", "avc3":
+		if avcC := findChild(entry, "avcC"); len(avcC) >= 4 {
+			return fmt.Sprintf("%s.%02x%02x%02x", format, avcC[1], avcC[2], avcC[3])
+		}
+	case "hvc1", "hev1":
+		if hvcC := findChild(entry, "hvcC"); len(hvcC) >= 13 {
+			return format + "." + hevcCodecString(hvcC)
+		}
+	case "mp4a":
+		if esds := findChild(entry, "esds"); len(esds) > 4 {
+			if oti, asc := parseESDS(esds[4:]); oti == 0x40 && len(asc) > 0 {
+				objectType := asc[0] >> 3
+				if objectType == 31 && len(asc) > 1 {
+					objectType = 32 + (asc[0]&0x07)<<3 | asc[1]>>5
+				}
+				return fmt.Sprintf("mp4a.40.%d", objectType)
+			} else if oti != 0 {
+				return fmt.Sprintf("mp4a.%02x", oti)
+			}
+		}
+		return "mp4a.40.2"
+	}
+	return strings.TrimSpace(format)
+}
+
+// hevcCodecString formats the profile, tier, level and constraints of an
+// HEVC decoder configuration record.
+func hevcCodecString(hvcC []byte) string {
+	var b strings.Builder
+	if space := hvcC[1] >> 6; space > 0 {
+		b.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&b, "%d.%x.", hvcC[1]&0x1F, bits.Reverse32(binary.BigEndian.Uint32(hvcC[2:])))
+	if hvcC[1]&0x20 != 0 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", hvcC[12])
+
+	constraints := hvcC[6:12]
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+	for _, c := range constraints[:last] {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// parseESDS returns the object type indication and decoder specific info of an ES descriptor.
+func parseESDS(data []byte) (byte, []byte) {
+	var oti byte
+	for len(data) >= 2 {
+		tag := data[0]
+		length, n := 0, 1
+		for ; n < 5 && n < len(data); n++ {
+			length = length<<7 | int(data[n]&0x7F)
+			if data[n]&0x80 == 0 {
+				n++
+				break
+			}
+		}
+		body := data[n:]
+		if length < len(body) {
+			body = body[:length]
+		}
+		switch tag {
+		case 0x03:
+			if len(body) < 3 {
+				return oti, nil
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > len(body) {
+				return oti, nil
+			}
+			data = body[skip:]
+		case 0x04:
+			if len(body) < 13 {
+				return oti, nil
+			}
+			oti = body[0]
+			data = body[13:]
+		case 0x05:
+			return oti, body
+		default:
+			if n+length > len(data) {
+				return oti, nil
+			}
+			data = data[n+length:]
+		}
+	}
+	return oti, nil
+}
@@ -0,0 +1,90 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrOffsetOverflow is returned when a shifted chunk offset no longer fits
+// its 32-bit stco entry.
+var ErrOffsetOverflow = errors.New("chunk offset overflows stco")
+
+// ErrCompressedMovie is returned for moov boxes compressed in a cmov box,
+// whose chunk offsets cannot be rewritten.
+var ErrCompressedMovie = errors.New("compressed moov box")
+
+// ShiftChunkOffsets adds delta to the chunk offsets of every track that
+// point into [from, to). moov is a complete moov box, header included,
+// and is modified in place.
+func ShiftChunkOffsets(moov []byte, from, to, delta int64) error {
+	boxes, err := ParseBoxes(moov)
+	if err != nil {
+		return err
+	}
+	if len(boxes) != 1 || boxes[0].Type != "moov" {
+		return fmt.Errorf("%w: not a moov box", ErrInvalidBox)
+	}
+	children, err := ParseBoxes(boxes[0].Data)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		switch child.Type {
+		case "cmov":
+			return ErrCompressedMovie
+		case "trak":
+			stbl := FindBox(child.Data, "mdia", "minf", "stbl")
+			if stbl == nil {
+				continue
+			}
+			entries, err := ParseBoxes(stbl)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.Type != "stco" && entry.Type != "co64" {
+					continue
+				}
+				if err := shiftOffsetTable(entry.Data, entry.Type == "co64", from, to, delta); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// shiftOffsetTable rewrites the entries of an stco or co64 payload.
+func shiftOffsetTable(data []byte, wide bool, from, to, delta int64) error {
+	if len(data) < 8 {
+		return fmt.Errorf("%w: truncated chunk offset table", ErrInvalidBox)
+	}
+	count := int(binary.BigEndian.Uint32(data[4:]))
+	width := 4
+	if wide {
+		width = 8
+	}
+	if len(data) < 8+count*width {
+		return fmt.Errorf("%w: truncated chunk offset table", ErrInvalidBox)
+	}
+	for i := 0; i < count; i++ {
+		entry := data[8+i*width:]
+		if wide {
+			offset := int64(binary.BigEndian.Uint64(entry))
+			if offset >= from && offset < to {
+				binary.BigEndian.PutUint64(entry, uint64(offset+delta))
+			}
+			continue
+		}
+		offset := int64(binary.BigEndian.Uint32(entry))
+		if offset >= from && offset < to {
+			if offset+delta < 0 || offset+delta > math.MaxUint32 {
+				return ErrOffsetOverflow
+			}
+			binary.BigEndian.PutUint32(entry, uint32(offset+delta))
+		}
+	}
+	return nil
+}
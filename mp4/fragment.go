@@ -0,0 +1,235 @@
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// Sample flags of fragment samples.
+const (
+	sampleFlagsSync    = 0x02000000 // sample_depends_on = 2 (depends on no other sample)
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on = 1, sample_is_non_sync_sample
+)
+
+// trun flags.
+const (
+	trunDataOffset = 0x000001
+	trunDuration   = 0x000100
+	trunSize       = 0x000200
+	trunFlags      = 0x000400
+	trunCTS        = 0x000800
+)
+
+// unityMatrix is the identity transformation matrix of mvhd and tkhd.
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// InitTrack describes the single track of a fragmented MP4 initialization segment.
+type InitTrack struct {
+	ID          uint32
+	Handler     string // "vide" or "soun"
+	Timescale   uint32
+	Language    string
+	Width       uint32
+	Height      uint32
+	SampleEntry []byte
+}
+
+// FragmentSample is one sample of a media segment.
+type FragmentSample struct {
+	Data     []byte
+	Duration uint32
+	CTS      int32 // composition offset, may be negative
+	Sync     bool
+}
+
+// WriteInit returns a fragmented MP4 initialization segment for track.
+func WriteInit(track InitTrack) []byte {
+	var w Writer
+	w.StartBox("ftyp")
+	w.Write([]byte("iso6"))
+	w.U32(0)
+	for _, brand := range []string{"iso6", "cmfc", "mp41"} {
+		w.Write([]byte(brand))
+	}
+	w.EndBox()
+
+	w.StartBox("moov")
+	w.StartFullBox("mvhd", 0, 0)
+	w.U32(0) // creation time
+	w.U32(0) // modification time
+	w.U32(1000)
+	w.U32(0)          // duration, unknown for fragmented files
+	w.U32(0x00010000) // rate
+	w.U16(0x0100)     // volume
+	w.Zeros(10)
+	for _, v := range unityMatrix {
+		w.U32(v)
+	}
+	w.Zeros(24)
+	w.U32(track.ID + 1) // next track ID
+	w.EndBox()
+
+	w.StartBox("trak")
+	w.StartFullBox("tkhd", 0, 0x000003) // enabled, in movie
+	w.U32(0)
+	w.U32(0)
+	w.U32(track.ID)
+	w.U32(0)
+	w.U32(0) // duration
+	w.Zeros(8)
+	w.U16(0) // layer
+	w.U16(0) // alternate group
+	if track.Handler == "soun" {
+		w.U16(0x0100)
+	} else {
+		w.U16(0)
+	}
+	w.U16(0)
+	for _, v := range unityMatrix {
+		w.U32(v)
+	}
+	w.U32(track.Width << 16)
+	w.U32(track.Height << 16)
+	w.EndBox()
+
+	w.StartBox("mdia")
+	w.StartFullBox("mdhd", 0, 0)
+	w.U32(0)
+	w.U32(0)
+	w.U32(track.Timescale)
+	w.U32(0)
+	w.U16(encodeLanguage(track.Language))
+	w.U16(0)
+	w.EndBox()
+
+	w.StartFullBox("hdlr", 0, 0)
+	w.U32(0)
+	w.Write([]byte(track.Handler))
+	w.Zeros(12)
+	if track.Handler == "soun" {
+		w.Write([]byte("SoundHandler\x00"))
+	} else {
+		w.Write([]byte("VideoHandler\x00"))
+	}
+	w.EndBox()
+
+	w.StartBox("minf")
+	if track.Handler == "soun" {
+		w.StartFullBox("smhd", 0, 0)
+		w.U32(0)
+		w.EndBox()
+	} else {
+		w.StartFullBox("vmhd", 0, 1)
+		w.Zeros(8)
+		w.EndBox()
+	}
+	w.StartBox("dinf")
+	w.StartFullBox("dref", 0, 0)
+	w.U32(1)
+	w.StartFullBox("url ", 0, 1) // media data is in the same file
+	w.EndBox()
+	w.EndBox()
+	w.EndBox()
+
+	w.StartBox("stbl")
+	w.StartFullBox("stsd", 0, 0)
+	w.U32(1)
+	w.Write(track.SampleEntry)
+	w.EndBox()
+	for _, empty := range []string{"stts", "stsc", "stco"} {
+		w.StartFullBox(empty, 0, 0)
+		w.U32(0)
+		w.EndBox()
+	}
+	w.StartFullBox("stsz", 0, 0)
+	w.U32(0)
+	w.U32(0)
+	w.EndBox()
+	w.EndBox() // stbl
+	w.EndBox() // minf
+	w.EndBox() // mdia
+	w.EndBox() // trak
+
+	w.StartBox("mvex")
+	w.StartFullBox("trex", 0, 0)
+	w.U32(track.ID)
+	w.U32(1) // default sample description index
+	w.U32(0)
+	w.U32(0)
+	w.U32(0)
+	w.EndBox()
+	w.EndBox()
+	w.EndBox() // moov
+	return w.Bytes()
+}
+
+// WriteFragment returns a media segment holding samples of one track,
+// starting at the decode time baseDTS in the track timescale.
+func WriteFragment(sequence, trackID uint32, baseDTS uint64, samples []FragmentSample) []byte {
+	var w Writer
+	w.StartBox("styp")
+	w.Write([]byte("msdh"))
+	w.U32(0)
+	w.Write([]byte("msdh"))
+	w.Write([]byte("msix"))
+	w.EndBox()
+
+	moofStart := w.Len()
+	w.StartBox("moof")
+	w.StartFullBox("mfhd", 0, 0)
+	w.U32(sequence)
+	w.EndBox()
+
+	w.StartBox("traf")
+	w.StartFullBox("tfhd", 0, 0x020000) // default-base-is-moof
+	w.U32(trackID)
+	w.EndBox()
+	w.StartFullBox("tfdt", 1, 0)
+	w.U64(baseDTS)
+	w.EndBox()
+
+	w.StartFullBox("trun", 1, trunDataOffset|trunDuration|trunSize|trunFlags|trunCTS)
+	w.U32(uint32(len(samples)))
+	dataOffsetPos := w.Len()
+	w.U32(0)
+	size := 0
+	for _, s := range samples {
+		w.U32(s.Duration)
+		w.U32(uint32(len(s.Data)))
+		if s.Sync {
+			w.U32(sampleFlagsSync)
+		} else {
+			w.U32(sampleFlagsNonSync)
+		}
+		w.U32(uint32(s.CTS))
+		size += len(s.Data)
+	}
+	w.EndBox() // trun
+	w.EndBox() // traf
+	w.EndBox() // moof
+
+	// The data offset is relative to the start of moof and points past the mdat header.
+	binary.BigEndian.PutUint32(w.Bytes()[dataOffsetPos:], uint32(w.Len()-moofStart+8))
+
+	w.U32(uint32(8 + size))
+	w.Write([]byte("mdat"))
+	for _, s := range samples {
+		w.Write(s.Data)
+	}
+	return w.Bytes()
+}
+
+// encodeLanguage packs an ISO-639-2/T language code, "und" when unknown.
+func encodeLanguage(language string) uint16 {
+	if len(language) != 3 {
+		language = "und"
+	}
+	var packed uint16
+	for i := 0; i < 3; i++ {
+		c := language[i]
+		if c < 'a' || c > 'z' {
+			return encodeLanguage("und")
+		}
+		packed = packed<<5 | uint16(c-0x60)
+	}
+	return packed
+}
@@ -0,0 +1,378 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoMovie is returned for files without a moov box, such as fragmented
+// MP4 files whose samples are only described by their fragments.
+var ErrNoMovie = errors.New("no moov box")
+
+// Sample tables are checked against these limits before they are expanded,
+// so a corrupt or crafted file cannot make the parser, or the segment
+// requests reading its samples, allocate gigabytes.
+const (
+	maxSamples    = 1 << 22  // over 19 hours of 60 fps video per track
+	maxSampleSize = 64 << 20 // far above the largest compressed frames
+)
+
+// Movie describes the tracks of an MP4 file.
+type Movie struct {
+	Timescale uint32
+	Duration  uint64 // in Timescale units
+	Tracks    []*Track
+	Moov      BoxHeader
+	Boxes     []BoxHeader // top-level boxes of the file
+}
+
+// Track describes one track and its samples.
+type Track struct {
+	ID          uint32
+	Handler     string // "vide", "soun", "sbtl", ...
+	Timescale   uint32
+	Duration    uint64 // in Timescale units
+	Language    string
+	Width       uint32
+	Height      uint32
+	SampleEntry []byte   // first stsd entry, header included
+	Format      string   // sample entry type, such as "avc1" or "mp4a"
+	EditShift   int64    // media time of the first edit, in Timescale units
+	Samples     []Sample // empty in fragmented files, whose samples are described by their fragments
+}
+
+// DecodeStart returns the earliest decode time of t on the presentation
+// timeline, that is after the edit list shift. It is negative when decoding
+// starts before presentation, as in files with B-frames or audio priming
+// whose edit list skips the first frames.
+func (t *Track) DecodeStart() int64 {
+	if len(t.Samples) == 0 {
+		return 0
+	}
+	start := t.Samples[0].DTS
+	for _, sample := range t.Samples[1:] {
+		start = min(start, sample.DTS)
+	}
+	return start - t.EditShift
+}
+
+// Sample locates one sample in the file.
+type Sample struct {
+	Offset   int64
+	Size     uint32
+	DTS      int64 // decode time in track Timescale units
+	CTS      int32 // composition offset from DTS
+	Duration uint32
+	Sync     bool
+}
+
+// ReadMovie parses the moov box of the MP4 file read from r.
+func ReadMovie(r io.ReaderAt, size int64) (*Movie, error) {
+	boxes, err := ReadTopLevel(r, size)
+	if err != nil {
+		return nil, err
+	}
+	m := &Movie{Boxes: boxes}
+	found := false
+	for _, box := range boxes {
+		if box.Type == "moov" {
+			m.Moov, found = box, true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrNoMovie
+	}
+	if err := m.load(r, size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadMovie parses the moov box located by the header moov in the file of
+// the given size read from r. The returned movie does not list the
+// top-level boxes of the file.
+func LoadMovie(r io.ReaderAt, moov BoxHeader, size int64) (*Movie, error) {
+	m := &Movie{Moov: moov}
+	if err := m.load(r, size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load parses the moov box. Samples must lie within the first size bytes.
+func (m *Movie) load(r io.ReaderAt, size int64) error {
+	moov, err := LoadBox(r, m.Moov)
+	if err != nil {
+		return err
+	}
+	children, err := ParseBoxes(moov)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		switch child.Type {
+		case "mvhd":
+			m.Timescale, m.Duration = parseTimes(child.Data, 12)
+		case "trak":
+			track, err := parseTrack(child.Data, size)
+			if err != nil {
+				return err
+			}
+			if track != nil {
+				m.Tracks = append(m.Tracks, track)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimes reads the timescale and duration of an mvhd or mdhd payload.
+// offset is the position of the timescale in a version 0 box.
+func parseTimes(data []byte, offset int) (uint32, uint64) {
+	if len(data) < 4 {
+		return 0, 0
+	}
+	if data[0] == 1 {
+		offset += 8
+		if len(data) < offset+12 {
+			return 0, 0
+		}
+		return binary.BigEndian.Uint32(data[offset:]), binary.BigEndian.Uint64(data[offset+4:])
+	}
+	if len(data) < offset+8 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(data[offset:]), uint64(binary.BigEndian.Uint32(data[offset+4:]))
+}
+
+// parseTrack decodes a trak box of a file of the given size. Tracks without
+// samples are skipped.
+func parseTrack(trak []byte, size int64) (*Track, error) {
+	t := &Track{}
+	if tkhd := FindBox(trak, "tkhd"); len(tkhd) >= 84 {
+		if tkhd[0] == 1 {
+			t.ID = binary.BigEndian.Uint32(tkhd[20:])
+		} else {
+			t.ID = binary.BigEndian.Uint32(tkhd[12:])
+		}
+		// Width and height are the last two 16.16 fixed point fields.
+		t.Width = binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16
+		t.Height = binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16
+	}
+
+	mdhd := FindBox(trak, "mdia", "mdhd")
+	t.Timescale, t.Duration = parseTimes(mdhd, 12)
+	if t.Timescale == 0 {
+		return nil, fmt.Errorf("%w: track %d has no timescale", ErrInvalidBox, t.ID)
+	}
+	languageOffset := 20
+	if len(mdhd) > 0 && mdhd[0] == 1 {
+		languageOffset = 32
+	}
+	if len(mdhd) >= languageOffset+2 {
+		t.Language = decodeLanguage(binary.BigEndian.Uint16(mdhd[languageOffset:]))
+	}
+	if hdlr := FindBox(trak, "mdia", "hdlr"); len(hdlr) >= 12 {
+		t.Handler = string(hdlr[8:12])
+	}
+	t.EditShift = parseEditShift(FindBox(trak, "edts", "elst"))
+
+	stbl := FindBox(trak, "mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, nil
+	}
+	if stsd := FindBox(stbl, "stsd"); len(stsd) >= 8 {
+		entries, _ := ParseBoxes(stsd[8:])
+		if len(entries) > 0 {
+			t.SampleEntry = entries[0].Raw
+			t.Format = entries[0].Type
+		}
+	}
+
+	samples, err := buildSamples(stbl, size)
+	if err != nil {
+		return nil, fmt.Errorf("track %d: %w", t.ID, err)
+	}
+	t.Samples = samples
+	return t, nil
+}
+
+// decodeLanguage decodes a packed ISO-639-2/T language code.
+func decodeLanguage(packed uint16) string {
+	if packed == 0 || packed == 0x7FFF {
+		return ""
+	}
+	code := []byte{byte(packed>>10&0x1F) + 0x60, byte(packed>>5&0x1F) + 0x60, byte(packed&0x1F) + 0x60}
+	if string(code) == "und" {
+		return ""
+	}
+	return string(code)
+}
+
+// parseEditShift returns the media time at which presentation starts: the
+// media time of the first non-empty edit.
+func parseEditShift(elst []byte) int64 {
+	if len(elst) < 8 {
+		return 0
+	}
+	version := elst[0]
+	count := int(binary.BigEndian.Uint32(elst[4:]))
+	entrySize := 12
+	if version == 1 {
+		entrySize = 20
+	}
+	for i := 0; i < count && 8+(i+1)*entrySize <= len(elst); i++ {
+		entry := elst[8+i*entrySize:]
+		var mediaTime int64
+		if version == 1 {
+			mediaTime = int64(binary.BigEndian.Uint64(entry[8:]))
+		} else {
+			mediaTime = int64(int32(binary.BigEndian.Uint32(entry[4:])))
+		}
+		if mediaTime >= 0 {
+			return mediaTime
+		}
+	}
+	return 0
+}
+
+// buildSamples expands the sample tables of an stbl box. The sample count is
+// checked against the chunk tables and the file size before anything is
+// allocated, and every sample must lie within the file.
+func buildSamples(stbl []byte, fileSize int64) ([]Sample, error) {
+	stsz := FindBox(stbl, "stsz")
+	if len(stsz) < 12 {
+		if stz2 := FindBox(stbl, "stz2"); len(stz2) >= 12 {
+			return nil, fmt.Errorf("%w: compact sample sizes are not supported", ErrInvalidBox)
+		}
+		return nil, nil
+	}
+	fixed := binary.BigEndian.Uint32(stsz[4:])
+	count := int(binary.BigEndian.Uint32(stsz[8:]))
+	switch {
+	case count == 0:
+		return nil, nil
+	case count > maxSamples:
+		return nil, fmt.Errorf("%w: %d samples, at most %d are supported", ErrInvalidBox, count, maxSamples)
+	case fixed == 0 && len(stsz) < 12+4*count:
+		return nil, fmt.Errorf("%w: truncated stsz", ErrInvalidBox)
+	case uint64(fixed)*uint64(count) > uint64(fileSize):
+		return nil, fmt.Errorf("%w: %d samples of %d bytes do not fit in the file", ErrInvalidBox, count, fixed)
+	}
+
+	// Chunk offsets, expanded to sample offsets through the sample-to-chunk table.
+	var chunks []int64
+	if stco := FindBox(stbl, "stco"); len(stco) >= 8 {
+		n := int(binary.BigEndian.Uint32(stco[4:]))
+		for i := 0; i < n && 8+4*i+4 <= len(stco); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(stco[8+4*i:])))
+		}
+	} else if co64 := FindBox(stbl, "co64"); len(co64) >= 8 {
+		n := int(binary.BigEndian.Uint32(co64[4:]))
+		for i := 0; i < n && 8+8*i+8 <= len(co64); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(co64[8+8*i:])))
+		}
+	}
+	stsc := FindBox(stbl, "stsc")
+	if len(chunks) == 0 || len(stsc) < 8 {
+		return nil, fmt.Errorf("%w: missing chunk tables", ErrInvalidBox)
+	}
+	type stscEntry struct{ firstChunk, lastChunk, samplesPerChunk uint32 }
+	var entries []stscEntry
+	for i := 0; i < int(binary.BigEndian.Uint32(stsc[4:])) && 8+12*i+12 <= len(stsc); i++ {
+		e := stsc[8+12*i:]
+		entries = append(entries, stscEntry{firstChunk: binary.BigEndian.Uint32(e), samplesPerChunk: binary.BigEndian.Uint32(e[4:])})
+	}
+	covered := uint64(0)
+	for i := range entries {
+		entries[i].lastChunk = uint32(len(chunks))
+		if i+1 < len(entries) {
+			entries[i].lastChunk = min(entries[i+1].firstChunk-1, uint32(len(chunks)))
+		}
+		if first, last := entries[i].firstChunk, entries[i].lastChunk; first >= 1 && first <= last && covered < uint64(count) {
+			covered += uint64(last-first+1) * uint64(entries[i].samplesPerChunk)
+		}
+	}
+	if covered < uint64(count) {
+		return nil, fmt.Errorf("%w: chunk tables cover %d of %d samples", ErrInvalidBox, covered, count)
+	}
+
+	samples := make([]Sample, count)
+	for i := range samples {
+		size := fixed
+		if fixed == 0 {
+			size = binary.BigEndian.Uint32(stsz[12+4*i:])
+		}
+		if size > maxSampleSize {
+			return nil, fmt.Errorf("%w: sample %d is %d bytes", ErrInvalidBox, i+1, size)
+		}
+		samples[i].Size = size
+	}
+	sample := 0
+	for _, entry := range entries {
+		for chunk := entry.firstChunk; chunk <= entry.lastChunk && chunk >= 1 && sample < count; chunk++ {
+			offset := chunks[chunk-1]
+			for k := uint32(0); k < entry.samplesPerChunk && sample < count; k++ {
+				end := offset + int64(samples[sample].Size)
+				if offset < 0 || end > fileSize {
+					return nil, fmt.Errorf("%w: sample %d at %d-%d is outside the file", ErrInvalidBox, sample+1, offset, end)
+				}
+				samples[sample].Offset = offset
+				offset = end
+				sample++
+			}
+		}
+	}
+
+	// Decode times.
+	stts := FindBox(stbl, "stts")
+	if len(stts) < 8 {
+		return nil, fmt.Errorf("%w: missing stts", ErrInvalidBox)
+	}
+	sample = 0
+	var dts int64
+	for i := 0; i < int(binary.BigEndian.Uint32(stts[4:])) && 8+8*i+8 <= len(stts); i++ {
+		n := binary.BigEndian.Uint32(stts[8+8*i:])
+		delta := binary.BigEndian.Uint32(stts[12+8*i:])
+		for k := uint32(0); k < n && sample < count; k++ {
+			samples[sample].DTS = dts
+			samples[sample].Duration = delta
+			dts += int64(delta)
+			sample++
+		}
+	}
+	for ; sample < count; sample++ {
+		samples[sample].DTS = dts
+	}
+
+	// Composition offsets; version 1 offsets are signed, and so are version 0
+	// offsets in practice.
+	if ctts := FindBox(stbl, "ctts"); len(ctts) >= 8 {
+		sample = 0
+		for i := 0; i < int(binary.BigEndian.Uint32(ctts[4:])) && 8+8*i+8 <= len(ctts); i++ {
+			n := binary.BigEndian.Uint32(ctts[8+8*i:])
+			offset := int32(binary.BigEndian.Uint32(ctts[12+8*i:]))
+			for k := uint32(0); k < n && sample < count; k++ {
+				samples[sample].CTS = offset
+				sample++
+			}
+		}
+	}
+
+	// Sync samples; every sample is a sync sample when stss is absent.
+	if stss := FindBox(stbl, "stss"); len(stss) >= 8 {
+		for i := 0; i < int(binary.BigEndian.Uint32(stss[4:])) && 8+4*i+4 <= len(stss); i++ {
+			if n := int(binary.BigEndian.Uint32(stss[8+4*i:])); n >= 1 && n <= count {
+				samples[n-1].Sync = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].Sync = true
+		}
+	}
+	return samples, nil
+}
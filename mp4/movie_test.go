@@ -0,0 +1,128 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// box returns a box of type typ holding payload.
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox returns the payload of a version 0 full box holding values.
+func fullBox(values ...uint32) []byte {
+	b := make([]byte, 4)
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// sampleTable returns an stbl payload with one chunk at chunkOffset holding
+// every sample, sized by stsz.
+func sampleTable(stsz []byte, count, chunkOffset uint32) []byte {
+	var stbl []byte
+	stbl = append(stbl, box("stts", fullBox(1, count, 1000))...)
+	stbl = append(stbl, box("stsc", fullBox(1, 1, count, 1))...)
+	stbl = append(stbl, box("stsz", stsz)...)
+	stbl = append(stbl, box("stco", fullBox(1, chunkOffset))...)
+	return stbl
+}
+
+func TestBuildSamples(t *testing.T) {
+	samples, err := buildSamples(sampleTable(fullBox(0, 3, 10, 20, 30), 3, 100), 160)
+	if err != nil {
+		t.Fatalf("buildSamples: %v", err)
+	}
+	want := []Sample{
+		{Offset: 100, Size: 10, DTS: 0, Duration: 1000, Sync: true},
+		{Offset: 110, Size: 20, DTS: 1000, Duration: 1000, Sync: true},
+		{Offset: 130, Size: 30, DTS: 2000, Duration: 1000, Sync: true},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(samples), len(want))
+	}
+	for i := range want {
+		if samples[i] != want[i] {
+			t.Errorf("sample %d = %+v, want %+v", i, samples[i], want[i])
+		}
+	}
+}
+
+// TestBuildSamplesRejectsCorruptTables checks that sample tables promising
+// more data than the file holds are rejected before anything is allocated
+// for them.
+func TestBuildSamplesRejectsCorruptTables(t *testing.T) {
+	tests := []struct {
+		name string
+		stbl []byte
+	}{
+		{"count above the sample limit", sampleTable(fullBox(1, 0x7FFFFFFF), 0x7FFFFFFF, 100)},
+		{"fixed size samples larger than the file", sampleTable(fullBox(100, 50), 50, 100)},
+		{"count larger than the chunk tables", sampleTable(fullBox(1, 500), 5, 100)},
+		{"sample larger than the size limit", sampleTable(fullBox(0, 2, 10, 0xF0000000), 2, 100)},
+		{"sample past the end of the file", sampleTable(fullBox(0, 2, 10, 1000), 2, 100)},
+		{"chunk past the end of the file", sampleTable(fullBox(0, 1, 10), 1, 5000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildSamples(tt.stbl, 1000); !errors.Is(err, ErrInvalidBox) {
+				t.Fatalf("buildSamples = %v, want ErrInvalidBox", err)
+			}
+		})
+	}
+}
+
+// bframeTrack returns a trak box of a video track with four 40 ms frames,
+// decoded two frames ahead of their presentation. Its edit list starts
+// presentation 80 ms into the media when editShift is set, as muxers write
+// for B-frames.
+func bframeTrack(editShift bool) []byte {
+	stbl := box("stbl",
+		box("stts", fullBox(1, 4, 40)),
+		box("ctts", fullBox(2, 1, 80, 3, 40)),
+		box("stsc", fullBox(1, 1, 4, 1)),
+		box("stsz", fullBox(10, 4)),
+		box("stco", fullBox(1, 100)))
+	trak := box("mdia",
+		box("mdhd", fullBox(0, 0, 1000, 160, 0)),
+		box("minf", stbl))
+	if editShift {
+		trak = append(box("edts", box("elst", fullBox(1, 160, 80, 0x00010000))), trak...)
+	}
+	return trak
+}
+
+// TestDecodeStart checks that decoding starts before presentation in a
+// track whose edit list skips the first frames.
+func TestDecodeStart(t *testing.T) {
+	for _, tt := range []struct {
+		editShift bool
+		want      int64
+	}{
+		{false, 0},
+		{true, -80},
+	} {
+		track, err := parseTrack(bframeTrack(tt.editShift), 1000)
+		if err != nil {
+			t.Fatalf("parseTrack: %v", err)
+		}
+		if len(track.Samples) != 4 || track.Samples[3].DTS != 120 || track.Samples[0].CTS != 80 {
+			t.Fatalf("unexpected samples %+v", track.Samples)
+		}
+		if got := track.DecodeStart(); got != tt.want {
+			t.Errorf("edit list %v: DecodeStart() = %d, want %d", tt.editShift, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SegmentIndex is a parsed sidx box, which indexes the fragments of a
+// fragmented MP4 file.
+type SegmentIndex struct {
+	ReferenceID              uint32
+	Timescale                uint32
+	EarliestPresentationTime uint64
+	FirstOffset              uint64 // from the end of the sidx box to the first referenced byte
+	References               []SegmentReference
+}
+
+// SegmentReference is one entry of a segment index.
+type SegmentReference struct {
+	Indirect      bool // references another sidx box rather than media
+	Size          uint32
+	Duration      uint32 // in the index timescale
+	StartsWithSAP bool
+}
+
+// ParseSegmentIndex parses the payload of a sidx box.
+func ParseSegmentIndex(data []byte) (*SegmentIndex, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("%w: truncated sidx", ErrInvalidBox)
+	}
+	version := data[0]
+	index := &SegmentIndex{
+		ReferenceID: binary.BigEndian.Uint32(data[4:]),
+		Timescale:   binary.BigEndian.Uint32(data[8:]),
+	}
+	pos := 12
+	if version == 0 {
+		if len(data) < pos+8 {
+			return nil, fmt.Errorf("%w: truncated sidx", ErrInvalidBox)
+		}
+		index.EarliestPresentationTime = uint64(binary.BigEndian.Uint32(data[pos:]))
+		index.FirstOffset = uint64(binary.BigEndian.Uint32(data[pos+4:]))
+		pos += 8
+	} else {
+		if len(data) < pos+16 {
+			return nil, fmt.Errorf("%w: truncated sidx", ErrInvalidBox)
+		}
+		index.EarliestPresentationTime = binary.BigEndian.Uint64(data[pos:])
+		index.FirstOffset = binary.BigEndian.Uint64(data[pos+8:])
+		pos += 16
+	}
+	if len(data) < pos+4 {
+		return nil, fmt.Errorf("%w: truncated sidx", ErrInvalidBox)
+	}
+	count := int(binary.BigEndian.Uint16(data[pos+2:]))
+	pos += 4
+	if len(data) < pos+12*count {
+		return nil, fmt.Errorf("%w: truncated sidx references", ErrInvalidBox)
+	}
+	index.References = make([]SegmentReference, count)
+	for i := range index.References {
+		entry := data[pos+12*i:]
+		sizeField := binary.BigEndian.Uint32(entry)
+		index.References[i] = SegmentReference{
+			Indirect:      sizeField&0x80000000 != 0,
+			Size:          sizeField & 0x7FFFFFFF,
+			Duration:      binary.BigEndian.Uint32(entry[4:]),
+			StartsWithSAP: entry[8]&0x80 != 0,
+		}
+	}
+	return index, nil
+}
+
+// Duration returns the total duration of the referenced fragments in the
+// index timescale.
+func (s *SegmentIndex) Duration() uint64 {
+	var total uint64
+	for _, ref := range s.References {
+		total += uint64(ref.Duration)
+	}
+	return total
+}
@@ -0,0 +1,156 @@
+// Package secret resolves secrets from the source a config value refers to:
+// the value itself, an environment variable, a file, or the output of an
+// external command such as pass or a Vault agent helper.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandTimeout bounds the run of a secret command.
+const commandTimeout = 10 * time.Second
+
+// Provider returns the current value of a secret.
+type Provider interface {
+	Resolve(ctx context.Context) (string, error)
+}
+
+// Factory returns the provider of a reference, given the part after its scheme.
+type Factory func(arg string) (Provider, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		"literal": func(arg string) (Provider, error) { return literal(arg), nil },
+		"env":     newEnv,
+		"file":    newFile,
+		"cmd":     newCommand,
+	}
+)
+
+// Register adds a source to Parse, for references of the form scheme:arg.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	factories[scheme] = factory
+	factoriesMu.Unlock()
+}
+
+// Parse returns the provider of ref, one of:
+//
+//	env:NAME             the environment variable NAME
+//	file:/path           the content of a file, such as a Docker secret
+//	cmd:program args...  the standard output of a program, arguments separated by spaces
+//	literal:value        value itself
+//
+// or a source added by Register. Any other ref is the secret itself, so
+// plain values keep working.
+func Parse(ref string) (Provider, error) {
+	scheme, arg, ok := strings.Cut(ref, ":")
+	if !ok {
+		return literal(ref), nil
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return literal(ref), nil
+	}
+	return factory(arg)
+}
+
+// Resolve returns the current value of the secret ref refers to.
+func Resolve(ref string) (string, error) {
+	provider, err := Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	return provider.Resolve(ctx)
+}
+
+// IsLiteral reports whether ref holds the secret itself rather than
+// referring to a source, so it must not be shown.
+func IsLiteral(ref string) bool {
+	provider, err := Parse(ref)
+	if err != nil {
+		return false
+	}
+	_, ok := provider.(literal)
+	return ok
+}
+
+// literal is a secret written in the config.
+type literal string
+
+func (l literal) Resolve(context.Context) (string, error) {
+	return string(l), nil
+}
+
+// env is a secret held by an environment variable.
+type env string
+
+func newEnv(name string) (Provider, error) {
+	if name == "" {
+		return nil, errors.New("env: missing variable name")
+	}
+	return env(name), nil
+}
+
+func (e env) Resolve(context.Context) (string, error) {
+	value, ok := os.LookupEnv(string(e))
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", string(e))
+	}
+	return value, nil
+}
+
+// file is a secret stored in a file. A trailing newline is not part of it.
+type file string
+
+func newFile(path string) (Provider, error) {
+	if path == "" {
+		return nil, errors.New("file: missing path")
+	}
+	return file(path), nil
+}
+
+func (f file) Resolve(context.Context) (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// command is a secret printed by a program. A trailing newline is not part of it.
+type command []string
+
+func newCommand(line string) (Provider, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, errors.New("cmd: missing program")
+	}
+	return command(args), nil
+}
+
+func (c command) Resolve(ctx context.Context) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if message, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); message != "" {
+			return "", fmt.Errorf("%s: %w: %s", c[0], err, message)
+		}
+		return "", fmt.Errorf("%s: %w", c[0], err)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"PiliPili_Backend/logger"
+	"crypto/tls"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newHTTP3Server returns an HTTP/3 server listening on UDP port that serves
+// the same handler, and therefore the same routes, as the TCP listener.
+func newHTTP3Server(port int, handler http.Handler, tlsConfig *tls.Config, idleTimeout time.Duration) *http3.Server {
+	return &http3.Server{
+		Addr:        "0.0.0.0:" + strconv.Itoa(port),
+		Port:        port,
+		Handler:     handler,
+		TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+		IdleTimeout: idleTimeout,
+	}
+}
+
+// newHTTP3Listener wraps an HTTP/3 server as a listener.
+func newHTTP3Listener(srv *http3.Server) listener {
+	return listener{
+		name: "http3",
+		serve: func() error {
+			logger.Info("Server listening (HTTP/3)", "url", "udp://"+srv.Addr)
+			return srv.ListenAndServe()
+		},
+		shutdown: srv.Shutdown,
+		close:    srv.Close,
+	}
+}
+
+// altSvcHandler advertises the HTTP/3 listener on every TCP response through
+// the Alt-Svc header, so clients can upgrade on their next request.
+func altSvcHandler(srv *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := srv.SetQUICHeaders(w.Header()); err != nil {
+			logger.Debug("Alt-Svc header not set", "error", err)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
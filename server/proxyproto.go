@@ -0,0 +1,244 @@
+package server
+
+import (
+	"PiliPili_Backend/logger"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted proxy may take to send the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature is the fixed prefix of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts connections that may start with a PROXY protocol
+// v1 or v2 header. Headers are only honoured from trusted proxies; other
+// connections are passed through untouched.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// newProxyProtoListener wraps ln so that connections from trusted report the
+// client address carried in their PROXY header.
+func newProxyProtoListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtoListener{Listener: ln, trusted: trusted}
+}
+
+// Accept waits for the next connection. The PROXY header is parsed lazily on
+// first use so a slow proxy cannot block the accept loop.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ipInNets(remoteIP(conn.RemoteAddr()), l.trusted) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection from a trusted proxy that may carry a PROXY header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader parses the PROXY header, if any, exactly once.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, err := parseProxyHeader(c.reader)
+		if err != nil {
+			logger.Warn("Invalid PROXY protocol header", "remote", c.Conn.RemoteAddr(), "error", err)
+			c.err = err
+			return
+		}
+		c.remoteAddr = addr
+	})
+}
+
+// Read reads from the connection after the PROXY header.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer
+// address when no header was sent.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// parseProxyHeader consumes a PROXY v1 or v2 header from r. It returns a nil
+// address when no header is present or the header carries no address
+// (UNKNOWN / LOCAL), in which case the peer address should be used.
+func parseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) == 0 {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(peek, proxyV2Signature):
+		return parseProxyV2(r)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return parseProxyV1(r)
+	default:
+		return nil, nil
+	}
+}
+
+// parseProxyV1 parses a human-readable header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid v1 header is 107 bytes including CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed v1 source address %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyV2 parses a binary header.
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections (health checks from the proxy itself) keep the peer address.
+	if verCmd&0x0F == 0x0 {
+		return nil, nil
+	}
+	if verCmd&0x0F != 0x1 {
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0x0F)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable client IP.
+		return nil, nil
+	}
+}
+
+// parseTrustedNets converts IPs and CIDRs into networks.
+func parseTrustedNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// remoteIP extracts the IP of addr.
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ipInNets reports whether ip belongs to one of nets.
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a v2 header with the given version and command byte,
+// family byte and payload, which the length field is set to unless length
+// is not negative.
+func proxyV2(verCmd, family byte, payload []byte, length int) []byte {
+	if length < 0 {
+		length = len(payload)
+	}
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, verCmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	return append(b, payload...)
+}
+
+// inet4 returns the v2 address block of a TCP over IPv4 connection from
+// 192.0.2.1:56324 to 198.51.100.1:443, followed by extra TLV bytes.
+func inet4(extra ...byte) []byte {
+	b := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB}
+	return append(b, extra...)
+}
+
+// inet6 returns the v2 address block of a TCP over IPv6 connection from
+// [2001:db8::1]:56324 to [2001:db8::2]:443.
+func inet6() []byte {
+	b := append([]byte{}, net.ParseIP("2001:db8::1")...)
+	b = append(b, net.ParseIP("2001:db8::2")...)
+	return append(b, 0xDC, 0x04, 0x01, 0xBB)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // client address, empty when the peer address is kept
+	}{
+		{"no header", nil, ""},
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"), ""},
+		{"v2 TCP4", proxyV2(0x21, 0x11, inet4(), -1), "192.0.2.1:56324"},
+		{"v2 TCP4 with TLVs", proxyV2(0x21, 0x11, inet4(0x04, 0x00, 0x01, 0x00), -1), "192.0.2.1:56324"},
+		{"v2 TCP6", proxyV2(0x21, 0x21, inet6(), -1), "[2001:db8::1]:56324"},
+		{"v2 LOCAL", proxyV2(0x20, 0x00, nil, -1), ""},
+		{"v2 LOCAL with an address block", proxyV2(0x20, 0x11, inet4(), -1), ""},
+		{"v2 UNSPEC family", proxyV2(0x21, 0x00, nil, -1), ""},
+		{"v2 UNIX family", proxyV2(0x21, 0x31, make([]byte, 216), -1), ""},
+		{"v2 unknown family", proxyV2(0x21, 0x51, inet4(), -1), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.header), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := parseProxyHeader(r)
+			if err != nil {
+				t.Fatalf("parseProxyHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address %q, want %q", got, tt.want)
+			}
+			// The header is consumed and nothing after it.
+			if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("left %q after the header", rest)
+			}
+		})
+	}
+}
+
+func TestParseProxyHeaderRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51")},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n")},
+		{"v1 without CR", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n")},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n")},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n")},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n")},
+		{"v1 TCP4 with an IPv6 address", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{"v1 TCP6 with an IPv4 address", []byte("PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n")},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n")},
+		{"v2 truncated header", proxyV2(0x21, 0x11, nil, -1)[:14]},
+		{"v2 truncated address block", proxyV2(0x21, 0x11, inet4()[:6], 12)},
+		{"v2 length past the end", proxyV2(0x21, 0x11, inet4(), 0xFFFF)},
+		{"v2 version 1", proxyV2(0x11, 0x11, inet4(), -1)},
+		{"v2 unknown command", proxyV2(0x22, 0x11, inet4(), -1)},
+		{"v2 short IPv4 block", proxyV2(0x21, 0x11, inet4()[:8], -1)},
+		{"v2 short IPv6 block", proxyV2(0x21, 0x21, inet4(), -1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr, err := parseProxyHeader(bufio.NewReader(bytes.NewReader(tt.header))); err == nil {
+				t.Fatalf("parseProxyHeader = %v, want an error", addr)
+			}
+		})
+	}
+}
+
+// acceptWith accepts a connection on a listener trusting trusted, after a
+// client connected and wrote data, and returns it with its first line.
+func acceptWith(t *testing.T, trusted []string, data string) (net.Conn, string, error) {
+	t.Helper()
+	nets, err := parseTrustedNets(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newProxyProtoListener(tcp, nets)
+	t.Cleanup(func() { ln.Close() })
+
+	client, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return conn, line, err
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	// A trusted proxy reports the client address and the header is stripped.
+	conn, line, err := acceptWith(t, []string{"127.0.0.0/8"}, header+"GET / HTTP/1.1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" || line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("trusted proxy: remote %s, first line %q", conn.RemoteAddr(), line)
+	}
+
+	// Anyone else cannot spoof their address: the header reaches the server as data.
+	conn, line, err = acceptWith(t, []string{"10.0.0.0/8", "192.0.2.7"}, header+"GET / HTTP/1.1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := remoteIP(conn.RemoteAddr()); !ip.IsLoopback() || line != header {
+		t.Errorf("untrusted peer: remote %s, first line %q", conn.RemoteAddr(), line)
+	}
+
+	// An invalid header from a trusted proxy fails the connection.
+	conn, _, err = acceptWith(t, []string{"127.0.0.1"}, "PROXY TCP4 nonsense\r\nGET / HTTP/1.1\r\n")
+	if err == nil {
+		t.Error("invalid header from a trusted proxy was accepted")
+	}
+	if ip := remoteIP(conn.RemoteAddr()); !ip.IsLoopback() {
+		t.Errorf("invalid header: remote %s, want the peer address", conn.RemoteAddr())
+	}
+}
+
+func TestParseTrustedNets(t *testing.T) {
+	nets, err := parseTrustedNets([]string{"192.0.2.7", "10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.0.2.7":   true,
+		"192.0.2.8":   false,
+		"10.20.30.40": true,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if got := ipInNets(net.ParseIP(ip), nets); got != want {
+			t.Errorf("ipInNets(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	for _, entry := range []string{"192.0.2", "10.0.0.0/33", "proxy.example.com"} {
+		if _, err := parseTrustedNets([]string{entry}); err == nil {
+			t.Errorf("parseTrustedNets accepted %q", entry)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package server runs the HTTP listeners and handles graceful shutdown and connection draining.
+package server
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/streamer"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// shutdownGrace bounds how long idle connections are given to close once every stream has drained.
+const shutdownGrace = 5 * time.Second
+
+// listener is one server managed by Run.
+type listener struct {
+	name     string
+	serve    func() error
+	shutdown func(ctx context.Context) error
+	close    func() error
+}
+
+// Run serves handler on the configured listeners until SIGINT or SIGTERM is
+// received, then drains in-flight streams before shutting down. A non-nil
+// admin handler is served on the admin listener.
+func Run(handler, admin http.Handler) error {
+	cfg := config.GetConfig()
+
+	listeners, cleanup, err := newListeners(cfg, handler)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if admin != nil {
+		l, err := newAdminListener(cfg, admin)
+		if err != nil {
+			closeAll(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			errCh <- l.serve()
+		}(l)
+	}
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		closeAll(listeners)
+		return err
+	case <-ctx.Done():
+	}
+
+	// Restore default signal handling so a second signal terminates immediately.
+	stop()
+	return shutdown(listeners, cfg.DrainTimeout)
+}
+
+// newListeners builds the main listener, plain HTTP or HTTPS depending on the
+// config, and the optional HTTP to HTTPS redirect listener. The returned
+// cleanup function releases resources such as the certificate watcher.
+func newListeners(cfg config.Config, handler http.Handler) ([]listener, func(), error) {
+	port := cfg.Port
+	if port == 0 {
+		port = 60002
+	}
+
+	srv := &http.Server{
+		Addr:         "0.0.0.0:" + strconv.Itoa(port),
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	if cfg.HTTP3Enabled && !cfg.TLSEnabled {
+		return nil, nil, errors.New("HTTP3.enabled requires TLS.enabled, QUIC is always encrypted")
+	}
+
+	ln, err := listenTCP(srv.Addr, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !cfg.TLSEnabled {
+		main := newHTTPListener("http", srv, func() error {
+			logger.Info("Server listening", "url", "http://"+srv.Addr)
+			return srv.Serve(ln)
+		})
+		return []listener{main}, func() {}, nil
+	}
+
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	srv.TLSConfig = newTLSConfig(reloader)
+	if !cfg.HTTP2 {
+		// A non-nil, empty TLSNextProto disables the automatic HTTP/2 upgrade.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	listeners := []listener{newHTTPListener("https", srv, func() error {
+		logger.Info("Server listening", "url", "https://"+srv.Addr, "http2", cfg.HTTP2)
+		return srv.ServeTLS(ln, "", "")
+	})}
+
+	if cfg.HTTP3Enabled {
+		h3Port := cfg.HTTP3Port
+		if h3Port == 0 {
+			h3Port = port
+		}
+		h3 := newHTTP3Server(h3Port, handler, newTLSConfig(reloader), cfg.IdleTimeout)
+		srv.Handler = altSvcHandler(h3, handler)
+		listeners = append(listeners, newHTTP3Listener(h3))
+	}
+
+	if cfg.RedirectHTTP {
+		redirect := &http.Server{
+			Addr:              "0.0.0.0:" + strconv.Itoa(cfg.RedirectPort),
+			Handler:           redirectHandler(port),
+			ReadHeaderTimeout: cfg.ReadTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		listeners = append(listeners, newHTTPListener("redirect", redirect, func() error {
+			logger.Info("Redirecting HTTP to HTTPS", "url", "http://"+redirect.Addr)
+			return redirect.ListenAndServe()
+		}))
+	}
+
+	cleanup := func() {
+		if err := reloader.Close(); err != nil {
+			logger.Error("Error closing certificate watcher", "error", err)
+		}
+	}
+	return listeners, cleanup, nil
+}
+
+// newAdminListener builds the listener of the admin API.
+func newAdminListener(cfg config.Config, handler http.Handler) (listener, error) {
+	srv := &http.Server{
+		Addr:        cfg.AdminAddress,
+		Handler:     handler,
+		ReadTimeout: cfg.ReadTimeout,
+		IdleTimeout: cfg.IdleTimeout,
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return listener{}, err
+	}
+	return newHTTPListener("admin", srv, func() error {
+		logger.Info("Admin API listening", "url", "http://"+srv.Addr)
+		return srv.Serve(ln)
+	}), nil
+}
+
+// listenTCP opens the TCP socket of the main listener, accepting PROXY
+// protocol headers from trusted proxies when enabled.
+func listenTCP(addr string, cfg config.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.ProxyProtocol {
+		return ln, nil
+	}
+
+	trusted, err := parseTrustedNets(cfg.TrustedProxies)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	logger.Info("Accepting PROXY protocol headers", "from", cfg.TrustedProxies)
+	return newProxyProtoListener(ln, trusted), nil
+}
+
+// newHTTPListener wraps an http.Server as a listener.
+func newHTTPListener(name string, srv *http.Server, serve func() error) listener {
+	return listener{
+		name:     name,
+		serve:    serve,
+		shutdown: srv.Shutdown,
+		close:    srv.Close,
+	}
+}
+
+// shutdown refuses new streams, waits up to drainTimeout for in-flight streams
+// to finish and then closes every listener, cutting any stream still running.
+func shutdown(listeners []listener, drainTimeout time.Duration) error {
+	logger.Info("Shutdown signal received, draining active streams", "streams", streamer.ActiveStreamCount(), "timeout", drainTimeout)
+	streamer.StartDraining()
+	defer streamer.StopTranscodes()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := streamer.WaitForStreams(drainCtx); err != nil {
+		logger.Warn("Drain period elapsed, closing connections", "streams", streamer.ActiveStreamCount())
+		closeAll(listeners)
+		return nil
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancelShutdown()
+	for _, l := range listeners {
+		if err := l.shutdown(shutdownCtx); err != nil {
+			logger.Warn("Graceful shutdown of listener did not complete", "listener", l.name, "error", err)
+			if err := l.close(); err != nil {
+				logger.Error("Error closing listener", "listener", l.name, "error", err)
+			}
+		}
+	}
+
+	logger.Info("Server stopped gracefully")
+	return nil
+}
+
+// closeAll immediately closes every listener and its connections.
+func closeAll(listeners []listener) {
+	for _, l := range listeners {
+		if err := l.close(); err != nil {
+			logger.Error("Error closing listener", "listener", l.name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"PiliPili_Backend/logger"
+	"crypto/tls"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadDebounce groups the burst of file events produced by a certificate
+// renewal (acme.sh rewrites the certificate and key separately) into one reload.
+const reloadDebounce = 2 * time.Second
+
+// certReloader serves the current certificate and reloads it when the
+// certificate or key file changes on disk.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// newCertReloader loads the certificate pair and starts watching it for changes.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS is enabled but TLS.certFile or TLS.keyFile is empty")
+	}
+
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		done:     make(chan struct{}),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the directories rather than the files: renewals often replace the
+	// files (rename or symlink swap), which would silently drop a file watch.
+	dirs := map[string]bool{filepath.Dir(certFile): true, filepath.Dir(keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	r.watcher = watcher
+
+	go r.watch()
+	return r, nil
+}
+
+// reload reads the certificate pair from disk, keeping the previous one on failure.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the certificate after file events settle.
+func (r *certReloader) watch() {
+	var timer *time.Timer
+	var fire <-chan time.Time
+
+	for {
+		select {
+		case <-r.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if !r.isCertEvent(event) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(reloadDebounce)
+			} else {
+				timer.Reset(reloadDebounce)
+			}
+			fire = timer.C
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Certificate watcher error", "error", err)
+		case <-fire:
+			fire = nil
+			if err := r.reload(); err != nil {
+				logger.Error("Failed to reload TLS certificate, keeping the previous one", "error", err)
+				continue
+			}
+			logger.Info("TLS certificate reloaded", "file", r.certFile)
+		}
+	}
+}
+
+// isCertEvent reports whether event touches the certificate or key file.
+func (r *certReloader) isCertEvent(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if name == filepath.Clean(r.certFile) || name == filepath.Clean(r.keyFile) {
+		return true
+	}
+	// Kubernetes secret volumes swap a "..data" symlink instead of touching the files.
+	return filepath.Base(name) == "..data"
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Close stops watching the certificate files.
+func (r *certReloader) Close() error {
+	close(r.done)
+	return r.watcher.Close()
+}
+
+// newTLSConfig returns the TLS configuration used by the HTTPS listener.
+func newTLSConfig(reloader *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+}
+
+// redirectHandler redirects every request to the same host and path over HTTPS on httpsPort.
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,469 @@
+package storage
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blockStatsInterval is the period of the block cache statistics log line.
+const blockStatsInterval = 5 * time.Minute
+
+// blockKey identifies one block of one file version.
+type blockKey struct {
+	file  string // hash of the path, size and modification time
+	index int64
+}
+
+// blockFetch is an upstream read shared by every reader of the same block.
+type blockFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// blockCache keeps fixed-size blocks of slow files on a local disk. Blocks
+// are read from upstream once, written to the cache directory and evicted in
+// least-recently-used order when the cache exceeds its size.
+type blockCache struct {
+	dir       string
+	blockSize int64
+	maxSize   int64
+	roots     []string
+
+	mu       sync.Mutex
+	size     int64
+	items    map[blockKey]*list.Element
+	eviction *list.List
+	inflight map[blockKey]*blockFetch
+
+	hits, misses, coalesced, evictions, upstreamBytes atomic.Int64
+}
+
+// blockEntry is the value stored in the eviction list.
+type blockEntry struct {
+	key  blockKey
+	size int64
+}
+
+// BlockCacheStats reports the activity of the block cache.
+type BlockCacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Coalesced     int64   `json:"coalesced"` // misses served by a read already in flight
+	Evictions     int64   `json:"evictions"`
+	UpstreamBytes int64   `json:"upstreamBytes"`
+	HitRatio      float64 `json:"hitRatio"`
+	Blocks        int     `json:"blocks"`
+	Size          int64   `json:"size"`
+	MaxSize       int64   `json:"maxSize"`
+}
+
+var (
+	blocks     *blockCache
+	blocksOnce sync.Once
+)
+
+// getBlockCache returns the block cache configured for this server, or nil
+// when block caching is disabled.
+func getBlockCache() *blockCache {
+	blocksOnce.Do(func() {
+		cfg := config.GetConfig()
+		if !cfg.BlockCacheEnabled {
+			return
+		}
+		dir := cfg.BlockCacheDirectory
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "pilipili-blocks")
+		}
+		cache, err := newBlockCache(dir, cfg.BlockCacheBlockSize, cfg.BlockCacheSize, cfg.BlockCacheRoots)
+		if err != nil {
+			logger.Error("Block cache disabled", "dir", dir, "error", err)
+			return
+		}
+		blocks = cache
+		go blocks.logStats()
+	})
+	return blocks
+}
+
+// newBlockCache returns a block cache in dir, indexing the blocks left there
+// by a previous run.
+func newBlockCache(dir string, blockSize, maxSize int64, roots []string) (*blockCache, error) {
+	if blockSize <= 0 || maxSize < blockSize {
+		return nil, fmt.Errorf("invalid block cache size %d with block size %d", maxSize, blockSize)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	cleaned := make([]string, len(roots))
+	for i, root := range roots {
+		cleaned[i] = filepath.Clean(root)
+	}
+	c := &blockCache{
+		dir:       dir,
+		blockSize: blockSize,
+		maxSize:   maxSize,
+		roots:     cleaned,
+		items:     make(map[blockKey]*list.Element),
+		eviction:  list.New(),
+		inflight:  make(map[blockKey]*blockFetch),
+	}
+	startTime := time.Now()
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+	logger.Info("Block cache initialized", "dir", dir, "blocks", len(c.items), "size", c.size, "maxSize", maxSize, "elapsed", time.Since(startTime))
+	return c, nil
+}
+
+// loadIndex indexes the blocks in the cache directory, oldest first, and
+// removes temporary files of interrupted writes. Blocks of a previous run
+// with a larger block size are discarded, other files are left alone.
+func (c *blockCache) loadIndex() error {
+	type found struct {
+		key     blockKey
+		size    int64
+		modTime time.Time
+	}
+	var blocks []found
+	err := filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			os.Remove(path)
+			return nil
+		}
+		key, ok := parseBlockName(entry.Name())
+		if !ok || filepath.Dir(path) != c.shardDir(key.file) {
+			return nil
+		}
+		if info.Size() > c.blockSize {
+			os.Remove(path)
+			return nil
+		}
+		blocks = append(blocks, found{key: key, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].modTime.Before(blocks[j].modTime) })
+	for _, b := range blocks {
+		c.items[b.key] = c.eviction.PushFront(&blockEntry{key: b.key, size: b.size})
+		c.size += b.size
+	}
+	c.evict()
+	return nil
+}
+
+// parseBlockName parses a block file name of the form <file>-<index>.
+func parseBlockName(name string) (blockKey, bool) {
+	file, index, ok := strings.Cut(name, "-")
+	if !ok || len(file) != 2*sha1.Size {
+		return blockKey{}, false
+	}
+	n, err := strconv.ParseInt(index, 10, 64)
+	if err != nil || n < 0 {
+		return blockKey{}, false
+	}
+	return blockKey{file: file, index: n}, true
+}
+
+// shardDir returns the directory of the blocks of file, which spreads the
+// blocks over 256 directories.
+func (c *blockCache) shardDir(file string) string {
+	return filepath.Join(c.dir, file[:2])
+}
+
+// blockPath returns the path of the cache file of key.
+func (c *blockCache) blockPath(key blockKey) string {
+	return filepath.Join(c.shardDir(key.file), key.file+"-"+strconv.FormatInt(key.index, 10))
+}
+
+// caches reports whether files under path are cached. A root matches itself
+// and the files below it, but not a sibling sharing its prefix: /mnt/media
+// does not cover /mnt/media2.
+func (c *blockCache) caches(path string) bool {
+	if len(c.roots) == 0 {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, root := range c.roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// block returns the data of block index of file, reading it from the cache
+// directory or from upstream. Concurrent misses on the same block share one
+// upstream read, which the others stop waiting for when their ctx is done.
+func (c *blockCache) block(ctx context.Context, file *cachedFile, index int64) ([]byte, error) {
+	key := blockKey{file: file.id, index: index}
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		c.eviction.MoveToFront(elem)
+		c.mu.Unlock()
+		data, err := os.ReadFile(c.blockPath(key))
+		if err == nil {
+			c.hits.Add(1)
+			return data, nil
+		}
+		// The block file went missing, read the block again.
+		logger.Warn("Failed to read cached block", "file", file.Name(), "block", index, "error", err)
+		c.mu.Lock()
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+	if fetch, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		c.coalesced.Add(1)
+		select {
+		case <-fetch.done:
+			return fetch.data, fetch.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	fetch := &blockFetch{done: make(chan struct{})}
+	c.inflight[key] = fetch
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	fetch.data, fetch.err = c.fetch(file, key)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(fetch.done)
+	return fetch.data, fetch.err
+}
+
+// fetch reads a block from upstream and stores it in the cache directory.
+// A block that cannot be stored is still returned.
+func (c *blockCache) fetch(file *cachedFile, key blockKey) ([]byte, error) {
+	startTime := time.Now()
+	offset := key.index * c.blockSize
+	data := make([]byte, min(c.blockSize, file.info.Size()-offset))
+	n, err := file.File.ReadAt(data, offset)
+	if n < len(data) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	c.upstreamBytes.Add(int64(n))
+	logger.Debug("Block read from upstream", "file", file.Name(), "block", key.index, "bytes", n, "elapsed", time.Since(startTime))
+
+	if err := c.store(key, data); err != nil {
+		logger.Warn("Failed to store block", "file", file.Name(), "block", key.index, "error", err)
+	}
+	return data, nil
+}
+
+// store writes a block to the cache directory and indexes it.
+func (c *blockCache) store(key blockKey, data []byte) error {
+	dir := c.shardDir(key.file)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.blockPath(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.removeEntry(elem)
+	}
+	c.items[key] = c.eviction.PushFront(&blockEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used blocks until the cache fits its
+// size. The caller must hold c.mu.
+func (c *blockCache) evict() {
+	for c.size > c.maxSize {
+		c.removeElement(c.eviction.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// removeElement drops elem from the index and deletes its file. The caller must hold c.mu.
+func (c *blockCache) removeElement(elem *list.Element) {
+	entry := c.removeEntry(elem)
+	if err := os.Remove(c.blockPath(entry.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("Failed to remove cached block", "error", err)
+	}
+}
+
+// removeEntry drops elem from the index only. The caller must hold c.mu.
+func (c *blockCache) removeEntry(elem *list.Element) *blockEntry {
+	entry := c.eviction.Remove(elem).(*blockEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	return entry
+}
+
+// stats returns the current statistics of the cache.
+func (c *blockCache) stats() BlockCacheStats {
+	c.mu.Lock()
+	count, size := len(c.items), c.size
+	c.mu.Unlock()
+	stats := BlockCacheStats{
+		Enabled:       true,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Coalesced:     c.coalesced.Load(),
+		Evictions:     c.evictions.Load(),
+		UpstreamBytes: c.upstreamBytes.Load(),
+		Blocks:        count,
+		Size:          size,
+		MaxSize:       c.maxSize,
+	}
+	if total := stats.Hits + stats.Misses + stats.Coalesced; total > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.Coalesced) / float64(total)
+	}
+	return stats
+}
+
+// logStats periodically logs the statistics of the cache while it is used.
+func (c *blockCache) logStats() {
+	var last BlockCacheStats
+	for range time.Tick(blockStatsInterval) {
+		stats := c.stats()
+		if stats.Hits == last.Hits && stats.Misses == last.Misses && stats.Coalesced == last.Coalesced {
+			continue
+		}
+		logger.Info("Block cache statistics", "hits", stats.Hits, "misses", stats.Misses, "coalesced", stats.Coalesced,
+			"hitRatio", fmt.Sprintf("%.3f", stats.HitRatio), "evictions", stats.Evictions, "upstreamBytes", stats.UpstreamBytes,
+			"size", stats.Size, "maxSize", stats.MaxSize)
+		last = stats
+	}
+}
+
+// BlockCacheStatistics returns the statistics of the block cache.
+func BlockCacheStatistics() BlockCacheStats {
+	if c := getBlockCache(); c != nil {
+		return c.stats()
+	}
+	return BlockCacheStats{}
+}
+
+// cachedFile reads a file through the block cache. The last block read is
+// kept in memory, since streams read each block in several smaller reads.
+type cachedFile struct {
+	File
+	cache *blockCache
+	info  os.FileInfo
+	id    string
+
+	mu        sync.Mutex
+	lastIndex int64
+	lastData  []byte
+}
+
+// newCachedFile wraps file, whose version is identified by its path, size
+// and modification time.
+func newCachedFile(cache *blockCache, file File, path string, info os.FileInfo) *cachedFile {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())))
+	return &cachedFile{File: file, cache: cache, info: info, id: hex.EncodeToString(sum[:]), lastIndex: -1}
+}
+
+// Stat returns the file info read when the file was opened.
+func (f *cachedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// ReadAt reads p from the blocks covering [off, off+len(p)).
+func (f *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext reads p like ReadAt. When ctx is done it stops waiting for
+// blocks read by other streams, which still complete and are cached.
+func (f *cachedFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	size := f.info.Size()
+	total := 0
+	for len(p) > 0 && off < size {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		index := off / f.cache.blockSize
+		data, err := f.block(ctx, index)
+		if err != nil {
+			return total, err
+		}
+		n := copy(p, data[off-index*f.cache.blockSize:])
+		total += n
+		off += int64(n)
+		p = p[n:]
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+// block returns block index, from memory when it was the last block read.
+func (f *cachedFile) block(ctx context.Context, index int64) ([]byte, error) {
+	f.mu.Lock()
+	if f.lastIndex == index {
+		data := f.lastData
+		f.mu.Unlock()
+		return data, nil
+	}
+	f.mu.Unlock()
+
+	data, err := f.cache.block(ctx, f, index)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.lastIndex, f.lastData = index, data
+	f.mu.Unlock()
+	return data, nil
+}
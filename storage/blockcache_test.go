@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockCacheCaches(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 1024, 4096, []string{"/mnt/media/", "/srv/rclone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/mnt/media", true},
+		{"/mnt/media/movie.mkv", true},
+		{"/mnt/media/shows/../movie.mkv", true},
+		{"/srv/rclone/show/episode.mkv", true},
+		{"/mnt/media2/movie.mkv", false},
+		{"/srv/rclone-backup/movie.mkv", false},
+		{"/mnt/media/../other/movie.mkv", false},
+		{"/mnt", false},
+	}
+	for _, tt := range tests {
+		if got := cache.caches(tt.path); got != tt.want {
+			t.Errorf("caches(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	everything, err := newBlockCache(t.TempDir(), 1024, 4096, []string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !everything.caches("/mnt/media/movie.mkv") {
+		t.Error("root / does not cover /mnt/media/movie.mkv")
+	}
+}
+
+// countingFile is an upstream file that counts its reads. When gate is set,
+// reads wait for it to be closed.
+type countingFile struct {
+	data  []byte
+	gate  chan struct{}
+	reads atomic.Int32
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.Add(1)
+	if f.gate != nil {
+		<-f.gate
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *countingFile) Close() error               { return nil }
+func (f *countingFile) Name() string               { return "/mnt/media/movie.mkv" }
+func (f *countingFile) Stat() (os.FileInfo, error) { return fileInfo{size: int64(len(f.data))}, nil }
+
+// fileInfo describes a countingFile.
+type fileInfo struct {
+	size int64
+}
+
+func (i fileInfo) Name() string       { return "movie.mkv" }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() fs.FileMode  { return 0o644 }
+func (i fileInfo) ModTime() time.Time { return time.Unix(1700000000, 0) }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() any           { return nil }
+
+// newCountingFile returns an upstream file of blocks of 1024 bytes, each
+// filled with its index.
+func newCountingFile(blocks int) *countingFile {
+	data := make([]byte, blocks*1024)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+	return &countingFile{data: data}
+}
+
+// readBlock reads the start of block index of upstream through cache, as a
+// new stream would, and checks the data.
+func readBlock(t *testing.T, cache *blockCache, upstream *countingFile, index int64) {
+	t.Helper()
+	info, _ := upstream.Stat()
+	file := newCachedFile(cache, upstream, upstream.Name(), info)
+	p := make([]byte, 100)
+	if _, err := file.ReadAt(p, index*1024); err != nil {
+		t.Errorf("block %d: %v", index, err)
+		return
+	}
+	if p[0] != byte(index) || p[99] != byte(index) {
+		t.Errorf("block %d holds the data of block %d", index, p[0])
+	}
+}
+
+func TestBlockCacheCoalescesMisses(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 1024, 8*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := newCountingFile(4)
+	upstream.gate = make(chan struct{})
+
+	// Every stream misses the same block while the first read is in flight.
+	const streams = 8
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readBlock(t, cache, upstream, 2)
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.coalesced.Load() < streams-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d streams wait for the read in flight", cache.coalesced.Load(), streams-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.gate)
+	wg.Wait()
+	if reads := upstream.reads.Load(); reads != 1 {
+		t.Errorf("%d upstream reads, want 1", reads)
+	}
+
+	// Later streams find the block on disk.
+	readBlock(t, cache, upstream, 2)
+	stats := cache.stats()
+	want := BlockCacheStats{
+		Enabled:       true,
+		Hits:          1,
+		Misses:        1,
+		Coalesced:     streams - 1,
+		UpstreamBytes: 1024,
+		HitRatio:      float64(streams) / float64(streams+1),
+		Blocks:        1,
+		Size:          1024,
+		MaxSize:       8 * 1024,
+	}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newBlockCache(dir, 1024, 3*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := newCountingFile(4)
+	for index := int64(0); index < 3; index++ {
+		readBlock(t, cache, upstream, index)
+	}
+	// Block 0 is used again, so block 1 is the least recently used when
+	// block 3 no longer fits.
+	readBlock(t, cache, upstream, 0)
+	readBlock(t, cache, upstream, 3)
+
+	stats := cache.stats()
+	if stats.Evictions != 1 || stats.Blocks != 3 || stats.Size != 3*1024 || stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("stats = %+v, want 1 eviction, 3 blocks of 3072 bytes, 1 hit and 4 misses", stats)
+	}
+	info, _ := upstream.Stat()
+	id := newCachedFile(cache, upstream, upstream.Name(), info).id
+	for index, cached := range []bool{true, false, true, true} {
+		_, err := os.Stat(cache.blockPath(blockKey{file: id, index: int64(index)}))
+		if (err == nil) != cached {
+			t.Errorf("block %d cached on disk: %v, want %v", index, err == nil, cached)
+		}
+	}
+
+	reads := upstream.reads.Load()
+	readBlock(t, cache, upstream, 0)
+	readBlock(t, cache, upstream, 1)
+	if got := upstream.reads.Load() - reads; got != 1 {
+		t.Errorf("%d upstream reads for a cached and an evicted block, want 1", got)
+	}
+
+	// A restarted server finds the blocks left on disk.
+	restarted, err := newBlockCache(dir, 1024, 3*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := restarted.stats(); stats.Blocks != 3 || stats.Size != 3*1024 {
+		t.Errorf("after a restart: %d blocks of %d bytes, want 3 of 3072", stats.Blocks, stats.Size)
+	}
+}
@@ -0,0 +1,80 @@
+// Package storage provides ranged access to the media files served by the streamer.
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// File is an open media file. Reads are positional so that several readers,
+// such as a stream and a container parser, can share one handle.
+type File interface {
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
+// ContextReaderAt is implemented by files whose reads can give up waiting
+// once a context is done, such as files read through the block cache.
+type ContextReaderAt interface {
+	ReadAtContext(ctx context.Context, p []byte, off int64) (int, error)
+}
+
+// ReadAtContext reads len(p) bytes of r at off, returning ctx.Err() when ctx
+// is done before or, for a ContextReaderAt, during the read. A read of a
+// plain file already in progress cannot be interrupted and completes.
+func ReadAtContext(ctx context.Context, r io.ReaderAt, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cr, ok := r.(ContextReaderAt); ok {
+		return cr.ReadAtContext(ctx, p, off)
+	}
+	return r.ReadAt(p, off)
+}
+
+// contextReaderAt reads from r until ctx is done.
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+// WithContext returns a reader of r whose reads go through ReadAtContext
+// with ctx, for code that only takes an io.ReaderAt.
+func WithContext(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	return &contextReaderAt{ctx: ctx, r: r}
+}
+
+// ReadAt reads p with the context of the reader.
+func (c *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return ReadAtContext(c.ctx, c.r, p, off)
+}
+
+// Open opens the file at path for ranged reads. Files under the block cache
+// roots are read through the block cache when it is enabled.
+func Open(path string) (File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cache := getBlockCache()
+	if cache == nil || !cache.caches(path) {
+		return file, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return file, nil
+	}
+	return newCachedFile(cache, file, path, info), nil
+}
+
+// Stat returns the file info of the file at path without opening it.
+func Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
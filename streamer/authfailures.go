@@ -0,0 +1,55 @@
+package streamer
+
+import (
+	"github.com/gin-gonic/gin"
+	"sync"
+	"time"
+)
+
+// maxAuthFailures bounds the number of recent authentication failures kept.
+const maxAuthFailures = 100
+
+// AuthFailure describes a request refused for its signature.
+type AuthFailure struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"clientIp"`
+	Path     string    `json:"path"`
+	Reason   string    `json:"reason"`
+}
+
+// authFailures is a ring of the most recent authentication failures.
+var authFailures struct {
+	mu     sync.Mutex
+	ring   [maxAuthFailures]AuthFailure
+	next   int
+	filled bool
+}
+
+// recordAuthFailure records that the request c was refused for reason.
+func recordAuthFailure(c *gin.Context, reason error) {
+	authFailures.mu.Lock()
+	defer authFailures.mu.Unlock()
+	authFailures.ring[authFailures.next] = AuthFailure{
+		Time:     time.Now(),
+		ClientIP: c.ClientIP(),
+		Path:     c.Request.URL.Path + "?path=" + c.Query("path"),
+		Reason:   reason.Error(),
+	}
+	authFailures.next = (authFailures.next + 1) % maxAuthFailures
+	authFailures.filled = authFailures.filled || authFailures.next == 0
+}
+
+// RecentAuthFailures returns the most recent authentication failures, newest first.
+func RecentAuthFailures() []AuthFailure {
+	authFailures.mu.Lock()
+	defer authFailures.mu.Unlock()
+	count := authFailures.next
+	if authFailures.filled {
+		count = maxAuthFailures
+	}
+	failures := make([]AuthFailure, 0, count)
+	for i := 1; i <= count; i++ {
+		failures = append(failures, authFailures.ring[(authFailures.next-i+maxAuthFailures)%maxAuthFailures])
+	}
+	return failures
+}
@@ -0,0 +1,396 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/mp4"
+	"PiliPili_Backend/storage"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxCachedDashSources bounds the number of indexed media files kept in memory.
+const maxCachedDashSources = 64
+
+// dashContentType is the content type of MPD manifests.
+const dashContentType = "application/dash+xml"
+
+// errNoSegmentIndex is returned for files that cannot be fetched by byte
+// range because they lack a sidx box or Cues.
+var errNoSegmentIndex = errors.New("file has no segment index (sidx or Cues)")
+
+// dashSource describes a single-file media source that DASH clients play by
+// fetching byte ranges: the initialization data at the start of the file
+// and the index of its fragments or clusters.
+type dashSource struct {
+	profile    string
+	mimeType   string
+	duration   time.Duration
+	components []dashComponent
+
+	initEnd    int64 // the initialization data is [0, initEnd)
+	indexStart int64 // the index is [indexStart, indexEnd)
+	indexEnd   int64
+}
+
+// dashComponent is one track of a dash source.
+type dashComponent struct {
+	contentType string // "video" or "audio"
+	codec       string
+	language    string
+	width       uint32
+	height      uint32
+}
+
+// dashSourceCache holds indexed media files keyed by file version.
+var dashSourceCache = newLRUCache[fileKey, *dashSource](maxCachedDashSources, func(*dashSource) int64 { return 1 })
+
+// openDashSource indexes the fragmented MP4 or WebM file at filePath. The
+// result is cached per file version.
+func openDashSource(filePath string) (*dashSource, fileKey, error) {
+	file, err := storage.Open(filePath)
+	if err != nil {
+		return nil, fileKey{}, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, fileKey{}, err
+	}
+	key := newFileKey(filePath, fileInfo)
+	if source, ok := dashSourceCache.Get(key); ok {
+		return source, key, nil
+	}
+
+	var source *dashSource
+	header := readHeader(file)
+	switch {
+	case len(header) >= 4 && string(header[:4]) == "\x1A\x45\xDF\xA3":
+		var m *mkvFile
+		if m, err = loadMatroska(file, key); err == nil {
+			source, err = newMkvDashSource(m)
+		}
+	case len(header) >= 8 && isMP4Brand(string(header[4:8])):
+		source, err = newMP4DashSource(file, key.size)
+	default:
+		err = errUnsupportedContainer
+	}
+	if err != nil {
+		return nil, fileKey{}, err
+	}
+	if len(source.components) == 0 {
+		return nil, fileKey{}, errNoPlayableTracks
+	}
+	dashSourceCache.Add(key, source)
+	return source, key, nil
+}
+
+// newMP4DashSource indexes a fragmented MP4 file. The top-level boxes are
+// only scanned up to the first fragment, where the moov and sidx boxes of
+// on-demand files end.
+func newMP4DashSource(r io.ReaderAt, size int64) (*dashSource, error) {
+	var moov, sidx *mp4.BoxHeader
+	for offset := int64(0); offset+8 <= size; {
+		h, err := mp4.ReadBoxHeader(r, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		switch h.Type {
+		case "moov":
+			moov = &h
+		case "sidx":
+			if sidx == nil {
+				sidx = &h
+			}
+		}
+		if h.Type == "moof" || h.Type == "mdat" || (moov != nil && sidx != nil) {
+			break
+		}
+		offset = h.End()
+	}
+	if moov == nil {
+		return nil, mp4.ErrNoMovie
+	}
+	if sidx == nil {
+		return nil, errNoSegmentIndex
+	}
+
+	movie, err := mp4.LoadMovie(r, *moov, size)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mp4.LoadBox(r, *sidx)
+	if err != nil {
+		return nil, err
+	}
+	index, err := mp4.ParseSegmentIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &dashSource{
+		profile:    "urn:mpeg:dash:profile:isoff-on-demand:2011",
+		mimeType:   "video/mp4",
+		initEnd:    moov.End(),
+		indexStart: sidx.Offset,
+		indexEnd:   sidx.End(),
+	}
+	if index.Timescale > 0 {
+		source.duration = time.Duration(float64(index.Duration()) / float64(index.Timescale) * float64(time.Second))
+	}
+	if source.duration == 0 && movie.Timescale > 0 {
+		source.duration = time.Duration(float64(movie.Duration) / float64(movie.Timescale) * float64(time.Second))
+	}
+	for _, track := range movie.Tracks {
+		if track.SampleEntry == nil {
+			continue
+		}
+		component := dashComponent{codec: mp4.CodecString(track.SampleEntry), language: track.Language}
+		switch track.Handler {
+		case "vide":
+			component.contentType, component.width, component.height = "video", track.Width, track.Height
+		case "soun":
+			component.contentType = "audio"
+		default:
+			continue
+		}
+		source.components = append(source.components, component)
+	}
+	if !source.hasVideo() {
+		source.mimeType = "audio/mp4"
+	}
+	return source, nil
+}
+
+// newMkvDashSource indexes a WebM or Matroska file whose Cues locate its clusters.
+func newMkvDashSource(m *mkvFile) (*dashSource, error) {
+	if m.cuesSize == 0 || m.firstCluster == 0 {
+		return nil, errNoSegmentIndex
+	}
+	source := &dashSource{
+		profile:    "urn:mpeg:dash:profile:webm-on-demand:2012",
+		duration:   m.Duration,
+		initEnd:    m.firstCluster,
+		indexStart: m.cuesOffset,
+		indexEnd:   m.cuesOffset + m.cuesSize,
+	}
+	for _, track := range m.Tracks {
+		if track.Type != "video" && track.Type != "audio" {
+			continue
+		}
+		codec := mkvCodecString(track)
+		if codec == "" {
+			logger.Debug("Track codec has no DASH codec string", "track", track.Number, "codec", track.CodecID)
+			continue
+		}
+		source.components = append(source.components, dashComponent{
+			contentType: track.Type,
+			codec:       codec,
+			language:    track.Language,
+			width:       uint32(track.Width),
+			height:      uint32(track.Height),
+		})
+	}
+
+	container := "x-matroska"
+	if m.DocType == "webm" {
+		container = "webm"
+	}
+	if source.hasVideo() {
+		source.mimeType = "video/" + container
+	} else {
+		source.mimeType = "audio/" + container
+	}
+	return source, nil
+}
+
+// hasVideo reports whether the source has a video track.
+func (s *dashSource) hasVideo() bool {
+	for _, component := range s.components {
+		if component.contentType == "video" {
+			return true
+		}
+	}
+	return false
+}
+
+// mkvCodecString returns the RFC 6381 codec string of a Matroska track, or
+// an empty string for codecs DASH clients cannot identify.
+func mkvCodecString(track *mkvTrack) string {
+	config, _ := track.decodedCodecPrivate()
+	switch track.CodecID {
+	case "V_VP8":
+		return "vp8"
+	case "V_VP9":
+		return "vp9"
+	case "V_AV1":
+		// av1C: marker and version, seq_profile and seq_level_idx_0, then seq_tier_0 and bit depth flags.
+		if len(config) < 3 {
+			return "av01"
+		}
+		tier, depth := "M", 8
+		if config[2]&0x80 != 0 {
+			tier = "H"
+		}
+		if config[2]&0x40 != 0 {
+			depth = 10
+			if config[2]&0x20 != 0 {
+				depth = 12
+			}
+		}
+		return fmt.Sprintf("av01.%d.%02d%s.%02d", config[1]>>5, config[1]&0x1F, tier, depth)
+	case "V_MPEG4/ISO/AVC":
+		return mp4.CodecString(mp4.VideoSampleEntry("avc1", 0, 0, "avcC", config))
+	case "V_MPEGH/ISO/HEVC":
+		return mp4.CodecString(mp4.VideoSampleEntry("hvc1", 0, 0, "hvcC", config))
+	case "A_OPUS":
+		return "opus"
+	case "A_VORBIS":
+		return "vorbis"
+	case "A_FLAC":
+		return "flac"
+	case "A_AC3":
+		return "ac-3"
+	case "A_EAC3":
+		return "ec-3"
+	}
+	if strings.HasPrefix(track.CodecID, "A_AAC") {
+		if len(config) < 2 {
+			config = aacAudioSpecificConfig(track.CodecID, uint32(math.Round(track.SampleRate)), uint16(track.Channels))
+		}
+		return mp4.CodecString(mp4.AudioSampleEntry("mp4a", 2, 0, mp4.ESDSBox(config)))
+	}
+	return ""
+}
+
+// MPD elements of a single-period on-demand presentation.
+type (
+	dashMPD struct {
+		XMLName                   xml.Name   `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+		Profiles                  string     `xml:"profiles,attr"`
+		Type                      string     `xml:"type,attr"`
+		MediaPresentationDuration string     `xml:"mediaPresentationDuration,attr"`
+		MinBufferTime             string     `xml:"minBufferTime,attr"`
+		Period                    dashPeriod `xml:"Period"`
+	}
+	dashPeriod struct {
+		ID            string            `xml:"id,attr"`
+		Start         string            `xml:"start,attr"`
+		AdaptationSet dashAdaptationSet `xml:"AdaptationSet"`
+	}
+	dashAdaptationSet struct {
+		ID                      int                    `xml:"id,attr"`
+		ContentType             string                 `xml:"contentType,attr"`
+		MimeType                string                 `xml:"mimeType,attr"`
+		Lang                    string                 `xml:"lang,attr,omitempty"`
+		SubsegmentAlignment     bool                   `xml:"subsegmentAlignment,attr"`
+		SubsegmentStartsWithSAP int                    `xml:"subsegmentStartsWithSAP,attr"`
+		ContentComponents       []dashContentComponent `xml:"ContentComponent"`
+		Representation          dashRepresentation     `xml:"Representation"`
+	}
+	dashContentComponent struct {
+		ID          int    `xml:"id,attr"`
+		ContentType string `xml:"contentType,attr"`
+		Lang        string `xml:"lang,attr,omitempty"`
+	}
+	dashRepresentation struct {
+		ID          string          `xml:"id,attr"`
+		Codecs      string          `xml:"codecs,attr"`
+		Bandwidth   int64           `xml:"bandwidth,attr"`
+		Width       uint32          `xml:"width,attr,omitempty"`
+		Height      uint32          `xml:"height,attr,omitempty"`
+		BaseURL     string          `xml:"BaseURL"`
+		SegmentBase dashSegmentBase `xml:"SegmentBase"`
+	}
+	dashSegmentBase struct {
+		IndexRange      string             `xml:"indexRange,attr"`
+		IndexRangeExact bool               `xml:"indexRangeExact,attr"`
+		Initialization  dashInitialization `xml:"Initialization"`
+	}
+	dashInitialization struct {
+		Range string `xml:"range,attr"`
+	}
+)
+
+// DashManifest serves an MPEG-DASH manifest for a fragmented MP4 or WebM
+// file. The file is a single representation described with SegmentBase, so
+// clients fetch its initialization data, index and fragments as byte ranges
+// of /stream. A file holding several tracks is one multiplexed representation.
+func DashManifest(c *gin.Context) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	source, key, err := openDashSource(filePath)
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	case errors.Is(err, errUnsupportedContainer), errors.Is(err, errNotMatroska), errors.Is(err, mp4.ErrNoMovie):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported container"})
+		return
+	default:
+		logger.Error("Failed to index media for DASH", "filePath", filePath, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot describe media as DASH: " + err.Error()})
+		return
+	}
+
+	set := dashAdaptationSet{
+		ContentType:             source.components[0].contentType,
+		MimeType:                source.mimeType,
+		SubsegmentAlignment:     true,
+		SubsegmentStartsWithSAP: 1,
+	}
+	var codecs []string
+	for i, component := range source.components {
+		codecs = append(codecs, component.codec)
+		if component.contentType == "video" && set.Representation.Width == 0 {
+			set.ContentType = "video"
+			set.Representation.Width, set.Representation.Height = component.width, component.height
+		}
+		if len(source.components) > 1 {
+			set.ContentComponents = append(set.ContentComponents, dashContentComponent{ID: i + 1, ContentType: component.contentType, Lang: component.language})
+		}
+	}
+	if len(source.components) == 1 {
+		set.Lang = source.components[0].language
+	}
+
+	seconds := math.Max(source.duration.Seconds(), 1)
+	set.Representation.ID = "0"
+	set.Representation.Codecs = strings.Join(codecs, ",")
+	set.Representation.Bandwidth = int64(float64(key.size*8) / seconds)
+	// The manifest is served from /dash/, next to which /stream serves the file.
+	set.Representation.BaseURL = "../stream?" + signedQuery(c).Encode()
+	set.Representation.SegmentBase = dashSegmentBase{
+		IndexRange:      fmt.Sprintf("%d-%d", source.indexStart, source.indexEnd-1),
+		IndexRangeExact: true,
+		Initialization:  dashInitialization{Range: fmt.Sprintf("0-%d", source.initEnd-1)},
+	}
+
+	mpd := dashMPD{
+		Profiles:                  source.profile,
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", source.duration.Seconds()),
+		MinBufferTime:             "PT2S",
+		Period:                    dashPeriod{ID: "0", Start: "PT0S", AdaptationSet: set},
+	}
+	body, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		logger.Error("Failed to encode DASH manifest", "filePath", filePath, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, dashContentType, append([]byte(xml.Header), append(body, '\n')...))
+}
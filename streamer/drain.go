@@ -0,0 +1,88 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamTracker counts in-flight streams and refuses new ones once draining has started.
+var streamTracker struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+}
+
+// beginStream registers a new in-flight stream. It returns false when the
+// server is draining and the stream must be refused.
+func beginStream() bool {
+	streamTracker.mu.Lock()
+	defer streamTracker.mu.Unlock()
+	if streamTracker.draining {
+		return false
+	}
+	streamTracker.active++
+	return true
+}
+
+// endStream unregisters an in-flight stream.
+func endStream() {
+	streamTracker.mu.Lock()
+	streamTracker.active--
+	streamTracker.mu.Unlock()
+}
+
+// Drain returns a middleware counting the requests of the handlers after it
+// as in-flight streams, so that shutdown waits for them, and refusing new
+// ones once draining has started. Every media endpoint is registered
+// behind it, as playlists, segments, subtitles and images are cut off by
+// shutdown just like streams are.
+func Drain() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !beginStream() {
+			logger.Warn("Server is draining, refusing new request", "path", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+			return
+		}
+		defer endStream()
+		c.Next()
+	}
+}
+
+// StartDraining makes the streamer refuse new streams while letting in-flight ones finish.
+func StartDraining() {
+	streamTracker.mu.Lock()
+	streamTracker.draining = true
+	streamTracker.mu.Unlock()
+}
+
+// IsDraining reports whether the streamer has stopped accepting new streams.
+func IsDraining() bool {
+	streamTracker.mu.Lock()
+	defer streamTracker.mu.Unlock()
+	return streamTracker.draining
+}
+
+// ActiveStreamCount returns the number of in-flight streams.
+func ActiveStreamCount() int {
+	streamTracker.mu.Lock()
+	defer streamTracker.mu.Unlock()
+	return streamTracker.active
+}
+
+// WaitForStreams blocks until every in-flight stream has finished or ctx is done.
+func WaitForStreams(ctx context.Context) error {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for ActiveStreamCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
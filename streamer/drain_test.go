@@ -0,0 +1,53 @@
+package streamer
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDrain checks that requests behind the drain middleware are waited for
+// on shutdown and that new ones, of any media endpoint, are refused.
+func TestDrain(t *testing.T) {
+	t.Cleanup(func() {
+		streamTracker.mu.Lock()
+		streamTracker.draining = false
+		streamTracker.mu.Unlock()
+	})
+	started, finish := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(Drain())
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-finish
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/thumbnail", Thumbnail)
+
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		inFlight <- w
+	}()
+	<-started
+	if count := ActiveStreamCount(); count != 1 {
+		t.Fatalf("%d requests in flight, want 1", count)
+	}
+
+	StartDraining()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, signedURL(t, "/thumbnail", "drain.mkv", nil), nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("thumbnail while draining: got %d, want 503", w.Code)
+	}
+
+	close(finish)
+	if w := <-inFlight; w.Code != http.StatusOK {
+		t.Errorf("request in flight when draining started: got %d, want 200", w.Code)
+	}
+	if count := ActiveStreamCount(); count != 0 {
+		t.Errorf("%d requests in flight after they finished, want 0", count)
+	}
+}
@@ -0,0 +1,205 @@
+package streamer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// maxEBMLElementRead bounds how much of a single element is loaded into memory,
+// protecting against corrupt size fields.
+const maxEBMLElementRead = 64 * 1024 * 1024
+
+// ebmlHeaderPeek is the number of bytes read with every element header: enough
+// for the longest ID and size plus the first bytes of a block.
+const ebmlHeaderPeek = 16
+
+var errInvalidEBML = errors.New("invalid EBML data")
+
+// ebmlElement describes the position of an EBML element.
+type ebmlElement struct {
+	id         uint32
+	offset     int64 // offset of the element ID
+	dataOffset int64 // offset of the element payload
+	size       int64 // payload size, -1 when unknown (live or streamed files)
+	peek       []byte
+}
+
+// end returns the offset just past the element, or -1 when its size is unknown.
+func (e ebmlElement) end() int64 {
+	if e.size < 0 {
+		return -1
+	}
+	return e.dataOffset + e.size
+}
+
+// readElementHeader reads the element starting at offset. The first payload
+// bytes read along with the header are kept in peek.
+func readElementHeader(r io.ReaderAt, offset int64) (ebmlElement, error) {
+	buf := make([]byte, ebmlHeaderPeek)
+	n, err := r.ReadAt(buf, offset)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return ebmlElement{}, err
+	}
+	buf = buf[:n]
+
+	id, idLen, ok := parseElementID(buf)
+	if !ok {
+		return ebmlElement{}, fmt.Errorf("%w: bad element ID at %d", errInvalidEBML, offset)
+	}
+	size, sizeLen, ok := parseVintSize(buf[idLen:])
+	if !ok {
+		return ebmlElement{}, fmt.Errorf("%w: bad element size at %d", errInvalidEBML, offset)
+	}
+
+	headerLen := idLen + sizeLen
+	peek := buf[headerLen:]
+	if size >= 0 && int64(len(peek)) > size {
+		peek = peek[:size]
+	}
+	return ebmlElement{
+		id:         id,
+		offset:     offset,
+		dataOffset: offset + int64(headerLen),
+		size:       size,
+		peek:       peek,
+	}, nil
+}
+
+// readElementData loads the payload of e into memory.
+func readElementData(r io.ReaderAt, e ebmlElement) ([]byte, error) {
+	if e.size < 0 || e.size > maxEBMLElementRead {
+		return nil, fmt.Errorf("%w: element 0x%X too large to load (%d bytes)", errInvalidEBML, e.id, e.size)
+	}
+	if int64(len(e.peek)) == e.size {
+		return e.peek, nil
+	}
+	data := make([]byte, e.size)
+	if _, err := r.ReadAt(data, e.dataOffset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// parseElementID decodes a variable-length element ID, keeping its length marker.
+func parseElementID(buf []byte) (uint32, int, bool) {
+	if len(buf) == 0 || buf[0] == 0 {
+		return 0, 0, false
+	}
+	length := bits.LeadingZeros8(buf[0]) + 1
+	if length > 4 || len(buf) < length {
+		return 0, 0, false
+	}
+	var id uint32
+	for _, b := range buf[:length] {
+		id = id<<8 | uint32(b)
+	}
+	return id, length, true
+}
+
+// parseVintSize decodes a variable-length size, returning -1 for the reserved
+// all-ones value meaning "unknown size".
+func parseVintSize(buf []byte) (int64, int, bool) {
+	value, length, ok := parseVint(buf)
+	if !ok {
+		return 0, 0, false
+	}
+	if value == (uint64(1)<<(7*length))-1 {
+		return -1, length, true
+	}
+	if value > math.MaxInt64 {
+		return 0, 0, false
+	}
+	return int64(value), length, true
+}
+
+// parseVint decodes a variable-length integer without its length marker.
+func parseVint(buf []byte) (uint64, int, bool) {
+	if len(buf) == 0 || buf[0] == 0 {
+		return 0, 0, false
+	}
+	length := bits.LeadingZeros8(buf[0]) + 1
+	if len(buf) < length {
+		return 0, 0, false
+	}
+	value := uint64(buf[0]) & (0xFF >> length)
+	for _, b := range buf[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length, true
+}
+
+// ebmlChild is an element parsed from an in-memory master element.
+type ebmlChild struct {
+	id   uint32
+	data []byte
+	// offset of the child ID relative to the start of the parent payload
+	offset int
+}
+
+// parseChildren splits the payload of a master element into its children.
+func parseChildren(data []byte) ([]ebmlChild, error) {
+	var children []ebmlChild
+	for pos := 0; pos < len(data); {
+		id, idLen, ok := parseElementID(data[pos:])
+		if !ok {
+			return children, fmt.Errorf("%w: bad child ID", errInvalidEBML)
+		}
+		size, sizeLen, ok := parseVintSize(data[pos+idLen:])
+		if !ok {
+			return children, fmt.Errorf("%w: bad child size", errInvalidEBML)
+		}
+		start := pos + idLen + sizeLen
+		end := len(data)
+		if size >= 0 && int64(start)+size <= int64(len(data)) {
+			end = start + int(size)
+		}
+		children = append(children, ebmlChild{id: id, data: data[start:end], offset: pos})
+		pos = end
+	}
+	return children, nil
+}
+
+// ebmlUint decodes a big-endian unsigned integer element.
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// ebmlInt decodes a big-endian signed integer element.
+func ebmlInt(data []byte) int64 {
+	if len(data) == 0 {
+		return 0
+	}
+	value := int64(int8(data[0]))
+	for _, b := range data[1:] {
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// ebmlFloat decodes a 4 or 8 byte float element.
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// ebmlString decodes a string element, dropping trailing NUL padding.
+func ebmlString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00")
+}
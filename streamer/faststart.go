@@ -0,0 +1,156 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/mp4"
+	"PiliPili_Backend/storage"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxFaststartMoov bounds the size of moov boxes relocated in memory.
+const maxFaststartMoov = 64 * 1024 * 1024
+
+// faststartLayout describes the virtual faststart view of an MP4 file whose
+// moov box follows its media data. The moov box is moved in front of the
+// first mdat box and everything between them moves back by its size, so the
+// view has the same size as the file:
+//
+//	[0, insertAt)                    file bytes [0, insertAt)
+//	[insertAt, insertAt+len(moov))   rewritten moov box
+//	[insertAt+len(moov), moovEnd)    file bytes [insertAt, moovOffset)
+//	[moovEnd, size)                  file bytes [moovEnd, size)
+type faststartLayout struct {
+	moov     []byte // moov box with rewritten chunk offsets, nil when the file needs no rewriting
+	insertAt int64
+	moovEnd  int64 // end of the original moov box, identical in both layouts
+}
+
+// faststartFile serves the virtual faststart view of a file.
+type faststartFile struct {
+	storage.File
+	layout *faststartLayout
+}
+
+// ReadAt maps the virtual layout onto the underlying file.
+func (f *faststartFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext reads p like ReadAt, passing ctx to the underlying file.
+func (f *faststartFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	l := f.layout
+	moovStart, moovSize := l.insertAt, int64(len(l.moov))
+	total := 0
+	for len(p) > 0 {
+		var n int
+		var err error
+		switch {
+		case off < moovStart:
+			n, err = storage.ReadAtContext(ctx, f.File, p[:min(int64(len(p)), moovStart-off)], off)
+		case off < moovStart+moovSize:
+			n = copy(p, l.moov[off-moovStart:])
+		case off < l.moovEnd:
+			n, err = storage.ReadAtContext(ctx, f.File, p[:min(int64(len(p)), l.moovEnd-off)], off-moovSize)
+		default:
+			n, err = storage.ReadAtContext(ctx, f.File, p, off)
+		}
+		total += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+	}
+	return total, nil
+}
+
+var (
+	faststartCache     *lruCache[fileKey, *faststartLayout]
+	faststartCacheOnce sync.Once
+)
+
+// getFaststartCache returns the cache of rewritten moov boxes, sized from the configuration.
+func getFaststartCache() *lruCache[fileKey, *faststartLayout] {
+	faststartCacheOnce.Do(func() {
+		faststartCache = newLRUCache[fileKey, *faststartLayout](config.GetConfig().FaststartCacheSize, func(l *faststartLayout) int64 {
+			return int64(len(l.moov)) + 64
+		})
+	})
+	return faststartCache
+}
+
+// faststartView returns the faststart view of file when it is an MP4 file
+// with its moov box after the media data, and file itself otherwise.
+func faststartView(filePath string, file storage.File, fileInfo os.FileInfo) storage.File {
+	if !config.GetConfig().Faststart {
+		return file
+	}
+	key := newFileKey(filePath, fileInfo)
+	cache := getFaststartCache()
+	layout, ok := cache.Get(key)
+	if !ok {
+		startTime := time.Now()
+		layout = newFaststartLayout(file, fileInfo.Size())
+		cache.Add(key, layout)
+		if layout.moov != nil {
+			logger.Info("Serving MP4 with relocated moov box", "filePath", filePath, "moovSize", len(layout.moov), "elapsed", time.Since(startTime))
+		}
+	}
+	if layout.moov == nil {
+		return file
+	}
+	return &faststartFile{File: file, layout: layout}
+}
+
+// newFaststartLayout plans the faststart view of a file. Files that are not
+// MP4, already start with their moov box or cannot be rewritten get a layout
+// without moov, served as they are.
+func newFaststartLayout(r io.ReaderAt, size int64) *faststartLayout {
+	header := readHeader(r)
+	if len(header) < 8 || !isMP4Brand(string(header[4:8])) {
+		return &faststartLayout{}
+	}
+	boxes, err := mp4.ReadTopLevel(r, size)
+	if err != nil {
+		return &faststartLayout{}
+	}
+
+	var mdat, moov *mp4.BoxHeader
+	for i := range boxes {
+		switch boxes[i].Type {
+		case "mdat":
+			if mdat == nil && moov == nil {
+				mdat = &boxes[i]
+			}
+		case "moov":
+			if moov == nil {
+				moov = &boxes[i]
+			}
+		case "moof":
+			// Fragmented files are described by their fragments.
+			return &faststartLayout{}
+		}
+	}
+	if moov == nil || mdat == nil || moov.Size > maxFaststartMoov {
+		return &faststartLayout{}
+	}
+
+	data := make([]byte, moov.Size)
+	if n, err := r.ReadAt(data, moov.Offset); n < len(data) {
+		logger.Warn("Failed to read moov box", "error", err)
+		return &faststartLayout{}
+	}
+	if err := mp4.ShiftChunkOffsets(data, mdat.Offset, moov.Offset, moov.Size); err != nil {
+		logger.Debug("Cannot relocate moov box", "error", err)
+		return &faststartLayout{}
+	}
+	return &faststartLayout{moov: data, insertAt: mdat.Offset, moovEnd: moov.End()}
+}
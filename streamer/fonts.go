@@ -0,0 +1,467 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/fonts"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"PiliPili_Backend/subtitle"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFontSize bounds the size of fonts loaded into memory for subsetting.
+const maxFontSize = 64 * 1024 * 1024
+
+// maxCachedFontNames bounds the number of fonts whose family names are cached.
+const maxCachedFontNames = 4096
+
+// fontExtensions lists the file extensions of fonts that subtitle renderers can load.
+var fontExtensions = map[string]bool{".ttf": true, ".otf": true, ".ttc": true, ".otc": true}
+
+// fontSource identifies a font: an attachment of a Matroska file (uid > 0)
+// or a file of the fonts directory.
+type fontSource struct {
+	file fileKey
+	uid  uint64
+}
+
+// fontEntry describes a font available to the subtitles of a media item.
+type fontEntry struct {
+	Name     string   `json:"name"`
+	Families []string `json:"families"`
+	Source   string   `json:"source"` // "attachment" or "directory"
+	UID      uint64   `json:"uid,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Size     int64    `json:"size"`
+	URL      string   `json:"url"`
+}
+
+// subsetCacheKey identifies a font subset to a set of characters.
+type subsetCacheKey struct {
+	font  fontSource
+	runes string // hash of the characters kept
+}
+
+// fontNameCache holds the family names of fonts, which requires reading their name table.
+var fontNameCache = newLRUCache[fontSource, []string](maxCachedFontNames, func([]string) int64 { return 1 })
+
+var (
+	fontSubsetCache     *lruCache[subsetCacheKey, []byte]
+	fontSubsetCacheOnce sync.Once
+)
+
+// getFontSubsetCache returns the cache of subset fonts, sized from the config on first use.
+func getFontSubsetCache() *lruCache[subsetCacheKey, []byte] {
+	fontSubsetCacheOnce.Do(func() {
+		fontSubsetCache = newLRUCache[subsetCacheKey, []byte](config.GetConfig().FontCacheSize, func(data []byte) int64 {
+			return int64(len(data))
+		})
+	})
+	return fontSubsetCache
+}
+
+// Fonts lists the fonts the ASS subtitles of a media item need: the font
+// attachments of a Matroska file and the fonts of the configured fonts
+// directory whose family is referenced by an embedded or sidecar ASS script.
+// Each entry carries a URL, signed like the request, that serves the font.
+func Fonts(c *gin.Context) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	media, err := openMediaFonts(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		logger.Error("Failed to read media fonts", "filePath", filePath, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read fonts"})
+		return
+	}
+	defer media.close()
+
+	entries := media.attachmentFonts()
+	entries = append(entries, directoryFonts(media.usage.Families())...)
+
+	covered := make(map[string]bool)
+	query := signedQuery(c)
+	for i := range entries {
+		entry := &entries[i]
+		for _, family := range entry.Families {
+			covered[strings.ToLower(family)] = true
+		}
+		if entry.Source == "attachment" {
+			query.Set("uid", strconv.FormatUint(entry.UID, 10))
+			query.Del("file")
+		} else {
+			query.Set("file", entry.File)
+			query.Del("uid")
+		}
+		entry.URL = "/fonts/file?" + query.Encode()
+	}
+
+	missing := []string{}
+	for _, family := range media.usage.Families() {
+		if !covered[family] {
+			missing = append(missing, family)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fonts":      entries,
+		"referenced": media.usage.Families(),
+		"missing":    missing,
+	})
+}
+
+// FontFile serves one font listed by Fonts, selected by the uid of a Matroska
+// attachment or the file name within the fonts directory. When subsetting is
+// enabled (Fonts.subset, overridable with the subset query parameter), glyphs
+// the media's subtitles never draw are stripped.
+func FontFile(c *gin.Context) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	media, err := openMediaFonts(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		logger.Error("Failed to read media fonts", "filePath", filePath, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read fonts"})
+		return
+	}
+	defer media.close()
+
+	var (
+		source fontSource
+		name   string
+		reader *io.SectionReader
+	)
+	switch {
+	case c.Query("uid") != "":
+		uid, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+		if err != nil || media.mkv == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Font not found"})
+			return
+		}
+		attachment, ok := media.mkv.attachment(uid)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Font not found"})
+			return
+		}
+		source = fontSource{file: media.key, uid: uid}
+		name = attachment.Name
+		reader = io.NewSectionReader(media.file, attachment.dataOffset, attachment.Size)
+	case c.Query("file") != "":
+		fontPath, ok := resolveFontPath(c.Query("file"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Font not found"})
+			return
+		}
+		fontFile, err := storage.Open(fontPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Font not found"})
+			return
+		}
+		defer fontFile.Close()
+		fontInfo, err := fontFile.Stat()
+		if err != nil || fontInfo.IsDir() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Font not found"})
+			return
+		}
+		source = fontSource{file: newFileKey(fontPath, fontInfo)}
+		name = filepath.Base(fontPath)
+		reader = io.NewSectionReader(fontFile, 0, fontInfo.Size())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing uid or file"})
+		return
+	}
+
+	contentType, ok := GetMimeRegistry().Lookup(filepath.Ext(name))
+	if !ok {
+		contentType = defaultContentType
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	c.Header("Cache-Control", "private, max-age=86400")
+
+	subset := config.GetConfig().FontSubset
+	if value := c.Query("subset"); value != "" {
+		subset, _ = strconv.ParseBool(value)
+	}
+	if subset && reader.Size() <= maxFontSize {
+		if data, etag, ok := subsetFont(source, reader, media.usage); ok {
+			c.Header("ETag", etag)
+			if c.GetHeader("If-None-Match") == etag {
+				c.Status(http.StatusNotModified)
+				return
+			}
+			c.Data(http.StatusOK, contentType, data)
+			return
+		}
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("ETag", source.etag())
+	http.ServeContent(c.Writer, c.Request, name, time.Unix(0, source.file.modTime), reader)
+}
+
+// etag returns the entity tag of the whole font.
+func (s fontSource) etag() string {
+	return fmt.Sprintf(`"%x-%x-%x"`, s.file.modTime, s.file.size, s.uid)
+}
+
+// subsetFont returns the font subset to the characters its families draw in
+// usage, with its entity tag. It returns false when the font cannot be
+// subset, in which case the whole font should be served.
+func subsetFont(source fontSource, reader *io.SectionReader, usage subtitle.FontUsage) ([]byte, string, bool) {
+	families, err := fontFamilies(source, reader)
+	if err != nil {
+		return nil, "", false
+	}
+	runes := append(usage.Runes(families), ' ', '\u00A0')
+
+	hash := sha1.New()
+	for _, r := range runes {
+		binary.Write(hash, binary.BigEndian, int32(r))
+	}
+	key := subsetCacheKey{font: source, runes: string(hash.Sum(nil))}
+	etag := fmt.Sprintf(`"%x-%x-%x-%x"`, source.file.modTime, source.file.size, source.uid, hash.Sum(nil)[:8])
+
+	cache := getFontSubsetCache()
+	if data, ok := cache.Get(key); ok {
+		return data, etag, true
+	}
+
+	data := make([]byte, reader.Size())
+	if _, err := reader.ReadAt(data, 0); err != nil {
+		logger.Error("Failed to read font", "font", source.file.path, "uid", source.uid, "error", err)
+		return nil, "", false
+	}
+	startTime := time.Now()
+	subset, err := fonts.Subset(data, runes)
+	if err != nil {
+		logger.Debug("Serving font without subsetting", "font", source.file.path, "uid", source.uid, "reason", err)
+		return nil, "", false
+	}
+	logger.Info("Font subset", "font", source.file.path, "uid", source.uid, "characters", len(runes), "from", len(data), "to", len(subset), "elapsed", time.Since(startTime))
+	cache.Add(key, subset)
+	return subset, etag, true
+}
+
+// fontFamilies returns the cached family names of the font read from r.
+func fontFamilies(source fontSource, r io.ReaderAt) ([]string, error) {
+	if families, ok := fontNameCache.Get(source); ok {
+		return families, nil
+	}
+	families, err := fonts.Families(r)
+	if err != nil {
+		return nil, err
+	}
+	fontNameCache.Add(source, families)
+	return families, nil
+}
+
+// isFontAttachment reports whether a Matroska attachment is a font.
+func isFontAttachment(attachment mkvAttachment) bool {
+	if fontExtensions[strings.ToLower(filepath.Ext(attachment.Name))] {
+		return true
+	}
+	mediaType := strings.ToLower(attachment.MediaType)
+	return strings.HasPrefix(mediaType, "font/") || strings.Contains(mediaType, "truetype") ||
+		strings.Contains(mediaType, "opentype") || strings.Contains(mediaType, "sfnt")
+}
+
+// resolveFontPath maps a file name relative to the fonts directory to its
+// path, refusing names that would escape the directory.
+func resolveFontPath(name string) (string, bool) {
+	dir := config.GetConfig().FontsDirectory
+	if dir == "" || !fontExtensions[strings.ToLower(filepath.Ext(name))] {
+		return "", false
+	}
+	return filepath.Join(dir, filepath.Clean("/"+name)), true
+}
+
+// directoryFonts lists the fonts of the fonts directory providing any of
+// the given lower-cased families.
+func directoryFonts(families []string) []fontEntry {
+	dir := config.GetConfig().FontsDirectory
+	if dir == "" || len(families) == 0 {
+		return nil
+	}
+	wanted := make(map[string]bool, len(families))
+	for _, family := range families {
+		wanted[family] = true
+	}
+
+	var entries []fontEntry
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !fontExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		source := fontSource{file: newFileKey(path, info)}
+		file, err := storage.Open(path)
+		if err != nil {
+			return nil
+		}
+		names, err := fontFamilies(source, file)
+		file.Close()
+		if err != nil {
+			logger.Debug("Skipping unreadable font", "font", path, "error", err)
+			return nil
+		}
+
+		for _, name := range names {
+			if wanted[strings.ToLower(name)] {
+				rel, _ := filepath.Rel(dir, path)
+				entries = append(entries, fontEntry{
+					Name:     filepath.Base(path),
+					Families: names,
+					Source:   "directory",
+					File:     filepath.ToSlash(rel),
+					Size:     info.Size(),
+				})
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to scan fonts directory", "directory", dir, "error", err)
+	}
+	return entries
+}
+
+// mediaFonts is an opened media item with the font usage of its ASS subtitles.
+type mediaFonts struct {
+	file  storage.File
+	key   fileKey
+	mkv   *mkvFile // nil when the media is not a Matroska file
+	usage subtitle.FontUsage
+}
+
+// openMediaFonts opens the media at filePath and collects the fonts used by
+// its embedded ASS tracks and by sidecar ASS/SSA files sharing its name.
+func openMediaFonts(filePath string) (*mediaFonts, error) {
+	media := &mediaFonts{usage: subtitle.FontUsage{}}
+	file, m, key, err := openMatroska(filePath)
+	switch {
+	case err == nil:
+		media.file, media.mkv, media.key = file, m, key
+		for _, track := range m.Tracks {
+			if !track.isASS() {
+				continue
+			}
+			data, err := m.extractSubtitleCached(file, key, track, "ass")
+			if err != nil {
+				logger.Warn("Failed to extract ASS track for fonts", "filePath", filePath, "track", track.Number, "error", err)
+				continue
+			}
+			media.usage.Merge(parseASSFonts(data))
+		}
+	case errors.Is(err, os.ErrNotExist):
+		return nil, err
+	default:
+		// Not a readable Matroska file: only sidecar subtitles can reference fonts.
+		logger.Debug("No embedded fonts", "filePath", filePath, "reason", err)
+	}
+
+	for _, sidecar := range sidecarASSFiles(filePath) {
+		data, err := os.ReadFile(sidecar)
+		if err != nil {
+			continue
+		}
+		media.usage.Merge(parseASSFonts(data))
+	}
+	return media, nil
+}
+
+// parseASSFonts decodes an ASS/SSA script in any supported charset and collects its font usage.
+func parseASSFonts(data []byte) subtitle.FontUsage {
+	text, _, err := subtitle.DecodeText(data)
+	if err != nil {
+		return subtitle.FontUsage{}
+	}
+	return subtitle.ParseASSFonts(text)
+}
+
+// close releases the media file.
+func (m *mediaFonts) close() {
+	if m.file != nil {
+		m.file.Close()
+	}
+}
+
+// attachmentFonts lists the font attachments of a Matroska media item.
+func (m *mediaFonts) attachmentFonts() []fontEntry {
+	entries := []fontEntry{}
+	if m.mkv == nil {
+		return entries
+	}
+	for _, attachment := range m.mkv.Attachments {
+		if !isFontAttachment(attachment) {
+			continue
+		}
+		source := fontSource{file: m.key, uid: attachment.UID}
+		families, err := fontFamilies(source, io.NewSectionReader(m.file, attachment.dataOffset, attachment.Size))
+		if err != nil {
+			logger.Debug("Skipping unreadable font attachment", "name", attachment.Name, "error", err)
+			continue
+		}
+		entries = append(entries, fontEntry{
+			Name:     attachment.Name,
+			Families: families,
+			Source:   "attachment",
+			UID:      attachment.UID,
+			Size:     attachment.Size,
+		})
+	}
+	return entries
+}
+
+// sidecarASSFiles returns the ASS/SSA files next to the media whose names
+// start with the media's base name, such as "Movie.zh.ass" for "Movie.mkv".
+func sidecarASSFiles(filePath string) []string {
+	dir := filepath.Dir(filePath)
+	base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var sidecars []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".ass" && ext != ".ssa") || !strings.HasPrefix(entry.Name(), base) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.Size() <= maxSubtitleSize {
+			sidecars = append(sidecars, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(sidecars)
+	return sidecars
+}
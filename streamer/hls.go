@@ -0,0 +1,411 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/mp4"
+	"PiliPili_Backend/storage"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCachedHLSSources bounds the number of indexed media files kept in memory.
+const maxCachedHLSSources = 32
+
+// HLS content types.
+const (
+	playlistContentType = "application/vnd.apple.mpegurl"
+	videoSegmentType    = "video/mp4"
+	audioSegmentType    = "audio/mp4"
+)
+
+var (
+	errUnsupportedContainer = errors.New("unsupported container")
+	errNoIndex              = errors.New("file has no keyframe index")
+	errNoPlayableTracks     = errors.New("file has no playable video or audio track")
+)
+
+// hlsTrack is a track of the source that is packaged as an HLS rendition.
+type hlsTrack struct {
+	id          uint32 // MP4 track ID or Matroska track number
+	handler     string // "vide" or "soun"
+	name        string
+	language    string
+	isDefault   bool
+	timescale   uint32
+	width       uint32
+	height      uint32
+	sampleEntry []byte
+	codec       string
+}
+
+// hlsSegment is the presentation interval of one media segment, shared by all tracks.
+type hlsSegment struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// hlsSample is one sample of a media segment, timed in its track timescale.
+type hlsSample struct {
+	data     []byte
+	dts      int64 // decode time, not negative
+	cts      int32
+	duration uint32
+	sync     bool
+}
+
+// hlsSource is an indexed media file that can be remuxed into segments.
+type hlsSource interface {
+	tracks() []*hlsTrack
+	segments() []hlsSegment
+	duration() time.Duration
+	readSegment(r io.ReaderAt, track *hlsTrack, index int) ([]hlsSample, error)
+}
+
+// hlsSourceCache holds indexed media files keyed by file version.
+var hlsSourceCache = newLRUCache[fileKey, hlsSource](maxCachedHLSSources, func(hlsSource) int64 { return 1 })
+
+// openHLSSource opens the MP4 or Matroska file at filePath and returns it
+// with its index, which is cached per file version.
+func openHLSSource(filePath string) (storage.File, hlsSource, fileKey, error) {
+	file, err := storage.Open(filePath)
+	if err != nil {
+		return nil, nil, fileKey{}, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fileKey{}, err
+	}
+	key := newFileKey(filePath, fileInfo)
+	if source, ok := hlsSourceCache.Get(key); ok {
+		return file, source, key, nil
+	}
+
+	startTime := time.Now()
+	source, err := newHLSSource(file, key)
+	if err != nil {
+		file.Close()
+		return nil, nil, fileKey{}, err
+	}
+	logger.Info("Media indexed for HLS", "filePath", filePath, "tracks", len(source.tracks()), "segments", len(source.segments()), "elapsed", time.Since(startTime))
+	hlsSourceCache.Add(key, source)
+	return file, source, key, nil
+}
+
+// newHLSSource indexes a file according to its container.
+func newHLSSource(file storage.File, key fileKey) (hlsSource, error) {
+	header := readHeader(file)
+	switch {
+	case len(header) >= 4 && string(header[:4]) == "\x1A\x45\xDF\xA3":
+		m, err := loadMatroska(file, key)
+		if err != nil {
+			return nil, err
+		}
+		return newMkvHLSSource(file, m)
+	case len(header) >= 8 && isMP4Brand(string(header[4:8])):
+		movie, err := mp4.ReadMovie(file, key.size)
+		if err != nil {
+			return nil, err
+		}
+		return newMP4HLSSource(movie)
+	}
+	return nil, errUnsupportedContainer
+}
+
+// isMP4Brand reports whether a top-level box type starts an MP4 or QuickTime file.
+func isMP4Brand(boxType string) bool {
+	switch boxType {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide":
+		return true
+	}
+	return false
+}
+
+// planSegments groups keyframes into segments of at least target length.
+// It returns the indexes of the keyframes starting each segment; the first
+// segment always starts at the first keyframe.
+func planSegments(keyTimes []time.Duration, target time.Duration) []int {
+	if len(keyTimes) == 0 {
+		return nil
+	}
+	starts := []int{0}
+	for i := 1; i < len(keyTimes); i++ {
+		if keyTimes[i]-keyTimes[starts[len(starts)-1]] >= target {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// hlsSegmentDuration returns the configured target segment duration.
+func hlsSegmentDuration() time.Duration {
+	if d := config.GetConfig().HLSSegmentDuration; d > 0 {
+		return d
+	}
+	return 6 * time.Second
+}
+
+// toTimescale converts d to units of timescale, rounding to the nearest unit.
+func toTimescale(d time.Duration, timescale uint32) int64 {
+	return int64(math.Round(float64(d) * float64(timescale) / float64(time.Second)))
+}
+
+// openHLSForRequest authenticates c and opens the requested media. When it
+// returns false the error response has already been written.
+func openHLSForRequest(c *gin.Context) (storage.File, hlsSource, fileKey, bool) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return nil, nil, fileKey{}, false
+	}
+
+	file, source, key, err := openHLSSource(filePath)
+	switch {
+	case err == nil:
+		return file, source, key, true
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, errUnsupportedContainer), errors.Is(err, errNotMatroska), errors.Is(err, mp4.ErrNoMovie):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported container"})
+	default:
+		logger.Error("Failed to index media for HLS", "filePath", filePath, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot package media as HLS: " + err.Error()})
+	}
+	return nil, nil, fileKey{}, false
+}
+
+// requestedTrack returns the track selected by the track query parameter.
+func requestedTrack(c *gin.Context, source hlsSource) (*hlsTrack, bool) {
+	id, err := strconv.ParseUint(c.Query("track"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid track"})
+		return nil, false
+	}
+	for _, track := range source.tracks() {
+		if track.id == uint32(id) {
+			return track, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Track not found"})
+	return nil, false
+}
+
+// HLSMaster serves the HLS master playlist of a media file: audio tracks are
+// alternative renditions grouped by codec, with one video variant per group.
+// Segments are remuxed on the fly without transcoding.
+func HLSMaster(c *gin.Context) {
+	file, source, key, ok := openHLSForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	var video *hlsTrack
+	var audios []*hlsTrack
+	for _, track := range source.tracks() {
+		switch {
+		case track.handler == "vide" && video == nil:
+			video = track
+		case track.handler == "soun":
+			audios = append(audios, track)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	bandwidth := int64(float64(key.size*8) / math.Max(source.duration().Seconds(), 1))
+
+	if video == nil {
+		// Audio only: one variant per audio track.
+		for _, audio := range audios {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=%q\n", bandwidth, audio.codec)
+			b.WriteString(hlsURL(c, "playlist.m3u8", audio.id, -1) + "\n")
+		}
+	} else {
+		// Audio renditions are grouped by codec, with one variant per group,
+		// so that clients lacking a codec can still pick another variant.
+		var groups []string
+		renditions := make(map[string][]*hlsTrack)
+		for _, audio := range audios {
+			if _, ok := renditions[audio.codec]; !ok {
+				groups = append(groups, audio.codec)
+			}
+			renditions[audio.codec] = append(renditions[audio.codec], audio)
+		}
+		for _, codec := range groups {
+			defaultAudio := renditions[codec][0]
+			for _, audio := range renditions[codec] {
+				if audio.isDefault && !defaultAudio.isDefault {
+					defaultAudio = audio
+				}
+			}
+			for _, audio := range renditions[codec] {
+				fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio-%s\",NAME=%q,", codec, audio.name)
+				if audio.language != "" {
+					fmt.Fprintf(&b, "LANGUAGE=%q,", audio.language)
+				}
+				fmt.Fprintf(&b, "DEFAULT=%s,AUTOSELECT=YES,URI=%q\n", yesNo(audio == defaultAudio), hlsURL(c, "playlist.m3u8", audio.id, -1))
+			}
+		}
+
+		variant := func(codecs, group string) {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=%q", bandwidth, codecs)
+			if video.width > 0 && video.height > 0 {
+				fmt.Fprintf(&b, ",RESOLUTION=%dx%d", video.width, video.height)
+			}
+			if group != "" {
+				fmt.Fprintf(&b, ",AUDIO=\"audio-%s\"", group)
+			}
+			b.WriteString("\n" + hlsURL(c, "playlist.m3u8", video.id, -1) + "\n")
+		}
+		if len(groups) == 0 {
+			variant(video.codec, "")
+		}
+		for _, codec := range groups {
+			variant(video.codec+","+codec, codec)
+		}
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, playlistContentType, []byte(b.String()))
+}
+
+// HLSPlaylist serves the media playlist of one track.
+func HLSPlaylist(c *gin.Context) {
+	file, source, _, ok := openHLSForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	track, ok := requestedTrack(c, source)
+	if !ok {
+		return
+	}
+
+	segments := source.segments()
+	target := 1.0
+	for _, segment := range segments {
+		target = math.Max(target, math.Ceil((segment.end - segment.start).Seconds()))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n", int(target))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", hlsURL(c, "init.mp4", track.id, -1))
+	for i, segment := range segments {
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n%s\n", (segment.end - segment.start).Seconds(), hlsURL(c, "segment.m4s", track.id, i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, playlistContentType, []byte(b.String()))
+}
+
+// HLSInit serves the fragmented MP4 initialization segment of one track.
+func HLSInit(c *gin.Context) {
+	file, source, _, ok := openHLSForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	track, ok := requestedTrack(c, source)
+	if !ok {
+		return
+	}
+
+	data := mp4.WriteInit(mp4.InitTrack{
+		ID:          track.id,
+		Handler:     track.handler,
+		Timescale:   track.timescale,
+		Language:    track.language,
+		Width:       track.width,
+		Height:      track.height,
+		SampleEntry: track.sampleEntry,
+	})
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, segmentContentType(track), data)
+}
+
+// HLSSegment remuxes one media segment of one track, reading its samples
+// from the source file with ranged reads.
+func HLSSegment(c *gin.Context) {
+	file, source, key, ok := openHLSForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	track, ok := requestedTrack(c, source)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(c.Query("seq"))
+	if err != nil || index < 0 || index >= len(source.segments()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+
+	startTime := time.Now()
+	ctx := c.Request.Context()
+	samples, err := source.readSegment(storage.WithContext(ctx, file), track, index)
+	if err != nil && ctx.Err() != nil {
+		logger.Info("Client connection lost", "filePath", key.path, "track", track.id, "segment", index)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read HLS segment", "filePath", key.path, "track", track.id, "segment", index, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read segment"})
+		return
+	}
+
+	var baseDTS uint64
+	fragment := make([]mp4.FragmentSample, len(samples))
+	for i, sample := range samples {
+		fragment[i] = mp4.FragmentSample{Data: sample.data, Duration: sample.duration, CTS: sample.cts, Sync: sample.sync}
+	}
+	if len(samples) > 0 {
+		// Sources time their samples so that decode times are not negative;
+		// rounding between timescales may still leave a sample a unit early.
+		baseDTS = uint64(max(samples[0].dts, 0))
+	}
+	data := mp4.WriteFragment(uint32(index+1), track.id, baseDTS, fragment)
+	logger.Debug("HLS segment remuxed", "filePath", key.path, "track", track.id, "segment", index, "samples", len(samples), "bytes", len(data), "elapsed", time.Since(startTime))
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, segmentContentType(track), data)
+}
+
+// segmentContentType returns the content type of the segments of track.
+func segmentContentType(track *hlsTrack) string {
+	if track.handler == "soun" {
+		return audioSegmentType
+	}
+	return videoSegmentType
+}
+
+// hlsURL returns the URL, relative to the playlist, of an HLS resource of
+// track. The path and signature of the request are carried over; seq < 0
+// omits the segment number.
+func hlsURL(c *gin.Context, name string, track uint32, seq int) string {
+	query := signedQuery(c)
+	query.Set("track", strconv.FormatUint(uint64(track), 10))
+	if seq >= 0 {
+		query.Set("seq", strconv.Itoa(seq))
+	}
+	return name + "?" + query.Encode()
+}
+
+// yesNo formats a boolean HLS attribute.
+func yesNo(value bool) string {
+	if value {
+		return "YES"
+	}
+	return "NO"
+}
@@ -0,0 +1,444 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/mp4"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mkvVideoTimescale is the timescale of remuxed Matroska video tracks.
+const mkvVideoTimescale = 90000
+
+// mkvAudioScanMargin is how far past the end of a segment audio blocks are
+// looked for, since muxers interleave them loosely with the video.
+const mkvAudioScanMargin = 2 * time.Second
+
+// mkvHLSSource remuxes the video and audio tracks of a Matroska file.
+// Segments start at the video keyframes indexed by the Cues, and only the
+// clusters of a segment are read to build it.
+type mkvHLSSource struct {
+	m            *mkvFile
+	hlsTracks    []*hlsTrack
+	sources      map[uint32]*mkvTrack
+	frameSamples map[uint32]uint32 // audio samples per frame
+	segs         []hlsSegment
+	starts       []int64 // segment start timestamps in TimestampScale units
+	clusters     []int64 // offset of the cluster to start reading each segment from
+}
+
+// newMkvHLSSource indexes a parsed Matroska file for HLS packaging.
+func newMkvHLSSource(r io.ReaderAt, m *mkvFile) (*mkvHLSSource, error) {
+	s := &mkvHLSSource{
+		m:            m,
+		sources:      make(map[uint32]*mkvTrack),
+		frameSamples: make(map[uint32]uint32),
+	}
+
+	var video *mkvTrack
+	for _, track := range m.Tracks {
+		if track.Type == "video" && video != nil {
+			continue
+		}
+		t, frameSamples, err := s.newTrack(r, track)
+		if err != nil {
+			logger.Debug("Track not packaged as HLS", "track", track.Number, "codec", track.CodecID, "reason", err)
+			continue
+		}
+		if t == nil {
+			continue
+		}
+		if track.Type == "video" {
+			video = track
+		}
+		s.hlsTracks = append(s.hlsTracks, t)
+		s.sources[t.id] = track
+		s.frameSamples[t.id] = frameSamples
+	}
+	if len(s.hlsTracks) == 0 {
+		return nil, errNoPlayableTracks
+	}
+
+	// Keyframes come from the Cues of the video track, or of any track for audio-only files.
+	type keyframe struct {
+		time    uint64
+		cluster int64
+	}
+	var keyframes []keyframe
+	for _, cue := range m.cues {
+		for _, position := range cue.positions {
+			if video == nil || position.track == video.Number {
+				keyframes = append(keyframes, keyframe{cue.time, m.segmentOffset + position.clusterPosition})
+				break
+			}
+		}
+	}
+	if len(keyframes) == 0 {
+		return nil, errNoIndex
+	}
+	sort.SliceStable(keyframes, func(i, j int) bool { return keyframes[i].time < keyframes[j].time })
+
+	keyTimes := make([]time.Duration, len(keyframes))
+	for i, k := range keyframes {
+		keyTimes[i] = m.timestampToDuration(int64(k.time))
+	}
+	total := m.Duration
+	if last := keyTimes[len(keyTimes)-1]; total <= last {
+		total = last + hlsSegmentDuration()
+	}
+
+	starts := planSegments(keyTimes, hlsSegmentDuration())
+	for i, start := range starts {
+		segment := hlsSegment{start: keyTimes[start], end: total}
+		cluster := keyframes[start].cluster
+		if i == 0 {
+			segment.start = 0
+			cluster = m.firstCluster
+		}
+		if i+1 < len(starts) {
+			segment.end = keyTimes[starts[i+1]]
+		}
+		s.segs = append(s.segs, segment)
+		s.starts = append(s.starts, int64(keyframes[start].time))
+		s.clusters = append(s.clusters, cluster)
+	}
+	return s, nil
+}
+
+// newTrack describes a Matroska track as an HLS rendition and returns the
+// number of audio samples per frame. It returns nil for track types that are
+// not packaged, and an error for unsupported codecs.
+func (s *mkvHLSSource) newTrack(r io.ReaderAt, track *mkvTrack) (*hlsTrack, uint32, error) {
+	t := &hlsTrack{
+		id:        uint32(track.Number),
+		name:      track.Name,
+		language:  track.Language,
+		isDefault: track.Default,
+	}
+	if t.language == "und" {
+		t.language = ""
+	}
+
+	switch track.Type {
+	case "video":
+		config, err := track.decodedCodecPrivate()
+		if err != nil || len(config) == 0 {
+			return nil, 0, errors.New("missing decoder configuration")
+		}
+		t.handler, t.timescale = "vide", mkvVideoTimescale
+		t.width, t.height = uint32(track.Width), uint32(track.Height)
+		switch track.CodecID {
+		case "V_MPEG4/ISO/AVC":
+			t.sampleEntry = mp4.VideoSampleEntry("avc1", uint16(track.Width), uint16(track.Height), "avcC", config)
+		case "V_MPEGH/ISO/HEVC":
+			t.sampleEntry = mp4.VideoSampleEntry("hvc1", uint16(track.Width), uint16(track.Height), "hvcC", config)
+		default:
+			return nil, 0, fmt.Errorf("unsupported video codec %s", track.CodecID)
+		}
+		if t.name == "" {
+			t.name = "Video"
+		}
+		t.codec = mp4.CodecString(t.sampleEntry)
+		return t, 0, nil
+
+	case "audio":
+		t.handler = "soun"
+		t.timescale = uint32(math.Round(track.SampleRate))
+		channels := uint16(track.Channels)
+		if channels == 0 {
+			channels = 2
+		}
+		if t.timescale == 0 {
+			return nil, 0, errors.New("missing sample rate")
+		}
+		if t.name == "" {
+			t.name = fmt.Sprintf("Audio %d", track.Number)
+			if t.language != "" {
+				t.name = fmt.Sprintf("%s (%s)", t.name, t.language)
+			}
+		}
+
+		var frameSamples uint32
+		switch {
+		case strings.HasPrefix(track.CodecID, "A_AAC"):
+			config, err := track.decodedCodecPrivate()
+			if err != nil || len(config) < 2 {
+				config = aacAudioSpecificConfig(track.CodecID, t.timescale, channels)
+			}
+			t.sampleEntry = mp4.AudioSampleEntry("mp4a", channels, t.timescale, mp4.ESDSBox(config))
+			frameSamples = 1024
+		case track.CodecID == "A_AC3" || track.CodecID == "A_EAC3":
+			frame, err := s.firstFrame(r, track)
+			if err != nil {
+				return nil, 0, err
+			}
+			var config []byte
+			if track.CodecID == "A_AC3" {
+				config, err = ac3SpecificBox(frame)
+				frameSamples = 1536
+				t.sampleEntry = mp4.AudioSampleEntry("ac-3", channels, t.timescale, config)
+			} else {
+				config, frameSamples, err = eac3SpecificBox(frame)
+				t.sampleEntry = mp4.AudioSampleEntry("ec-3", channels, t.timescale, config)
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+		default:
+			return nil, 0, fmt.Errorf("unsupported audio codec %s", track.CodecID)
+		}
+		t.codec = mp4.CodecString(t.sampleEntry)
+		return t, frameSamples, nil
+	}
+	return nil, 0, nil
+}
+
+// firstFrame returns the first frame of track.
+func (s *mkvHLSSource) firstFrame(r io.ReaderAt, track *mkvTrack) ([]byte, error) {
+	var frame []byte
+	var frameErr error
+	err := s.m.scanClusters(r, 0, map[uint64]bool{track.Number: true}, func(block mkvBlock) bool {
+		frames, err := block.frames()
+		if err != nil || len(frames) == 0 {
+			frameErr = err
+			return false
+		}
+		frame, frameErr = track.decodeFrame(frames[0])
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if frameErr != nil {
+		return nil, frameErr
+	}
+	if frame == nil {
+		return nil, errors.New("track has no frames")
+	}
+	return frame, nil
+}
+
+func (s *mkvHLSSource) tracks() []*hlsTrack     { return s.hlsTracks }
+func (s *mkvHLSSource) segments() []hlsSegment  { return s.segs }
+func (s *mkvHLSSource) duration() time.Duration { return s.segs[len(s.segs)-1].end }
+
+// readSegment reads the frames of track in segment index. Video frames are
+// taken in decode order from the segment's keyframe up to the next segment's
+// keyframe; audio frames by timestamp.
+func (s *mkvHLSSource) readSegment(r io.ReaderAt, track *hlsTrack, index int) ([]hlsSample, error) {
+	source := s.sources[track.id]
+	last := index == len(s.segs)-1
+	from, to := s.starts[index], int64(math.MaxInt64)
+	if !last {
+		to = s.starts[index+1]
+	}
+	video := track.handler == "vide"
+	frameDuration := int64(0)
+	if samples := s.frameSamples[track.id]; samples > 0 {
+		frameDuration = int64(time.Duration(samples) * time.Second / time.Duration(track.timescale) / time.Duration(s.m.TimestampScale))
+	}
+	margin := int64(mkvAudioScanMargin) / int64(s.m.TimestampScale)
+
+	type frame struct {
+		timestamp int64
+		data      []byte
+		keyframe  bool
+	}
+	var frames []frame
+	started := index == 0
+	var frameErr error
+	err := s.m.scanClusters(r, s.clusters[index], map[uint64]bool{source.Number: true}, func(block mkvBlock) bool {
+		if video {
+			if block.keyframe && block.timestamp >= to {
+				return false
+			}
+			if !started {
+				if !block.keyframe || block.timestamp < from {
+					return true
+				}
+				started = true
+			}
+		} else if !last && block.timestamp >= to+margin {
+			return false
+		}
+
+		laced, err := block.frames()
+		if err != nil {
+			frameErr = err
+			return false
+		}
+		for k, data := range laced {
+			timestamp := block.timestamp + int64(k)*frameDuration
+			if !video && ((index > 0 && timestamp < from) || timestamp >= to) {
+				continue
+			}
+			decoded, err := source.decodeFrame(data)
+			if err != nil {
+				frameErr = err
+				return false
+			}
+			frames = append(frames, frame{timestamp: timestamp, data: decoded, keyframe: block.keyframe})
+		}
+		return true
+	})
+	if err == nil {
+		err = frameErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, nil
+	}
+
+	samples := make([]hlsSample, len(frames))
+	toTrack := func(timestamp int64) int64 {
+		return toTimescale(s.m.timestampToDuration(timestamp), track.timescale)
+	}
+	if !video {
+		// Audio frames have a fixed number of samples, so their decode times
+		// follow from the first one without accumulating rounding errors.
+		first := toTrack(frames[0].timestamp)
+		for i, f := range frames {
+			samples[i] = hlsSample{data: f.data, dts: first + int64(i)*int64(s.frameSamples[track.id]), duration: s.frameSamples[track.id], sync: true}
+		}
+		return samples, nil
+	}
+
+	// Matroska stores presentation timestamps; decode timestamps are the
+	// same values in ascending order, assigned in decode order.
+	pts := make([]int64, len(frames))
+	for i, f := range frames {
+		pts[i] = toTrack(f.timestamp)
+	}
+	dts := append([]int64(nil), pts...)
+	sort.Slice(dts, func(i, j int) bool { return dts[i] < dts[j] })
+	for i, f := range frames {
+		samples[i] = hlsSample{data: f.data, dts: dts[i], cts: int32(pts[i] - dts[i]), sync: f.keyframe}
+		if i > 0 {
+			samples[i-1].duration = uint32(dts[i] - dts[i-1])
+		}
+	}
+	lastSample := &samples[len(samples)-1]
+	switch end := toTimescale(s.segs[index].end, track.timescale); {
+	case !last && end > lastSample.dts:
+		lastSample.duration = uint32(end - lastSample.dts)
+	case source.defaultDuration > 0:
+		lastSample.duration = uint32(toTimescale(time.Duration(source.defaultDuration), track.timescale))
+	case len(samples) > 1:
+		lastSample.duration = samples[len(samples)-2].duration
+	}
+	return samples, nil
+}
+
+// aacSampleRates lists the sampling frequencies indexed by AudioSpecificConfig.
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacAudioSpecificConfig builds the AudioSpecificConfig of an AAC track that
+// has no codec private data, from its legacy codec ID.
+func aacAudioSpecificConfig(codecID string, sampleRate uint32, channels uint16) []byte {
+	objectType := uint16(2) // LC
+	switch {
+	case strings.HasSuffix(codecID, "/MAIN"):
+		objectType = 1
+	case strings.HasSuffix(codecID, "/SSR"):
+		objectType = 3
+	case strings.HasSuffix(codecID, "/LTP"):
+		objectType = 4
+	}
+	index := uint16(15)
+	for i, rate := range aacSampleRates {
+		if rate == sampleRate {
+			index = uint16(i)
+		}
+	}
+	config := objectType<<11 | index<<7 | channels<<3
+	return []byte{byte(config >> 8), byte(config)}
+}
+
+// ac3SampleRates lists the sampling frequencies indexed by fscod.
+var ac3SampleRates = []uint32{48000, 44100, 32000}
+
+// ac3SpecificBox builds the dac3 box of an AC-3 track from its first frame.
+func ac3SpecificBox(frame []byte) ([]byte, error) {
+	if len(frame) < 8 || frame[0] != 0x0B || frame[1] != 0x77 {
+		return nil, errors.New("invalid AC-3 frame")
+	}
+	b := bitReader{data: frame[4:]}
+	fscod := b.read(2)
+	frmsizecod := b.read(6)
+	bsid := b.read(5)
+	bsmod := b.read(3)
+	acmod := b.read(3)
+	if acmod&1 != 0 && acmod != 1 {
+		b.read(2) // cmixlev
+	}
+	if acmod&4 != 0 {
+		b.read(2) // surmixlev
+	}
+	if acmod == 2 {
+		b.read(2) // dsurmod
+	}
+	lfeon := b.read(1)
+
+	config := fscod<<22 | bsid<<17 | bsmod<<14 | acmod<<11 | lfeon<<10 | (frmsizecod>>1)<<5
+	return mp4.ConfigBox("dac3", []byte{byte(config >> 16), byte(config >> 8), byte(config)}), nil
+}
+
+// eac3SpecificBox builds the dec3 box of an E-AC-3 track from its first
+// frame, and returns the number of samples per frame. Only the first
+// independent substream is described.
+func eac3SpecificBox(frame []byte) ([]byte, uint32, error) {
+	if len(frame) < 6 || frame[0] != 0x0B || frame[1] != 0x77 {
+		return nil, 0, errors.New("invalid E-AC-3 frame")
+	}
+	b := bitReader{data: frame[2:]}
+	b.read(2) // strmtyp
+	b.read(3) // substreamid
+	frameSize := (b.read(11) + 1) * 2
+	fscod := b.read(2)
+	var sampleRate, blocks uint32
+	if fscod == 3 {
+		fscod2 := b.read(2)
+		if fscod2 == 3 {
+			return nil, 0, errors.New("invalid E-AC-3 sample rate")
+		}
+		sampleRate, blocks = ac3SampleRates[fscod2]/2, 6
+	} else {
+		sampleRate, blocks = ac3SampleRates[fscod], []uint32{1, 2, 3, 6}[b.read(2)]
+	}
+	acmod := b.read(3)
+	lfeon := b.read(1)
+	bsid := b.read(5)
+
+	frameSamples := blocks * 256
+	dataRate := frameSize * 8 * sampleRate / frameSamples / 1000
+	config := uint64(dataRate)<<27 | // num_ind_sub = 0: one independent substream
+		uint64(fscod)<<22 | uint64(bsid)<<17 | uint64(acmod)<<9 | uint64(lfeon)<<8
+	payload := []byte{byte(config >> 32), byte(config >> 24), byte(config >> 16), byte(config >> 8), byte(config)}
+	return mp4.ConfigBox("dec3", payload), frameSamples, nil
+}
+
+// bitReader reads big-endian bit fields. Reads past the end return zeros.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// read returns the next n bits, n <= 32.
+func (b *bitReader) read(n int) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		v <<= 1
+		if i := b.pos / 8; i < len(b.data) {
+			v |= uint32(b.data[i]>>(7-b.pos%8)) & 1
+		}
+		b.pos++
+	}
+	return v
+}
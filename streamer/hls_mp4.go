@@ -0,0 +1,180 @@
+package streamer
+
+import (
+	"PiliPili_Backend/mp4"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// maxCoalescedRead bounds a single read of contiguous samples.
+const maxCoalescedRead = 8 * 1024 * 1024
+
+// mp4HLSSource remuxes the tracks of a progressive MP4 file. Segments start
+// at the sync samples of the first video track listed in the sample tables.
+type mp4HLSSource struct {
+	hlsTracks []*hlsTrack
+	sources   map[uint32]*mp4.Track
+	segs      []hlsSegment
+	total     time.Duration
+
+	video       *mp4.Track
+	videoRanges [][2]int // sample index range of the video track per segment
+
+	// decodeBase is the earliest decode time of any track on the
+	// presentation timeline, at most 0. Segments are timed from it, since
+	// fragment decode times cannot be negative, and every track is shifted
+	// alike to stay in sync.
+	decodeBase time.Duration
+}
+
+// newMP4HLSSource indexes movie for HLS packaging.
+func newMP4HLSSource(movie *mp4.Movie) (*mp4HLSSource, error) {
+	s := &mp4HLSSource{sources: make(map[uint32]*mp4.Track)}
+	if movie.Timescale > 0 {
+		s.total = time.Duration(float64(movie.Duration) / float64(movie.Timescale) * float64(time.Second))
+	}
+
+	audioCount := 0
+	for _, track := range movie.Tracks {
+		if track.Handler != "vide" && track.Handler != "soun" || track.SampleEntry == nil || len(track.Samples) == 0 {
+			continue
+		}
+		if track.Handler == "vide" && s.video != nil {
+			continue
+		}
+		t := &hlsTrack{
+			id:          track.ID,
+			handler:     track.Handler,
+			language:    track.Language,
+			timescale:   track.Timescale,
+			width:       track.Width,
+			height:      track.Height,
+			sampleEntry: track.SampleEntry,
+			codec:       mp4.CodecString(track.SampleEntry),
+		}
+		if track.Handler == "vide" {
+			s.video = track
+			t.name = "Video"
+		} else {
+			audioCount++
+			t.name = fmt.Sprintf("Audio %d", audioCount)
+			if track.Language != "" {
+				t.name = fmt.Sprintf("%s (%s)", t.name, track.Language)
+			}
+			t.isDefault = audioCount == 1
+		}
+		s.hlsTracks = append(s.hlsTracks, t)
+		s.sources[track.ID] = track
+		s.decodeBase = min(s.decodeBase, trackTime(track, track.DecodeStart()))
+
+		if d := trackTime(track, int64(track.Duration)); d > s.total {
+			s.total = d
+		}
+	}
+	if len(s.hlsTracks) == 0 {
+		return nil, errNoPlayableTracks
+	}
+
+	target := hlsSegmentDuration()
+	if s.video == nil {
+		// Audio only: every sample is a sync sample, cut at fixed intervals.
+		for start := time.Duration(0); start < s.total; start += target {
+			s.segs = append(s.segs, hlsSegment{start: start, end: min(start+target, s.total)})
+		}
+		return s, nil
+	}
+
+	var keyIndexes []int
+	var keyTimes []time.Duration
+	for i, sample := range s.video.Samples {
+		if sample.Sync {
+			keyIndexes = append(keyIndexes, i)
+			keyTimes = append(keyTimes, trackTime(s.video, sample.DTS+int64(sample.CTS)-s.video.EditShift))
+		}
+	}
+	if len(keyIndexes) == 0 {
+		return nil, errNoIndex
+	}
+
+	starts := planSegments(keyTimes, target)
+	for i, start := range starts {
+		segment := hlsSegment{start: keyTimes[start], end: s.total}
+		sampleRange := [2]int{keyIndexes[start], len(s.video.Samples)}
+		if i == 0 {
+			segment.start = 0
+			sampleRange[0] = 0
+		}
+		if i+1 < len(starts) {
+			segment.end = keyTimes[starts[i+1]]
+			sampleRange[1] = keyIndexes[starts[i+1]]
+		}
+		s.segs = append(s.segs, segment)
+		s.videoRanges = append(s.videoRanges, sampleRange)
+	}
+	return s, nil
+}
+
+// trackTime converts a time in the track timescale to a duration.
+func trackTime(track *mp4.Track, value int64) time.Duration {
+	return time.Duration(float64(value) / float64(track.Timescale) * float64(time.Second))
+}
+
+func (s *mp4HLSSource) tracks() []*hlsTrack     { return s.hlsTracks }
+func (s *mp4HLSSource) segments() []hlsSegment  { return s.segs }
+func (s *mp4HLSSource) duration() time.Duration { return s.total }
+
+// readSegment returns the samples of track in segment index. Video samples
+// are cut at the segment's sync samples; other tracks by presentation time.
+func (s *mp4HLSSource) readSegment(r io.ReaderAt, track *hlsTrack, index int) ([]hlsSample, error) {
+	source := s.sources[track.id]
+	segment := s.segs[index]
+
+	var first, last int
+	if source == s.video {
+		first, last = s.videoRanges[index][0], s.videoRanges[index][1]
+	} else {
+		bound := func(d time.Duration) int {
+			t := toTimescale(d, source.Timescale) + source.EditShift
+			return sort.Search(len(source.Samples), func(i int) bool { return source.Samples[i].DTS >= t })
+		}
+		first, last = bound(segment.start), bound(segment.end)
+		if index == 0 {
+			first = 0
+		}
+		if index == len(s.segs)-1 {
+			last = len(source.Samples)
+		}
+	}
+
+	// Decode times are moved to the presentation timeline, where composition
+	// offsets no longer need the edit shift, and then timed from decodeBase.
+	shift := source.EditShift + toTimescale(s.decodeBase, source.Timescale)
+	samples := make([]hlsSample, 0, last-first)
+	for i := first; i < last; {
+		// Read runs of contiguous samples at once.
+		j := i + 1
+		runEnd := source.Samples[i].Offset + int64(source.Samples[i].Size)
+		for j < last && source.Samples[j].Offset == runEnd && runEnd-source.Samples[i].Offset < maxCoalescedRead {
+			runEnd += int64(source.Samples[j].Size)
+			j++
+		}
+		data := make([]byte, runEnd-source.Samples[i].Offset)
+		if _, err := r.ReadAt(data, source.Samples[i].Offset); err != nil {
+			return nil, err
+		}
+		for ; i < j; i++ {
+			sample := source.Samples[i]
+			samples = append(samples, hlsSample{
+				data:     data[:sample.Size:sample.Size],
+				dts:      sample.DTS - shift,
+				cts:      sample.CTS,
+				duration: sample.Duration,
+				sync:     sample.Sync,
+			})
+			data = data[sample.Size:]
+		}
+	}
+	return samples, nil
+}
@@ -0,0 +1,84 @@
+package streamer
+
+import (
+	"PiliPili_Backend/mp4"
+	"PiliPili_Backend/storage"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestMP4HLSNegativeDecodeStart checks the segment timing of a file whose
+// video is decoded ahead of presentation: its edit list skips 80 ms of B-frame
+// delay while the audio starts at 0. Decode times must not be negative, run
+// on across segments, and keep the tracks in sync.
+func TestMP4HLSNegativeDecodeStart(t *testing.T) {
+	const frames = 300 // 12 s of 40 ms frames, a keyframe every 2 s
+	video := &mp4.Track{ID: 1, Handler: "vide", Timescale: 1000, Duration: frames * 40, SampleEntry: []byte("avc1"), EditShift: 80}
+	audio := &mp4.Track{ID: 2, Handler: "soun", Timescale: 1000, Duration: frames * 40, SampleEntry: []byte("mp4a")}
+	for i := 0; i < frames; i++ {
+		video.Samples = append(video.Samples, mp4.Sample{Offset: int64(i), Size: 1, DTS: int64(i) * 40, CTS: 80, Duration: 40, Sync: i%50 == 0})
+		audio.Samples = append(audio.Samples, mp4.Sample{Offset: int64(i), Size: 1, DTS: int64(i) * 40, Duration: 40, Sync: true})
+	}
+	source, err := newMP4HLSSource(&mp4.Movie{Timescale: 1000, Duration: frames * 40, Tracks: []*mp4.Track{video, audio}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.segments()) < 2 {
+		t.Fatalf("got %d segments, want several", len(source.segments()))
+	}
+	file := bytes.NewReader(make([]byte, frames))
+
+	for _, track := range source.tracks() {
+		next := int64(-1)
+		for index := range source.segments() {
+			samples, err := source.readSegment(file, track, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) == 0 {
+				continue
+			}
+			if samples[0].dts < 0 || (next >= 0 && samples[0].dts != next) {
+				t.Errorf("track %d segment %d starts at %d, want %d and not negative", track.id, index, samples[0].dts, next)
+			}
+			last := samples[len(samples)-1]
+			next = last.dts + int64(last.duration)
+		}
+	}
+
+	// The first video frame is presented with the first audio sample, both
+	// shifted by the 80 ms decoded ahead.
+	first, err := source.readSegment(file, source.tracks()[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstAudio, err := source.readSegment(file, source.tracks()[1], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0].dts != 0 || first[0].dts+int64(first[0].cts) != 80 || firstAudio[0].dts != 80 {
+		t.Errorf("first video frame decoded at %d and presented at %d, first audio at %d; want 0, 80 and 80",
+			first[0].dts, first[0].dts+int64(first[0].cts), firstAudio[0].dts)
+	}
+}
+
+// TestMP4HLSSegmentCanceled checks that the segment of a request that went
+// away is not read.
+func TestMP4HLSSegmentCanceled(t *testing.T) {
+	track := &mp4.Track{ID: 1, Handler: "soun", Timescale: 1000, Duration: 4000, SampleEntry: []byte("mp4a")}
+	for i := 0; i < 100; i++ {
+		track.Samples = append(track.Samples, mp4.Sample{Offset: int64(i), Size: 1, DTS: int64(i) * 40, Duration: 40, Sync: true})
+	}
+	source, err := newMP4HLSSource(&mp4.Movie{Timescale: 1000, Duration: 4000, Tracks: []*mp4.Track{track}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	file := storage.WithContext(ctx, bytes.NewReader(make([]byte, 100)))
+	if _, err := source.readSegment(file, source.tracks()[0], 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("readSegment = %v, want %v", err, context.Canceled)
+	}
+}
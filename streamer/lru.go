@@ -0,0 +1,106 @@
+package streamer
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// lruCache is a size-bounded, concurrency-safe least-recently-used cache.
+type lruCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	maxSize  int64
+	size     int64
+	sizeOf   func(V) int64
+	items    map[K]*list.Element
+	eviction *list.List
+}
+
+// lruEntry is the value stored in the eviction list.
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+	size  int64
+}
+
+// newLRUCache returns a cache holding at most maxSize units as measured by sizeOf.
+func newLRUCache[K comparable, V any](maxSize int64, sizeOf func(V) int64) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		maxSize:  maxSize,
+		sizeOf:   sizeOf,
+		items:    make(map[K]*list.Element),
+		eviction: list.New(),
+	}
+}
+
+// Get returns the value cached under key and marks it as recently used.
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.eviction.MoveToFront(elem)
+		return elem.Value.(*lruEntry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add stores value under key, evicting the least recently used entries to stay
+// within the size limit. Values larger than the whole cache are not stored.
+func (c *lruCache[K, V]) Add(key K, value V) {
+	size := c.sizeOf(value)
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+	c.items[key] = c.eviction.PushFront(&lruEntry[K, V]{key: key, value: value, size: size})
+	c.size += size
+	for c.size > c.maxSize {
+		c.removeElement(c.eviction.Back())
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Size returns the total size of the cached entries.
+func (c *lruCache[K, V]) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// removeElement drops elem from the cache. The caller must hold c.mu.
+func (c *lruCache[K, V]) removeElement(elem *list.Element) {
+	entry := c.eviction.Remove(elem).(*lruEntry[K, V])
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+// fileKey identifies one version of a file, so that cached results derived
+// from it are invalidated when the file is replaced or modified.
+type fileKey struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+// newFileKey returns the key of the file at path described by info.
+func newFileKey(path string, info os.FileInfo) fileKey {
+	return fileKey{path: path, size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+// etag returns a strong HTTP entity tag for the file version.
+func (k fileKey) etag() string {
+	return fmt.Sprintf(`"%x-%x"`, k.modTime, k.size)
+}
@@ -0,0 +1,127 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEncipher is the signature key of the test configuration.
+const testEncipher = "0123456789abcdef"
+
+// testDir holds the configuration, media and caches of the tests.
+var testDir string
+
+// testConfig is the configuration the streamer tests run with. Caches and
+// worker pools sized from the configuration are created on first use, so
+// it must be loaded before any test runs.
+const testConfig = `LogLevel: "ERROR"
+Encipher: %q
+StorageBasePath: %q
+Thumbnails:
+  cacheDirectory: %q
+  spriteColumns: 2
+  spriteRows: 2
+FFmpeg:
+  path: %q
+Transcode:
+  enabled: true
+  maxConcurrent: 1
+  idleTimeout: 1s
+  directory: %q
+`
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "pilipili-streamer-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	testDir = dir
+
+	media := filepath.Join(dir, "media")
+	if err := os.Mkdir(media, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	file := filepath.Join(dir, "config.yaml")
+	content := fmt.Sprintf(testConfig, testEncipher, media+"/", filepath.Join(dir, "thumbnails"), ffmpeg, filepath.Join(dir, "transcodes"))
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.Initialize(file, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := InitializeSignature(config.GetConfig().Encipher); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	WatchConfig()
+	gin.SetMode(gin.TestMode)
+	return m.Run()
+}
+
+// writeMedia creates a file of the given content in the media directory and
+// returns its path relative to it.
+func writeMedia(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(config.GetConfig().StorageBasePath, name), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// signedURL returns target with the path query parameter set to path and a
+// signature valid for the next hour.
+func signedURL(t *testing.T, target, path string, query url.Values) string {
+	t.Helper()
+	return signedURLFor(t, "media", target, path, query)
+}
+
+// signedURLFor returns a URL like signedURL, signed for mediaId, so that
+// links of different playbacks can be told apart.
+func signedURLFor(t *testing.T, mediaId, target, path string, query url.Values) string {
+	t.Helper()
+	signature, err := GetSignatureInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signature.Encrypt("item", mediaId, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("path", path)
+	query.Set("signature", token)
+	return target + "?" + query.Encode()
+}
+
+// serve runs req against handler, registered on a gin engine for the path of req.
+func serve(handler gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.GET(req.URL.Path, handler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,354 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sniffLength is the number of leading bytes inspected by content sniffing.
+const sniffLength = 512
+
+// defaultContentType is returned when neither the extension nor the content is recognized.
+const defaultContentType = "application/octet-stream"
+
+// maxCachedSniffs bounds the number of file versions whose sniffed type is cached.
+const maxCachedSniffs = 4096
+
+// builtinMimeTypes maps lower-case file extensions to content types.
+var builtinMimeTypes = map[string]string{
+	// Video
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mk3d": "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".flv":  "video/x-flv",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".vob":  "video/mpeg",
+	".ogv":  "video/ogg",
+	".wmv":  "video/x-ms-wmv",
+	".3gp":  "video/3gpp",
+	".rmvb": "application/vnd.rn-realmedia-vbr",
+	".rm":   "application/vnd.rn-realmedia",
+
+	// Audio
+	".mka":  "audio/x-matroska",
+	".aac":  "audio/aac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".mp2":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".ac3":  "audio/ac3",
+	".eac3": "audio/eac3",
+	".dts":  "audio/vnd.dts",
+	".wma":  "audio/x-ms-wma",
+
+	// Subtitles
+	".srt": "application/x-subrip",
+	".vtt": "text/vtt",
+	".ass": "text/x-ssa",
+	".ssa": "text/x-ssa",
+	".sup": "application/x-pgs",
+	".sub": "text/plain",
+	".idx": "text/plain",
+
+	// Images
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+
+	// Fonts
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".ttc":   "font/collection",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+
+	// Playlists and metadata
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".nfo":  "text/plain",
+	".txt":  "text/plain",
+	".xml":  "application/xml",
+	".json": "application/json",
+}
+
+// containerFamilies groups content types sharing a container format, so that
+// an extension is only considered wrong when the sniffed container differs
+// (a .mka file sniffed as Matroska video is still fine).
+var containerFamilies = map[string]string{
+	"video/x-matroska": "matroska",
+	"audio/x-matroska": "matroska",
+	"video/webm":       "matroska",
+	"video/mp4":        "isobmff",
+	"audio/mp4":        "isobmff",
+	"video/quicktime":  "isobmff",
+	"video/3gpp":       "isobmff",
+	"video/mp2t":       "mpegts",
+	"video/mpeg":       "mpegps",
+	"audio/ogg":        "ogg",
+	"video/ogg":        "ogg",
+	"audio/wav":        "riff",
+	"video/x-msvideo":  "riff",
+	"image/webp":       "riff",
+}
+
+// MimeRegistry resolves the content type of media files from their extension,
+// config-supplied overrides and the magic bytes at the start of the file.
+type MimeRegistry struct {
+	mu        sync.RWMutex
+	types     map[string]string
+	overrides map[string]string
+}
+
+var (
+	mimeRegistry     = NewMimeRegistry(nil)
+	mimeRegistryLock sync.RWMutex
+)
+
+// sniffCache holds the type sniffed from the first bytes of each file
+// version, "" when the content was not recognized. It is independent of the
+// overrides, so it survives the registry being replaced on reload.
+var sniffCache = newLRUCache[fileKey, string](maxCachedSniffs, func(string) int64 { return 1 })
+
+// NewMimeRegistry returns a registry with the built-in table and the given
+// extension overrides, which take precedence over both the table and sniffing.
+func NewMimeRegistry(overrides map[string]string) *MimeRegistry {
+	r := &MimeRegistry{
+		types:     make(map[string]string, len(builtinMimeTypes)),
+		overrides: make(map[string]string, len(overrides)),
+	}
+	for ext, contentType := range builtinMimeTypes {
+		r.types[ext] = contentType
+	}
+	for ext, contentType := range overrides {
+		r.overrides[normalizeExt(ext)] = contentType
+	}
+	return r
+}
+
+// InitializeMimeTypes replaces the global registry with one using the given overrides.
+func InitializeMimeTypes(overrides map[string]string) {
+	mimeRegistryLock.Lock()
+	mimeRegistry = NewMimeRegistry(overrides)
+	mimeRegistryLock.Unlock()
+}
+
+// GetMimeRegistry returns the global registry.
+func GetMimeRegistry() *MimeRegistry {
+	mimeRegistryLock.RLock()
+	defer mimeRegistryLock.RUnlock()
+	return mimeRegistry
+}
+
+// Register adds or replaces the content type of an extension in the built-in table.
+func (r *MimeRegistry) Register(ext, contentType string) {
+	r.mu.Lock()
+	r.types[normalizeExt(ext)] = contentType
+	r.mu.Unlock()
+}
+
+// Lookup returns the content type registered for ext.
+func (r *MimeRegistry) Lookup(ext string) (string, bool) {
+	ext = normalizeExt(ext)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if contentType, ok := r.overrides[ext]; ok {
+		return contentType, true
+	}
+	contentType, ok := r.types[ext]
+	return contentType, ok
+}
+
+// DetectContentType returns the content type of the file called name whose
+// first bytes are header. Config overrides always win; otherwise the sniffed
+// type is used when the extension is unknown or names a different container.
+func (r *MimeRegistry) DetectContentType(name string, header []byte) string {
+	return r.resolveContentType(name, func() string { return sniffContentType(header) })
+}
+
+// DetectFileContentType returns the content type of the file version key
+// like DetectContentType. The first bytes of file are only read when no
+// override applies, and their sniffed type is cached per file version, so
+// seeking into a file does not read its header again.
+func (r *MimeRegistry) DetectFileContentType(key fileKey, file io.ReaderAt) string {
+	return r.resolveContentType(key.path, func() string {
+		if sniffed, ok := sniffCache.Get(key); ok {
+			return sniffed
+		}
+		sniffed := sniffContentType(readHeader(file))
+		sniffCache.Add(key, sniffed)
+		return sniffed
+	})
+}
+
+// resolveContentType picks the content type of the file called name from
+// the overrides, the extension and the type returned by sniff, which is
+// only called when no override applies.
+func (r *MimeRegistry) resolveContentType(name string, sniff func() string) string {
+	ext := normalizeExt(filepath.Ext(name))
+
+	r.mu.RLock()
+	override, hasOverride := r.overrides[ext]
+	byExt, hasExt := r.types[ext]
+	r.mu.RUnlock()
+
+	if hasOverride {
+		return override
+	}
+
+	sniffed := sniff()
+	switch {
+	case sniffed == "":
+		if hasExt {
+			return byExt
+		}
+		return defaultContentType
+	case !hasExt:
+		return sniffed
+	case containerFamilies[byExt] != "" && containerFamilies[byExt] == containerFamilies[sniffed]:
+		// Same container, keep the more specific extension type (e.g. audio/mp4 for .m4a).
+		return byExt
+	case containerFamilies[sniffed] != "" && byExt != sniffed:
+		logger.Debug("Extension does not match content, using sniffed type", "name", name, "extension", byExt, "sniffed", sniffed)
+		return sniffed
+	default:
+		return byExt
+	}
+}
+
+// sniffContentType recognizes common media formats from their magic bytes,
+// returning "" when the content is not recognized.
+func sniffContentType(header []byte) string {
+	switch {
+	case len(header) == 0:
+		return ""
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML: the DocType element tells Matroska and WebM apart.
+		if bytes.Contains(header, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		switch string(header[8:12]) {
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		case "qt  ":
+			return "video/quicktime"
+		case "3gp4", "3gp5", "3gp6", "3g2a":
+			return "video/3gpp"
+		default:
+			return "video/mp4"
+		}
+	case isMPEGTS(header, 0, 188):
+		return "video/mp2t"
+	case isMPEGTS(header, 4, 192):
+		// M2TS (Blu-ray) prefixes each 188-byte packet with a 4-byte timecode.
+		return "video/mp2t"
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xBA}):
+		return "video/mpeg"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		if bytes.Contains(header, []byte("\x80theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "audio/flac"
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")):
+		switch string(header[8:12]) {
+		case "WAVE":
+			return "audio/wav"
+		case "AVI ":
+			return "video/x-msvideo"
+		case "WEBP":
+			return "image/webp"
+		}
+		return ""
+	case bytes.HasPrefix(header, []byte("FLV\x01")):
+		return "video/x-flv"
+	case bytes.HasPrefix(header, []byte(".RMF")):
+		return "application/vnd.rn-realmedia"
+	case bytes.HasPrefix(header, []byte("PG")) && len(header) >= 11 && isPGSSegment(header[10]):
+		return "application/x-pgs"
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return "audio/mpeg"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		// ADTS sync word with layer bits 00 is AAC.
+		return "audio/aac"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return "audio/mpeg"
+	}
+
+	text := bytes.TrimPrefix(header, []byte("\xEF\xBB\xBF"))
+	switch {
+	case bytes.HasPrefix(text, []byte("WEBVTT")):
+		return "text/vtt"
+	case bytes.HasPrefix(text, []byte("[Script Info]")):
+		return "text/x-ssa"
+	}
+
+	if detected := http.DetectContentType(header); detected != defaultContentType && !strings.HasPrefix(detected, "text/plain") {
+		return detected
+	}
+	return ""
+}
+
+// isMPEGTS reports whether header holds an MPEG-TS sync byte at offset for
+// every packet of the given size it covers, requiring at least two packets.
+func isMPEGTS(header []byte, offset, packetSize int) bool {
+	packets := 0
+	for i := offset; i < len(header) && packets < 3; i += packetSize {
+		if header[i] != 0x47 {
+			return false
+		}
+		packets++
+	}
+	return packets >= 2
+}
+
+// isPGSSegment reports whether b is a valid Presentation Graphic Stream segment type.
+func isPGSSegment(b byte) bool {
+	switch b {
+	case 0x14, 0x15, 0x16, 0x17, 0x80:
+		return true
+	}
+	return false
+}
+
+// normalizeExt returns ext in lower case with a leading dot.
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// readHeader reads up to sniffLength bytes from the start of r without moving its offset.
+func readHeader(r io.ReaderAt) []byte {
+	header := make([]byte, sniffLength)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		logger.Debug("Failed to read file header for sniffing", "error", err)
+	}
+	return header[:n]
+}
@@ -0,0 +1,906 @@
+package streamer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Matroska element IDs, see https://www.matroska.org/technical/elements.html.
+const (
+	mkvIDEBML                 = 0x1A45DFA3
+	mkvIDDocType              = 0x4282
+	mkvIDSegment              = 0x18538067
+	mkvIDSeekHead             = 0x114D9B74
+	mkvIDSeek                 = 0x4DBB
+	mkvIDSeekID               = 0x53AB
+	mkvIDSeekPosition         = 0x53AC
+	mkvIDInfo                 = 0x1549A966
+	mkvIDTimestampScale       = 0x2AD7B1
+	mkvIDDuration             = 0x4489
+	mkvIDTitle                = 0x7BA9
+	mkvIDMuxingApp            = 0x4D80
+	mkvIDWritingApp           = 0x5741
+	mkvIDTracks               = 0x1654AE6B
+	mkvIDTrackEntry           = 0xAE
+	mkvIDTrackNumber          = 0xD7
+	mkvIDTrackUID             = 0x73C5
+	mkvIDTrackType            = 0x83
+	mkvIDFlagDefault          = 0x88
+	mkvIDFlagForced           = 0x55AA
+	mkvIDDefaultDuration      = 0x23E383
+	mkvIDName                 = 0x536E
+	mkvIDLanguage             = 0x22B59C
+	mkvIDLanguageBCP47        = 0x22B59D
+	mkvIDCodecID              = 0x86
+	mkvIDCodecPrivate         = 0x63A2
+	mkvIDCodecDelay           = 0x56AA
+	mkvIDVideo                = 0xE0
+	mkvIDPixelWidth           = 0xB0
+	mkvIDPixelHeight          = 0xBA
+	mkvIDAudio                = 0xE1
+	mkvIDSamplingFrequency    = 0xB5
+	mkvIDChannels             = 0x9F
+	mkvIDBitDepth             = 0x6264
+	mkvIDContentEncodings     = 0x6D80
+	mkvIDContentEncoding      = 0x6240
+	mkvIDContentEncodingScope = 0x5032
+	mkvIDContentEncodingType  = 0x5033
+	mkvIDContentCompression   = 0x5034
+	mkvIDContentCompAlgo      = 0x4254
+	mkvIDContentCompSettings  = 0x4255
+	mkvIDCues                 = 0x1C53BB6B
+	mkvIDCuePoint             = 0xBB
+	mkvIDCueTime              = 0xB3
+	mkvIDCueTrackPositions    = 0xB7
+	mkvIDCueTrack             = 0xF7
+	mkvIDCueClusterPosition   = 0xF1
+	mkvIDCueRelativePosition  = 0xF0
+	mkvIDCueDuration          = 0xB2
+	mkvIDAttachments          = 0x1941A469
+	mkvIDAttachedFile         = 0x61A7
+	mkvIDFileDescription      = 0x467E
+	mkvIDFileName             = 0x466E
+	mkvIDFileMediaType        = 0x4660
+	mkvIDFileData             = 0x465C
+	mkvIDFileUID              = 0x46AE
+	mkvIDCluster              = 0x1F43B675
+	mkvIDTimestamp            = 0xE7
+	mkvIDSimpleBlock          = 0xA3
+	mkvIDBlockGroup           = 0xA0
+	mkvIDBlock                = 0xA1
+	mkvIDBlockDuration        = 0x9B
+	mkvIDReferenceBlock       = 0xFB
+	mkvIDChapters             = 0x1043A770
+	mkvIDTags                 = 0x1254C367
+)
+
+// mkvTrackTypes names the Matroska TrackType values.
+var mkvTrackTypes = map[uint64]string{
+	1:    "video",
+	2:    "audio",
+	3:    "complex",
+	0x10: "logo",
+	0x11: "subtitle",
+	0x12: "buttons",
+	0x20: "control",
+	0x21: "metadata",
+}
+
+var errNotMatroska = errors.New("not a Matroska/WebM file")
+
+// mkvFile holds the header level structure of a Matroska file: everything
+// needed to locate data without reading the clusters themselves.
+type mkvFile struct {
+	DocType        string
+	TimestampScale uint64 // nanoseconds per timestamp unit
+	Duration       time.Duration
+	Title          string
+	MuxingApp      string
+	WritingApp     string
+	Tracks         []*mkvTrack
+	Attachments    []mkvAttachment
+
+	cues          []mkvCuePoint
+	segmentOffset int64 // offset of the Segment payload, the base of SeekHead and Cue positions
+	segmentEnd    int64
+	firstCluster  int64
+	cuesOffset    int64 // offset and total size of the Cues element, 0 when absent
+	cuesSize      int64
+}
+
+// mkvTrack describes one TrackEntry.
+type mkvTrack struct {
+	Number     uint64  `json:"number"`
+	UID        uint64  `json:"uid"`
+	Type       string  `json:"type"`
+	CodecID    string  `json:"codecId"`
+	Name       string  `json:"name,omitempty"`
+	Language   string  `json:"language,omitempty"`
+	Default    bool    `json:"default"`
+	Forced     bool    `json:"forced"`
+	Width      uint64  `json:"width,omitempty"`
+	Height     uint64  `json:"height,omitempty"`
+	SampleRate float64 `json:"sampleRate,omitempty"`
+	Channels   uint64  `json:"channels,omitempty"`
+	BitDepth   uint64  `json:"bitDepth,omitempty"`
+
+	defaultDuration uint64 // nanoseconds per frame
+	codecDelay      uint64 // nanoseconds
+	codecPrivate    []byte
+	encodings       []mkvContentEncoding
+}
+
+// mkvContentEncoding describes a compression applied to a track.
+type mkvContentEncoding struct {
+	scope        uint64 // 1: frames, 2: codec private
+	encodingType uint64 // 0: compression, 1: encryption
+	algorithm    uint64 // 0: zlib, 3: header stripping
+	settings     []byte
+}
+
+// mkvAttachment describes an attached file such as a font.
+type mkvAttachment struct {
+	UID         uint64 `json:"uid"`
+	Name        string `json:"name"`
+	MediaType   string `json:"mediaType"`
+	Description string `json:"description,omitempty"`
+	Size        int64  `json:"size"`
+
+	dataOffset int64
+}
+
+// mkvCuePoint is an index entry pointing at the cluster holding a timestamp.
+type mkvCuePoint struct {
+	time      uint64
+	positions []mkvCuePosition
+}
+
+// mkvCuePosition locates a block of one track.
+type mkvCuePosition struct {
+	track            uint64
+	clusterPosition  int64 // relative to the Segment payload
+	relativePosition int64 // relative to the Cluster payload, -1 when absent
+	duration         uint64
+}
+
+// mkvBlock is a decoded Block or SimpleBlock.
+type mkvBlock struct {
+	track       uint64
+	timestamp   int64 // absolute, in TimestampScale units
+	duration    uint64
+	hasDuration bool
+	keyframe    bool
+	lacing      byte // 0 none, 1 Xiph, 2 fixed-size, 3 EBML
+	data        []byte
+}
+
+// parseMatroska reads the header level structure of a Matroska or WebM file.
+// Elements stored after the clusters are located through the SeekHead, so the
+// cluster data is never scanned.
+func parseMatroska(r io.ReaderAt, fileSize int64) (*mkvFile, error) {
+	header, err := readElementHeader(r, 0)
+	if err != nil || header.id != mkvIDEBML {
+		return nil, errNotMatroska
+	}
+
+	m := &mkvFile{DocType: "matroska", TimestampScale: 1000000}
+	headerData, err := readElementData(r, header)
+	if err != nil {
+		return nil, err
+	}
+	children, _ := parseChildren(headerData)
+	for _, child := range children {
+		if child.id == mkvIDDocType {
+			m.DocType = ebmlString(child.data)
+		}
+	}
+
+	segment, err := findSegment(r, header.end())
+	if err != nil {
+		return nil, err
+	}
+	m.segmentOffset = segment.dataOffset
+	m.segmentEnd = fileSize
+	if end := segment.end(); end >= 0 && end < fileSize {
+		m.segmentEnd = end
+	}
+
+	seeks := make(map[uint32][]int64)
+	parsed := make(map[int64]bool)
+	found := make(map[uint32]bool)
+
+	for pos := segment.dataOffset; pos < m.segmentEnd; {
+		e, err := readElementHeader(r, pos)
+		if err != nil {
+			break
+		}
+		if e.id == mkvIDCluster {
+			m.firstCluster = pos
+			break
+		}
+		if err := m.parseTopLevel(r, e, seeks); err != nil {
+			return nil, err
+		}
+		parsed[pos] = true
+		found[e.id] = true
+		if e.size < 0 {
+			break
+		}
+		pos = e.end()
+	}
+
+	// Follow the SeekHead to elements stored after the clusters, including
+	// secondary SeekHeads which may list more of them.
+	for _, id := range []uint32{mkvIDSeekHead, mkvIDInfo, mkvIDTracks, mkvIDCues, mkvIDAttachments} {
+		for i := 0; i < len(seeks[id]); i++ {
+			pos := m.segmentOffset + seeks[id][i]
+			if parsed[pos] || (found[id] && id != mkvIDSeekHead) || pos >= m.segmentEnd {
+				continue
+			}
+			e, err := readElementHeader(r, pos)
+			if err != nil || e.id != id {
+				continue
+			}
+			if err := m.parseTopLevel(r, e, seeks); err != nil {
+				return nil, err
+			}
+			parsed[pos] = true
+			found[id] = true
+		}
+	}
+
+	if m.firstCluster == 0 && len(seeks[mkvIDCluster]) > 0 {
+		m.firstCluster = m.segmentOffset + seeks[mkvIDCluster][0]
+	}
+	if !found[mkvIDTracks] {
+		return nil, fmt.Errorf("%w: no Tracks element", errInvalidEBML)
+	}
+	return m, nil
+}
+
+// findSegment locates the Segment element following the EBML header.
+func findSegment(r io.ReaderAt, offset int64) (ebmlElement, error) {
+	for {
+		e, err := readElementHeader(r, offset)
+		if err != nil {
+			return ebmlElement{}, errNotMatroska
+		}
+		if e.id == mkvIDSegment {
+			return e, nil
+		}
+		if e.size < 0 {
+			return ebmlElement{}, errNotMatroska
+		}
+		offset = e.end()
+	}
+}
+
+// parseTopLevel parses one top-level element of the Segment.
+func (m *mkvFile) parseTopLevel(r io.ReaderAt, e ebmlElement, seeks map[uint32][]int64) error {
+	switch e.id {
+	case mkvIDSeekHead:
+		data, err := readElementData(r, e)
+		if err != nil {
+			return err
+		}
+		m.parseSeekHead(data, seeks)
+	case mkvIDInfo:
+		data, err := readElementData(r, e)
+		if err != nil {
+			return err
+		}
+		m.parseInfo(data)
+	case mkvIDTracks:
+		data, err := readElementData(r, e)
+		if err != nil {
+			return err
+		}
+		return m.parseTracks(data)
+	case mkvIDCues:
+		data, err := readElementData(r, e)
+		if err != nil {
+			return err
+		}
+		m.cuesOffset = e.offset
+		m.cuesSize = e.end() - e.offset
+		m.parseCues(data)
+	case mkvIDAttachments:
+		return m.parseAttachments(r, e)
+	}
+	return nil
+}
+
+// parseSeekHead records the positions of the top-level elements it lists.
+func (m *mkvFile) parseSeekHead(data []byte, seeks map[uint32][]int64) {
+	entries, _ := parseChildren(data)
+	for _, entry := range entries {
+		if entry.id != mkvIDSeek {
+			continue
+		}
+		fields, _ := parseChildren(entry.data)
+		var id uint32
+		position := int64(-1)
+		for _, field := range fields {
+			switch field.id {
+			case mkvIDSeekID:
+				id = uint32(ebmlUint(field.data))
+			case mkvIDSeekPosition:
+				position = int64(ebmlUint(field.data))
+			}
+		}
+		if id != 0 && position >= 0 {
+			seeks[id] = append(seeks[id], position)
+		}
+	}
+}
+
+// parseInfo parses the segment Info element.
+func (m *mkvFile) parseInfo(data []byte) {
+	fields, _ := parseChildren(data)
+	var duration float64
+	for _, field := range fields {
+		switch field.id {
+		case mkvIDTimestampScale:
+			if scale := ebmlUint(field.data); scale > 0 {
+				m.TimestampScale = scale
+			}
+		case mkvIDDuration:
+			duration = ebmlFloat(field.data)
+		case mkvIDTitle:
+			m.Title = ebmlString(field.data)
+		case mkvIDMuxingApp:
+			m.MuxingApp = ebmlString(field.data)
+		case mkvIDWritingApp:
+			m.WritingApp = ebmlString(field.data)
+		}
+	}
+	m.Duration = time.Duration(duration * float64(m.TimestampScale))
+}
+
+// parseTracks parses every TrackEntry of the Tracks element.
+func (m *mkvFile) parseTracks(data []byte) error {
+	entries, err := parseChildren(data)
+	if err != nil && len(entries) == 0 {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.id != mkvIDTrackEntry {
+			continue
+		}
+		track := parseTrackEntry(entry.data)
+		if track.Number != 0 {
+			m.Tracks = append(m.Tracks, track)
+		}
+	}
+	return nil
+}
+
+// parseTrackEntry parses a single TrackEntry.
+func parseTrackEntry(data []byte) *mkvTrack {
+	track := &mkvTrack{Language: "eng", Default: true}
+	fields, _ := parseChildren(data)
+	var bcp47 string
+	for _, field := range fields {
+		switch field.id {
+		case mkvIDTrackNumber:
+			track.Number = ebmlUint(field.data)
+		case mkvIDTrackUID:
+			track.UID = ebmlUint(field.data)
+		case mkvIDTrackType:
+			track.Type = mkvTrackTypes[ebmlUint(field.data)]
+		case mkvIDFlagDefault:
+			track.Default = ebmlUint(field.data) != 0
+		case mkvIDFlagForced:
+			track.Forced = ebmlUint(field.data) != 0
+		case mkvIDDefaultDuration:
+			track.defaultDuration = ebmlUint(field.data)
+		case mkvIDName:
+			track.Name = ebmlString(field.data)
+		case mkvIDLanguage:
+			track.Language = ebmlString(field.data)
+		case mkvIDLanguageBCP47:
+			bcp47 = ebmlString(field.data)
+		case mkvIDCodecID:
+			track.CodecID = ebmlString(field.data)
+		case mkvIDCodecPrivate:
+			track.codecPrivate = field.data
+		case mkvIDCodecDelay:
+			track.codecDelay = ebmlUint(field.data)
+		case mkvIDVideo:
+			video, _ := parseChildren(field.data)
+			for _, v := range video {
+				switch v.id {
+				case mkvIDPixelWidth:
+					track.Width = ebmlUint(v.data)
+				case mkvIDPixelHeight:
+					track.Height = ebmlUint(v.data)
+				}
+			}
+		case mkvIDAudio:
+			audio, _ := parseChildren(field.data)
+			track.SampleRate = 8000
+			track.Channels = 1
+			for _, a := range audio {
+				switch a.id {
+				case mkvIDSamplingFrequency:
+					track.SampleRate = ebmlFloat(a.data)
+				case mkvIDChannels:
+					track.Channels = ebmlUint(a.data)
+				case mkvIDBitDepth:
+					track.BitDepth = ebmlUint(a.data)
+				}
+			}
+		case mkvIDContentEncodings:
+			track.encodings = parseContentEncodings(field.data)
+		}
+	}
+	if bcp47 != "" {
+		track.Language = bcp47
+	}
+	if track.Type == "" {
+		track.Type = "unknown"
+	}
+	return track
+}
+
+// parseContentEncodings parses the ContentEncodings of a track.
+func parseContentEncodings(data []byte) []mkvContentEncoding {
+	var encodings []mkvContentEncoding
+	entries, _ := parseChildren(data)
+	for _, entry := range entries {
+		if entry.id != mkvIDContentEncoding {
+			continue
+		}
+		encoding := mkvContentEncoding{scope: 1}
+		fields, _ := parseChildren(entry.data)
+		for _, field := range fields {
+			switch field.id {
+			case mkvIDContentEncodingScope:
+				encoding.scope = ebmlUint(field.data)
+			case mkvIDContentEncodingType:
+				encoding.encodingType = ebmlUint(field.data)
+			case mkvIDContentCompression:
+				compression, _ := parseChildren(field.data)
+				for _, c := range compression {
+					switch c.id {
+					case mkvIDContentCompAlgo:
+						encoding.algorithm = ebmlUint(c.data)
+					case mkvIDContentCompSettings:
+						encoding.settings = c.data
+					}
+				}
+			}
+		}
+		encodings = append(encodings, encoding)
+	}
+	return encodings
+}
+
+// parseCues parses the CuePoints of the Cues element.
+func (m *mkvFile) parseCues(data []byte) {
+	points, _ := parseChildren(data)
+	m.cues = make([]mkvCuePoint, 0, len(points))
+	for _, point := range points {
+		if point.id != mkvIDCuePoint {
+			continue
+		}
+		var cue mkvCuePoint
+		fields, _ := parseChildren(point.data)
+		for _, field := range fields {
+			switch field.id {
+			case mkvIDCueTime:
+				cue.time = ebmlUint(field.data)
+			case mkvIDCueTrackPositions:
+				position := mkvCuePosition{relativePosition: -1}
+				values, _ := parseChildren(field.data)
+				for _, v := range values {
+					switch v.id {
+					case mkvIDCueTrack:
+						position.track = ebmlUint(v.data)
+					case mkvIDCueClusterPosition:
+						position.clusterPosition = int64(ebmlUint(v.data))
+					case mkvIDCueRelativePosition:
+						position.relativePosition = int64(ebmlUint(v.data))
+					case mkvIDCueDuration:
+						position.duration = ebmlUint(v.data)
+					}
+				}
+				cue.positions = append(cue.positions, position)
+			}
+		}
+		m.cues = append(m.cues, cue)
+	}
+	sort.SliceStable(m.cues, func(i, j int) bool { return m.cues[i].time < m.cues[j].time })
+}
+
+// parseAttachments lists the attached files without loading their data.
+func (m *mkvFile) parseAttachments(r io.ReaderAt, e ebmlElement) error {
+	end := e.end()
+	if end < 0 {
+		return nil
+	}
+	for pos := e.dataOffset; pos < end; {
+		file, err := readElementHeader(r, pos)
+		if err != nil || file.size < 0 {
+			return err
+		}
+		pos = file.end()
+		if file.id != mkvIDAttachedFile {
+			continue
+		}
+
+		var attachment mkvAttachment
+		for fieldPos := file.dataOffset; fieldPos < file.end(); {
+			field, err := readElementHeader(r, fieldPos)
+			if err != nil || field.size < 0 {
+				return err
+			}
+			fieldPos = field.end()
+			if field.id == mkvIDFileData {
+				attachment.dataOffset = field.dataOffset
+				attachment.Size = field.size
+				continue
+			}
+			data, err := readElementData(r, field)
+			if err != nil {
+				return err
+			}
+			switch field.id {
+			case mkvIDFileName:
+				attachment.Name = ebmlString(data)
+			case mkvIDFileMediaType:
+				attachment.MediaType = ebmlString(data)
+			case mkvIDFileDescription:
+				attachment.Description = ebmlString(data)
+			case mkvIDFileUID:
+				attachment.UID = ebmlUint(data)
+			}
+		}
+		m.Attachments = append(m.Attachments, attachment)
+	}
+	return nil
+}
+
+// track returns the track with the given number.
+func (m *mkvFile) track(number uint64) *mkvTrack {
+	for _, track := range m.Tracks {
+		if track.Number == number {
+			return track
+		}
+	}
+	return nil
+}
+
+// attachment returns the attachment with the given UID.
+func (m *mkvFile) attachment(uid uint64) (mkvAttachment, bool) {
+	for _, attachment := range m.Attachments {
+		if attachment.UID == uid {
+			return attachment, true
+		}
+	}
+	return mkvAttachment{}, false
+}
+
+// timestampToDuration converts a timestamp in TimestampScale units to a duration.
+func (m *mkvFile) timestampToDuration(timestamp int64) time.Duration {
+	return time.Duration(timestamp * int64(m.TimestampScale))
+}
+
+// isTopLevelID reports whether id is a child of the Segment, which ends an unknown-size Cluster.
+func isTopLevelID(id uint32) bool {
+	switch id {
+	case mkvIDCluster, mkvIDCues, mkvIDSeekHead, mkvIDInfo, mkvIDTracks, mkvIDAttachments, mkvIDChapters, mkvIDTags:
+		return true
+	}
+	return false
+}
+
+// clusterEnd returns the end of cluster, bounded by the segment for unknown sizes.
+func (m *mkvFile) clusterEnd(cluster ebmlElement) int64 {
+	if end := cluster.end(); end >= 0 && end <= m.segmentEnd {
+		return end
+	}
+	return m.segmentEnd
+}
+
+// readClusterTimestamp reads the header and Timestamp of the cluster at offset.
+func (m *mkvFile) readClusterTimestamp(r io.ReaderAt, offset int64) (ebmlElement, int64, error) {
+	cluster, err := readElementHeader(r, offset)
+	if err != nil {
+		return ebmlElement{}, 0, err
+	}
+	if cluster.id != mkvIDCluster {
+		return ebmlElement{}, 0, fmt.Errorf("%w: no Cluster at %d", errInvalidEBML, offset)
+	}
+
+	end := m.clusterEnd(cluster)
+	// The Timestamp is required to be the first child; tolerate a CRC or Void before it.
+	for pos, i := cluster.dataOffset, 0; pos < end && i < 4; i++ {
+		child, err := readElementHeader(r, pos)
+		if err != nil || child.size < 0 {
+			break
+		}
+		if child.id == mkvIDTimestamp {
+			data, err := readElementData(r, child)
+			if err != nil {
+				return ebmlElement{}, 0, err
+			}
+			return cluster, int64(ebmlUint(data)), nil
+		}
+		pos = child.end()
+	}
+	return ebmlElement{}, 0, fmt.Errorf("%w: cluster at %d has no Timestamp", errInvalidEBML, offset)
+}
+
+// readBlock decodes the SimpleBlock or BlockGroup element e of a cluster whose timestamp is clusterTime.
+func readBlock(r io.ReaderAt, e ebmlElement, clusterTime int64) (mkvBlock, error) {
+	data, err := readElementData(r, e)
+	if err != nil {
+		return mkvBlock{}, err
+	}
+
+	switch e.id {
+	case mkvIDSimpleBlock:
+		return parseBlock(data, clusterTime, true)
+	case mkvIDBlockGroup:
+		fields, _ := parseChildren(data)
+		var block mkvBlock
+		found := false
+		var duration uint64
+		hasDuration := false
+		referenced := false
+		for _, field := range fields {
+			switch field.id {
+			case mkvIDBlock:
+				block, err = parseBlock(field.data, clusterTime, false)
+				if err != nil {
+					return mkvBlock{}, err
+				}
+				found = true
+			case mkvIDBlockDuration:
+				duration = ebmlUint(field.data)
+				hasDuration = true
+			case mkvIDReferenceBlock:
+				referenced = true
+			}
+		}
+		if !found {
+			return mkvBlock{}, fmt.Errorf("%w: BlockGroup without Block", errInvalidEBML)
+		}
+		block.duration, block.hasDuration = duration, hasDuration
+		block.keyframe = !referenced
+		return block, nil
+	}
+	return mkvBlock{}, fmt.Errorf("%w: element 0x%X is not a block", errInvalidEBML, e.id)
+}
+
+// parseBlock decodes the payload of a Block or SimpleBlock. Laced blocks
+// keep their lacing in data; frames splits them.
+func parseBlock(data []byte, clusterTime int64, simple bool) (mkvBlock, error) {
+	track, n, ok := parseVint(data)
+	if !ok || len(data) < n+3 {
+		return mkvBlock{}, fmt.Errorf("%w: short block", errInvalidEBML)
+	}
+	relative := int16(uint16(data[n])<<8 | uint16(data[n+1]))
+	flags := data[n+2]
+	block := mkvBlock{
+		track:     track,
+		timestamp: clusterTime + int64(relative),
+		data:      data[n+3:],
+	}
+	if simple {
+		block.keyframe = flags&0x80 != 0
+	}
+	block.lacing = flags >> 1 & 0x03
+	return block, nil
+}
+
+// frames splits the payload of a block into its frames, undoing lacing.
+func (b mkvBlock) frames() ([][]byte, error) {
+	if b.lacing == 0 {
+		return [][]byte{b.data}, nil
+	}
+	data := b.data
+	if len(data) < 1 {
+		return nil, fmt.Errorf("%w: short laced block", errInvalidEBML)
+	}
+	count := int(data[0]) + 1
+	data = data[1:]
+
+	sizes := make([]int, count)
+	switch b.lacing {
+	case 1: // Xiph
+		for i := 0; i < count-1; i++ {
+			for {
+				if len(data) == 0 {
+					return nil, fmt.Errorf("%w: truncated Xiph lacing", errInvalidEBML)
+				}
+				value := data[0]
+				sizes[i] += int(value)
+				data = data[1:]
+				if value != 255 {
+					break
+				}
+			}
+		}
+	case 2: // fixed-size
+		if len(data)%count != 0 {
+			return nil, fmt.Errorf("%w: uneven fixed-size lacing", errInvalidEBML)
+		}
+		for i := range sizes {
+			sizes[i] = len(data) / count
+		}
+		count = 0 // sizes are final
+	case 3: // EBML
+		first, n, ok := parseVint(data)
+		if !ok {
+			return nil, fmt.Errorf("%w: bad EBML lacing", errInvalidEBML)
+		}
+		sizes[0] = int(first)
+		data = data[n:]
+		for i := 1; i < count-1; i++ {
+			raw, n, ok := parseVint(data)
+			if !ok {
+				return nil, fmt.Errorf("%w: bad EBML lacing", errInvalidEBML)
+			}
+			// Signed differences are stored with a bias of 2^(7n-1)-1.
+			sizes[i] = sizes[i-1] + int(int64(raw)-(int64(1)<<(7*n-1)-1))
+			data = data[n:]
+		}
+	}
+
+	if count > 0 {
+		total := 0
+		for _, size := range sizes[:count-1] {
+			if size < 0 {
+				return nil, fmt.Errorf("%w: negative lace size", errInvalidEBML)
+			}
+			total += size
+		}
+		if total > len(data) {
+			return nil, fmt.Errorf("%w: lace sizes exceed block", errInvalidEBML)
+		}
+		sizes[count-1] = len(data) - total
+	}
+
+	frames := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		frames[i] = data[:size]
+		data = data[size:]
+	}
+	return frames, nil
+}
+
+// peekBlockTrack returns the track number of a SimpleBlock or BlockGroup from
+// the bytes read along with its header, without loading the whole element.
+func peekBlockTrack(e ebmlElement) (uint64, bool) {
+	peek := e.peek
+	if e.id == mkvIDBlockGroup {
+		id, idLen, ok := parseElementID(peek)
+		if !ok || id != mkvIDBlock {
+			return 0, false
+		}
+		_, sizeLen, ok := parseVintSize(peek[idLen:])
+		if !ok {
+			return 0, false
+		}
+		peek = peek[idLen+sizeLen:]
+	}
+	track, _, ok := parseVint(peek)
+	return track, ok
+}
+
+// scanClusters walks the clusters from the one at offset (the first cluster
+// when offset is 0) and calls fn for each block of tracks until fn returns
+// false. Only element headers are read for other tracks' blocks, so their
+// payloads are skipped with ranged reads.
+func (m *mkvFile) scanClusters(r io.ReaderAt, offset int64, tracks map[uint64]bool, fn func(mkvBlock) bool) error {
+	if offset == 0 {
+		offset = m.firstCluster
+	}
+	if offset == 0 {
+		return nil
+	}
+	for pos := offset; pos < m.segmentEnd; {
+		e, err := readElementHeader(r, pos)
+		if err != nil {
+			return nil
+		}
+		if e.id != mkvIDCluster {
+			if e.size < 0 {
+				return nil
+			}
+			pos = e.end()
+			continue
+		}
+		next, more, err := m.scanCluster(r, e, tracks, fn)
+		if err != nil || !more {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+// scanCluster calls fn for each block of tracks in cluster and returns the
+// offset of the next top-level element, and false once fn has returned false.
+func (m *mkvFile) scanCluster(r io.ReaderAt, cluster ebmlElement, tracks map[uint64]bool, fn func(mkvBlock) bool) (int64, bool, error) {
+	end := m.clusterEnd(cluster)
+	var clusterTime int64
+	for pos := cluster.dataOffset; pos < end; {
+		e, err := readElementHeader(r, pos)
+		if err != nil {
+			return end, true, nil
+		}
+		if cluster.size < 0 && isTopLevelID(e.id) {
+			return pos, true, nil
+		}
+		if e.size < 0 {
+			return end, false, fmt.Errorf("%w: unknown-size element 0x%X inside cluster", errInvalidEBML, e.id)
+		}
+
+		switch e.id {
+		case mkvIDTimestamp:
+			data, err := readElementData(r, e)
+			if err != nil {
+				return end, false, err
+			}
+			clusterTime = int64(ebmlUint(data))
+		case mkvIDSimpleBlock, mkvIDBlockGroup:
+			if number, ok := peekBlockTrack(e); !ok || tracks[number] {
+				block, err := readBlock(r, e, clusterTime)
+				if err == nil && tracks[block.track] && !fn(block) {
+					return e.end(), false, nil
+				}
+			}
+		}
+		pos = e.end()
+	}
+	return end, true, nil
+}
+
+// decodeFrame undoes the content compression applied to a frame of track.
+func (t *mkvTrack) decodeFrame(data []byte) ([]byte, error) {
+	return t.decode(data, 1)
+}
+
+// decodedCodecPrivate returns the codec private data with content compression undone.
+func (t *mkvTrack) decodedCodecPrivate() ([]byte, error) {
+	return t.decode(t.codecPrivate, 2)
+}
+
+// decode undoes, in reverse order, the encodings of track applying to scope.
+func (t *mkvTrack) decode(data []byte, scope uint64) ([]byte, error) {
+	for i := len(t.encodings) - 1; i >= 0; i-- {
+		encoding := t.encodings[i]
+		if encoding.scope&scope == 0 {
+			continue
+		}
+		if encoding.encodingType != 0 {
+			return nil, errors.New("encrypted tracks are not supported")
+		}
+		switch encoding.algorithm {
+		case 0:
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			decoded, err := io.ReadAll(io.LimitReader(zr, maxEBMLElementRead))
+			zr.Close()
+			if err != nil {
+				return nil, err
+			}
+			data = decoded
+		case 3:
+			data = append(append([]byte{}, encoding.settings...), data...)
+		default:
+			return nil, fmt.Errorf("unsupported content compression %d", encoding.algorithm)
+		}
+	}
+	return data, nil
+}
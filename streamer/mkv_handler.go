@@ -0,0 +1,222 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCachedMkvHeaders bounds the number of parsed Matroska headers kept in memory.
+const maxCachedMkvHeaders = 256
+
+// mkvCache holds parsed Matroska headers keyed by file version.
+var mkvCache = newLRUCache[fileKey, *mkvFile](maxCachedMkvHeaders, func(*mkvFile) int64 { return 1 })
+
+// subtitleContentTypes maps extracted subtitle formats to content types.
+var subtitleContentTypes = map[string]string{
+	"ass": "text/x-ssa; charset=utf-8",
+	"srt": "application/x-subrip; charset=utf-8",
+	"vtt": "text/vtt; charset=utf-8",
+}
+
+// openMatroska opens the Matroska file at filePath and returns it with its
+// parsed header, which is cached per file version.
+func openMatroska(filePath string) (storage.File, *mkvFile, fileKey, error) {
+	file, err := storage.Open(filePath)
+	if err != nil {
+		return nil, nil, fileKey{}, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fileKey{}, err
+	}
+
+	key := newFileKey(filePath, fileInfo)
+	m, err := loadMatroska(file, key)
+	if err != nil {
+		file.Close()
+		return nil, nil, fileKey{}, err
+	}
+	return file, m, key, nil
+}
+
+// loadMatroska returns the parsed header of the Matroska file read from r,
+// which is cached per file version.
+func loadMatroska(r io.ReaderAt, key fileKey) (*mkvFile, error) {
+	if m, ok := mkvCache.Get(key); ok {
+		return m, nil
+	}
+
+	startTime := time.Now()
+	m, err := parseMatroska(r, key.size)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Matroska header parsed", "filePath", key.path, "tracks", len(m.Tracks), "cues", len(m.cues), "elapsed", time.Since(startTime))
+	mkvCache.Add(key, m)
+	return m, nil
+}
+
+// openMatroskaForRequest authenticates c and opens the requested Matroska
+// file. When it returns false the error response has already been written.
+func openMatroskaForRequest(c *gin.Context) (storage.File, *mkvFile, fileKey, bool) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return nil, nil, fileKey{}, false
+	}
+
+	file, m, key, err := openMatroska(filePath)
+	switch {
+	case err == nil:
+		return file, m, key, true
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, errNotMatroska):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Not a Matroska file"})
+	default:
+		logger.Error("Failed to parse Matroska file", "filePath", filePath, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to parse Matroska file"})
+	}
+	return nil, nil, fileKey{}, false
+}
+
+// MkvTracks lists the tracks and attachments of a Matroska file.
+func MkvTracks(c *gin.Context) {
+	file, m, _, ok := openMatroskaForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	c.JSON(http.StatusOK, gin.H{
+		"docType":     m.DocType,
+		"title":       m.Title,
+		"duration":    m.Duration.Seconds(),
+		"tracks":      m.Tracks,
+		"attachments": m.Attachments,
+	})
+}
+
+// MkvSubtitle extracts a text subtitle track of a Matroska file as a
+// standalone file. The format query parameter selects "ass", "srt" or "vtt";
+// by default the track's own format is kept.
+func MkvSubtitle(c *gin.Context) {
+	number, err := strconv.ParseUint(c.Query("track"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid track number"})
+		return
+	}
+
+	file, m, key, ok := openMatroskaForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	track := m.track(number)
+	if track == nil || !track.isTextSubtitle() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No text subtitle track with this number"})
+		return
+	}
+
+	format := strings.ToLower(c.Query("format"))
+	if format == "" {
+		format = track.nativeSubtitleFormat()
+	}
+	contentType, ok := subtitleContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported subtitle format"})
+		return
+	}
+
+	etag := key.etag()
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=3600")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	data, err := m.extractSubtitleCached(file, key, track, format)
+	if err != nil {
+		logger.Error("Failed to extract subtitle track", "filePath", key.path, "track", number, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to extract subtitle: " + err.Error()})
+		return
+	}
+
+	name := strings.TrimSuffix(filepath.Base(key.path), filepath.Ext(key.path))
+	filename := name + "." + strconv.FormatUint(number, 10) + "." + format
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// extractSubtitleCached is extractSubtitle backed by the subtitle cache.
+func (m *mkvFile) extractSubtitleCached(file io.ReaderAt, key fileKey, track *mkvTrack, format string) ([]byte, error) {
+	cacheKey := subtitleCacheKey{file: key, track: track.Number, format: format}
+	cache := getSubtitleCache()
+	if data, ok := cache.Get(cacheKey); ok {
+		return data, nil
+	}
+
+	startTime := time.Now()
+	data, _, err := m.extractSubtitle(file, track, format)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Subtitle track extracted", "filePath", key.path, "track", track.Number, "format", format, "bytes", len(data), "elapsed", time.Since(startTime))
+	cache.Add(cacheKey, data)
+	return data, nil
+}
+
+// MkvAttachment serves an attached file of a Matroska file, such as a font,
+// identified by its uid query parameter. Range requests are supported.
+func MkvAttachment(c *gin.Context) {
+	uid, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment uid"})
+		return
+	}
+
+	file, m, key, ok := openMatroskaForRequest(c)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	attachment, ok := m.attachment(uid)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	serveAttachment(c, file, key, attachment)
+}
+
+// serveAttachment writes the data of attachment, read in place from file.
+func serveAttachment(c *gin.Context, file io.ReaderAt, key fileKey, attachment mkvAttachment) {
+	contentType := attachment.MediaType
+	if byExt, ok := GetMimeRegistry().Lookup(filepath.Ext(attachment.Name)); ok {
+		// Muxers commonly label fonts application/x-truetype-font or application/octet-stream.
+		if contentType == "" || strings.HasPrefix(byExt, "font/") {
+			contentType = byExt
+		}
+	}
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	c.Header("Cache-Control", "private, max-age=86400")
+	http.ServeContent(c.Writer, c.Request, attachment.Name, time.Unix(0, key.modTime),
+		io.NewSectionReader(file, attachment.dataOffset, attachment.Size))
+}
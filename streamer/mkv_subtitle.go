@@ -0,0 +1,299 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/subtitle"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSubtitleFrameDuration is used for subtitle frames stored without a duration
+// when the next frame does not bound them.
+const defaultSubtitleFrameDuration = 5 * time.Second
+
+var errNotTextSubtitle = errors.New("track is not a text subtitle track")
+
+// subtitleFrame is one subtitle event read from a Matroska track.
+type subtitleFrame struct {
+	start    time.Duration
+	duration time.Duration
+	data     []byte
+}
+
+// isTextSubtitle reports whether the track holds a text subtitle codec that can be extracted.
+func (t *mkvTrack) isTextSubtitle() bool {
+	switch t.CodecID {
+	case "S_TEXT/ASS", "S_TEXT/SSA", "S_ASS", "S_SSA", "S_TEXT/UTF8", "S_TEXT/ASCII", "S_TEXT/WEBVTT":
+		return true
+	}
+	return false
+}
+
+// isASS reports whether the track holds ASS or SSA subtitles.
+func (t *mkvTrack) isASS() bool {
+	switch t.CodecID {
+	case "S_TEXT/ASS", "S_TEXT/SSA", "S_ASS", "S_SSA":
+		return true
+	}
+	return false
+}
+
+// nativeSubtitleFormat returns the file format the track is naturally extracted to.
+func (t *mkvTrack) nativeSubtitleFormat() string {
+	switch {
+	case t.isASS():
+		return "ass"
+	case t.CodecID == "S_TEXT/WEBVTT":
+		return "vtt"
+	default:
+		return "srt"
+	}
+}
+
+// readSubtitleFrames collects every frame of a text subtitle track. When the
+// Cues index the track's blocks, only those blocks are read; otherwise the
+// clusters are scanned, skipping the payload of other tracks.
+func (m *mkvFile) readSubtitleFrames(r io.ReaderAt, track *mkvTrack) ([]subtitleFrame, error) {
+	if !track.isTextSubtitle() {
+		return nil, errNotTextSubtitle
+	}
+
+	startTime := time.Now()
+	blocks, usedCues := m.readCuedBlocks(r, track.Number)
+	if !usedCues {
+		if err := m.scanClusters(r, 0, map[uint64]bool{track.Number: true}, func(block mkvBlock) bool {
+			blocks = append(blocks, block)
+			return true
+		}); err != nil {
+			return nil, err
+		}
+	}
+	logger.Debug("Subtitle blocks read", "track", track.Number, "blocks", len(blocks), "usedCues", usedCues, "elapsed", time.Since(startTime))
+
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].timestamp < blocks[j].timestamp })
+
+	frames := make([]subtitleFrame, 0, len(blocks))
+	for _, block := range blocks {
+		if block.lacing != 0 {
+			logger.Warn("Skipping laced subtitle block", "track", track.Number)
+			continue
+		}
+		data, err := track.decodeFrame(block.data)
+		if err != nil {
+			logger.Warn("Skipping undecodable subtitle frame", "track", track.Number, "error", err)
+			continue
+		}
+		frame := subtitleFrame{start: m.timestampToDuration(block.timestamp), data: data}
+		if block.hasDuration {
+			frame.duration = m.timestampToDuration(int64(block.duration))
+		}
+		frames = append(frames, frame)
+	}
+
+	// Frames without a duration last until the next frame, within reason.
+	for i := range frames {
+		if frames[i].duration > 0 {
+			continue
+		}
+		frames[i].duration = defaultSubtitleFrameDuration
+		if i+1 < len(frames) {
+			if gap := frames[i+1].start - frames[i].start; gap > 0 && gap < defaultSubtitleFrameDuration {
+				frames[i].duration = gap
+			}
+		}
+	}
+	return frames, nil
+}
+
+// readCuedBlocks reads the blocks of track that the Cues point at directly.
+// It returns false when the Cues do not index the track precisely enough, in
+// which case the caller must scan the clusters.
+func (m *mkvFile) readCuedBlocks(r io.ReaderAt, track uint64) ([]mkvBlock, bool) {
+	type blockRef struct{ cluster, relative int64 }
+	var refs []blockRef
+	seen := make(map[blockRef]bool)
+	for _, cue := range m.cues {
+		for _, position := range cue.positions {
+			if position.track != track {
+				continue
+			}
+			if position.relativePosition < 0 {
+				return nil, false
+			}
+			ref := blockRef{position.clusterPosition, position.relativePosition}
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil, false
+	}
+
+	type clusterInfo struct {
+		element ebmlElement
+		time    int64
+	}
+	clusters := make(map[int64]clusterInfo)
+	blocks := make([]mkvBlock, 0, len(refs))
+	for _, ref := range refs {
+		info, ok := clusters[ref.cluster]
+		if !ok {
+			element, clusterTime, err := m.readClusterTimestamp(r, m.segmentOffset+ref.cluster)
+			if err != nil {
+				logger.Debug("Cue points at an unreadable cluster, falling back to scanning", "error", err)
+				return nil, false
+			}
+			info = clusterInfo{element: element, time: clusterTime}
+			clusters[ref.cluster] = info
+		}
+
+		e, err := readElementHeader(r, info.element.dataOffset+ref.relative)
+		if err != nil {
+			return nil, false
+		}
+		block, err := readBlock(r, e, info.time)
+		if err != nil || block.track != track {
+			logger.Debug("Cue does not point at a block of the track, falling back to scanning", "track", track)
+			return nil, false
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, true
+}
+
+// extractSubtitle renders a text subtitle track in format ("ass", "srt" or
+// "vtt"); an empty format selects the track's native format.
+func (m *mkvFile) extractSubtitle(r io.ReaderAt, track *mkvTrack, format string) ([]byte, string, error) {
+	if format == "" {
+		format = track.nativeSubtitleFormat()
+	}
+	if format == "ass" && !track.isASS() {
+		return nil, "", fmt.Errorf("track %d (%s) cannot be extracted as ASS", track.Number, track.CodecID)
+	}
+	if format != "ass" && format != "srt" && format != "vtt" {
+		return nil, "", subtitle.ErrUnsupportedFormat
+	}
+
+	frames, err := m.readSubtitleFrames(r, track)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var native []byte
+	switch {
+	case track.isASS():
+		native, err = m.buildASS(track, frames)
+	case track.CodecID == "S_TEXT/WEBVTT":
+		native, err = buildWebVTT(track, frames)
+	default:
+		native = buildSRT(frames)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == track.nativeSubtitleFormat() {
+		return native, format, nil
+	}
+	converted, err := subtitle.ToWebVTT(native, track.nativeSubtitleFormat(), "utf-8")
+	return converted, "vtt", err
+}
+
+// buildASS rebuilds a standalone ASS script from the track header and its
+// frames, which Matroska stores as "ReadOrder, Layer, Style, Name, MarginL,
+// MarginR, MarginV, Effect, Text" without timing.
+func (m *mkvFile) buildASS(track *mkvTrack, frames []subtitleFrame) ([]byte, error) {
+	header, err := track.decodedCodecPrivate()
+	if err != nil {
+		return nil, err
+	}
+	script := strings.TrimRight(strings.ReplaceAll(string(header), "\r\n", "\n"), "\n")
+	if !strings.Contains(script, "[Events]") {
+		script += "\n\n[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text"
+	}
+
+	type event struct {
+		order int
+		start time.Duration
+		line  string
+	}
+	events := make([]event, 0, len(frames))
+	for _, frame := range frames {
+		fields := strings.SplitN(string(frame.data), ",", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		order, _ := strconv.Atoi(strings.TrimSpace(fields[0]))
+		events = append(events, event{
+			order: order,
+			start: frame.start,
+			line: fmt.Sprintf("Dialogue: %s,%s,%s,%s", fields[1],
+				subtitle.FormatASSTimestamp(frame.start),
+				subtitle.FormatASSTimestamp(frame.start+frame.duration),
+				fields[2]),
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].order < events[j].order })
+
+	var b bytes.Buffer
+	b.WriteString(script)
+	b.WriteString("\n")
+	for _, e := range events {
+		b.WriteString(e.line)
+		b.WriteString("\n")
+	}
+	return b.Bytes(), nil
+}
+
+// buildSRT renders plain text frames as SubRip.
+func buildSRT(frames []subtitleFrame) []byte {
+	var b bytes.Buffer
+	index := 0
+	for _, frame := range frames {
+		text := strings.TrimSpace(strings.ReplaceAll(string(frame.data), "\r\n", "\n"))
+		if text == "" {
+			continue
+		}
+		index++
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", index,
+			srtTimestamp(frame.start), srtTimestamp(frame.start+frame.duration), text)
+	}
+	return b.Bytes()
+}
+
+// buildWebVTT renders WebVTT frames with the track header.
+func buildWebVTT(track *mkvTrack, frames []subtitleFrame) ([]byte, error) {
+	header, err := track.decodedCodecPrivate()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if len(header) > 0 {
+		b.Write(bytes.TrimRight(header, "\r\n"))
+	} else {
+		b.WriteString("WEBVTT")
+	}
+	b.WriteString("\n\n")
+	for _, frame := range frames {
+		text := strings.TrimSpace(string(frame.data))
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n",
+			subtitle.FormatTimestamp(frame.start), subtitle.FormatTimestamp(frame.start+frame.duration), text)
+	}
+	return b.Bytes(), nil
+}
+
+// srtTimestamp formats d as a SubRip timestamp (HH:MM:SS,mmm).
+func srtTimestamp(d time.Duration) string {
+	return strings.Replace(subtitle.FormatTimestamp(d), ".", ",", 1)
+}
@@ -0,0 +1,195 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// prewarmMinStreamed is the number of bytes a stream must have served before
+// it can trigger a prewarm, so that players reading an index at the end of a
+// file do not count as watching it.
+const prewarmMinStreamed = 16 * 1024 * 1024
+
+// maxPrewarmed bounds the number of prewarmed file versions remembered.
+const maxPrewarmed = 1024
+
+// maxConcurrentPrewarms bounds the number of files read at once. Prewarms
+// beyond it are skipped, since they are only an optimization.
+const maxConcurrentPrewarms = 2
+
+var (
+	prewarmSlots = make(chan struct{}, maxConcurrentPrewarms)
+
+	// prewarmed holds the file versions prewarmed recently, or being prewarmed.
+	prewarmed = newLRUCache[fileKey, bool](maxPrewarmed, func(bool) int64 { return 1 })
+)
+
+// prewarmTrigger watches the progress of a stream and prewarms the next file
+// of its directory once the stream passes the configured threshold. Reading
+// the start of the next episode ahead of time lets autoplay start from the
+// page cache or the block cache instead of cold storage.
+type prewarmTrigger struct {
+	filePath  string
+	threshold int64 // position in the file that triggers the prewarm
+	start     int64
+	fired     bool
+}
+
+// newPrewarmTrigger returns a trigger for a stream of file starting at
+// start, or nil when prewarming is disabled.
+func newPrewarmTrigger(file storage.File, start int64) *prewarmTrigger {
+	cfg := config.GetConfig()
+	if !cfg.PrewarmEnabled {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	return &prewarmTrigger{
+		filePath:  file.Name(),
+		threshold: int64(float64(info.Size()) * cfg.PrewarmThreshold),
+		start:     start,
+	}
+}
+
+// advance records that the stream has served the file up to position.
+func (t *prewarmTrigger) advance(position int64) {
+	if t == nil || t.fired || position < t.threshold || position-t.start < prewarmMinStreamed {
+		return
+	}
+	t.fired = true
+	go prewarmNext(t.filePath)
+}
+
+// prewarmNext reads the start of the file following filePath in its directory.
+func prewarmNext(filePath string) {
+	next, err := nextEpisode(filePath)
+	if err != nil {
+		logger.Debug("Cannot find the next file to prewarm", "filePath", filePath, "error", err)
+		return
+	}
+	if next == "" {
+		return
+	}
+	info, err := storage.Stat(next)
+	if err != nil {
+		return
+	}
+	key := newFileKey(next, info)
+	if _, ok := prewarmed.Get(key); ok {
+		return
+	}
+	select {
+	case prewarmSlots <- struct{}{}:
+		defer func() { <-prewarmSlots }()
+	default:
+		logger.Debug("Prewarm skipped, too many in progress", "filePath", next)
+		return
+	}
+	prewarmed.Add(key, true)
+
+	startTime := time.Now()
+	n, err := prewarmFile(next, config.GetConfig().PrewarmSize)
+	if err != nil {
+		logger.Warn("Failed to prewarm next file", "filePath", next, "error", err)
+		return
+	}
+	logger.Info("Prewarmed next file", "filePath", next, "after", filepath.Base(filePath), "bytes", n, "elapsed", time.Since(startTime))
+}
+
+// prewarmFile reads the first size bytes of the file at path and discards them.
+func prewarmFile(path string, size int64) (int64, error) {
+	file, err := storage.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	buffer := chunkPool.Get().([]byte)
+	defer chunkPool.Put(buffer)
+	return io.CopyBuffer(io.Discard, io.NewSectionReader(file, 0, size), buffer)
+}
+
+// nextEpisode returns the media file following filePath in its directory in
+// natural sort order, or an empty string when it is the last one.
+func nextEpisode(filePath string) (string, error) {
+	dir, name := filepath.Split(filePath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	next := ""
+	for _, entry := range entries {
+		candidate := entry.Name()
+		if !entry.Type().IsRegular() || !isVideoFile(candidate) {
+			continue
+		}
+		if naturalLess(name, candidate) && (next == "" || naturalLess(candidate, next)) {
+			next = candidate
+		}
+	}
+	if next == "" {
+		return "", nil
+	}
+	return filepath.Join(dir, next), nil
+}
+
+// isVideoFile reports whether name has the extension of a video container.
+func isVideoFile(name string) bool {
+	contentType, ok := GetMimeRegistry().Lookup(filepath.Ext(name))
+	return ok && strings.HasPrefix(contentType, "video/")
+}
+
+// naturalLess compares file names the way people number episodes: runs of
+// digits compare by value, so that "Episode 9" sorts before "Episode 10",
+// and letters compare case-insensitively.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numberA, restA := splitDigits(a)
+			numberB, restB := splitDigits(b)
+			trimmedA, trimmedB := strings.TrimLeft(numberA, "0"), strings.TrimLeft(numberB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) < len(trimmedB)
+			}
+			if trimmedA != trimmedB {
+				return trimmedA < trimmedB
+			}
+			if len(numberA) != len(numberB) {
+				// Equal values: fewer leading zeros first.
+				return len(numberA) < len(numberB)
+			}
+			a, b = restA, restB
+			continue
+		}
+		runeA, sizeA := utf8.DecodeRuneInString(a)
+		runeB, sizeB := utf8.DecodeRuneInString(b)
+		if foldA, foldB := unicode.ToLower(runeA), unicode.ToLower(runeB); foldA != foldB {
+			return foldA < foldB
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return len(a) < len(b)
+}
+
+// isDigit reports whether c is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigits splits the leading run of digits off s.
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,287 @@
+package streamer
+
+import (
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/mp4"
+	"PiliPili_Backend/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxCachedProbes bounds the number of probe results kept in memory.
+const maxCachedProbes = 1024
+
+// ProbeResult describes the container and tracks of a media file.
+type ProbeResult struct {
+	Container string       `json:"container"`
+	MimeType  string       `json:"mimeType"`
+	Size      int64        `json:"size"`
+	Duration  float64      `json:"duration"` // seconds
+	Bitrate   int64        `json:"bitrate"`  // bits per second
+	Title     string       `json:"title,omitempty"`
+	Tracks    []ProbeTrack `json:"tracks"`
+}
+
+// ProbeTrack describes one track of a media file.
+type ProbeTrack struct {
+	ID          uint64  `json:"id"` // MP4 track ID or Matroska track number
+	Type        string  `json:"type"`
+	Codec       string  `json:"codec"`
+	CodecString string  `json:"codecString,omitempty"` // RFC 6381, when known
+	Language    string  `json:"language,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	Default     bool    `json:"default"`
+	Forced      bool    `json:"forced"`
+	Width       uint64  `json:"width,omitempty"`
+	Height      uint64  `json:"height,omitempty"`
+	FrameRate   float64 `json:"frameRate,omitempty"`
+	SampleRate  float64 `json:"sampleRate,omitempty"`
+	Channels    uint64  `json:"channels,omitempty"`
+}
+
+// probeCache holds probe results keyed by file version.
+var probeCache = newLRUCache[fileKey, *ProbeResult](maxCachedProbes, func(*ProbeResult) int64 { return 1 })
+
+// ProbeFile reads the container headers of the MP4 or Matroska file at
+// filePath. Results are cached per file size and modification time.
+func ProbeFile(filePath string) (*ProbeResult, error) {
+	file, err := storage.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := newFileKey(filePath, fileInfo)
+	if result, ok := probeCache.Get(key); ok {
+		return result, nil
+	}
+
+	startTime := time.Now()
+	header := readHeader(file)
+	var result *ProbeResult
+	switch {
+	case len(header) >= 4 && string(header[:4]) == "\x1A\x45\xDF\xA3":
+		var m *mkvFile
+		if m, err = loadMatroska(file, key); err == nil {
+			result = probeMatroska(m)
+		}
+	case len(header) >= 8 && isMP4Brand(string(header[4:8])):
+		result, err = probeMP4(file, key.size, header)
+	default:
+		err = errUnsupportedContainer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.MimeType = GetMimeRegistry().DetectContentType(filepath.Base(filePath), header)
+	result.Size = key.size
+	if result.Duration > 0 {
+		result.Bitrate = int64(float64(key.size*8) / result.Duration)
+	}
+	logger.Debug("Media probed", "filePath", filePath, "container", result.Container, "tracks", len(result.Tracks), "elapsed", time.Since(startTime))
+	probeCache.Add(key, result)
+	return result, nil
+}
+
+// probeMatroska describes a parsed Matroska or WebM file.
+func probeMatroska(m *mkvFile) *ProbeResult {
+	result := &ProbeResult{Container: m.DocType, Duration: m.Duration.Seconds(), Title: m.Title, Tracks: []ProbeTrack{}}
+	for _, track := range m.Tracks {
+		t := ProbeTrack{
+			ID:          track.Number,
+			Type:        track.Type,
+			Codec:       mkvCodecName(track.CodecID),
+			CodecString: mkvCodecString(track),
+			Language:    track.Language,
+			Name:        track.Name,
+			Default:     track.Default,
+			Forced:      track.Forced,
+			Width:       track.Width,
+			Height:      track.Height,
+			SampleRate:  track.SampleRate,
+			Channels:    track.Channels,
+		}
+		if track.Type == "video" && track.defaultDuration > 0 {
+			t.FrameRate = roundFrameRate(float64(time.Second) / float64(track.defaultDuration))
+		}
+		result.Tracks = append(result.Tracks, t)
+	}
+	return result
+}
+
+// probeMP4 describes an MP4 or QuickTime file from its moov box.
+func probeMP4(r io.ReaderAt, size int64, header []byte) (*ProbeResult, error) {
+	movie, err := mp4.ReadMovie(r, size)
+	if err != nil {
+		return nil, err
+	}
+	result := &ProbeResult{Container: "mp4", Tracks: []ProbeTrack{}}
+	if len(header) >= 12 && string(header[4:12]) == "ftypqt  " {
+		result.Container = "mov"
+	}
+	if movie.Timescale > 0 {
+		result.Duration = float64(movie.Duration) / float64(movie.Timescale)
+	}
+
+	for _, track := range movie.Tracks {
+		t := ProbeTrack{
+			ID:       uint64(track.ID),
+			Codec:    mp4CodecName(track.Format),
+			Language: track.Language,
+		}
+		switch track.Handler {
+		case "vide":
+			t.Type, t.Width, t.Height = "video", uint64(track.Width), uint64(track.Height)
+			if track.Duration > 0 && len(track.Samples) > 0 {
+				t.FrameRate = roundFrameRate(float64(len(track.Samples)) * float64(track.Timescale) / float64(track.Duration))
+			}
+		case "soun":
+			t.Type = "audio"
+			t.SampleRate, t.Channels = mp4AudioFormat(track.SampleEntry)
+		case "sbtl", "subt", "text", "clcp":
+			t.Type = "subtitle"
+		default:
+			continue
+		}
+		if t.Type != "subtitle" {
+			t.CodecString = mp4.CodecString(track.SampleEntry)
+		}
+		if d := float64(track.Duration) / float64(track.Timescale); d > result.Duration {
+			result.Duration = d
+		}
+		result.Tracks = append(result.Tracks, t)
+	}
+	// The first track of each type plays by default.
+	seen := make(map[string]bool)
+	for i := range result.Tracks {
+		result.Tracks[i].Default = !seen[result.Tracks[i].Type]
+		seen[result.Tracks[i].Type] = true
+	}
+	return result, nil
+}
+
+// mp4AudioFormat reads the sample rate and channel count of an audio sample entry.
+func mp4AudioFormat(entry []byte) (float64, uint64) {
+	// Box header, reserved, data reference index, version fields, then channels, sample size, reserved and rate.
+	if len(entry) < 36 {
+		return 0, 0
+	}
+	channels := uint64(entry[24])<<8 | uint64(entry[25])
+	rate := float64(uint32(entry[32])<<8 | uint32(entry[33]))
+	return rate, channels
+}
+
+// roundFrameRate rounds a frame rate to three decimals, so that 24000/1001 reads as 23.976.
+func roundFrameRate(rate float64) float64 {
+	return math.Round(rate*1000) / 1000
+}
+
+// mkvCodecNames maps Matroska codec IDs to short codec names.
+var mkvCodecNames = map[string]string{
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+	"V_AV1":            "av1",
+	"V_VP8":            "vp8",
+	"V_VP9":            "vp9",
+	"V_MPEG2":          "mpeg2video",
+	"V_MPEG4/ISO/ASP":  "mpeg4",
+	"V_MS/VFW/FOURCC":  "vfw",
+	"A_AAC":            "aac",
+	"A_AC3":            "ac3",
+	"A_EAC3":           "eac3",
+	"A_DTS":            "dts",
+	"A_TRUEHD":         "truehd",
+	"A_FLAC":           "flac",
+	"A_OPUS":           "opus",
+	"A_VORBIS":         "vorbis",
+	"A_MPEG/L2":        "mp2",
+	"A_MPEG/L3":        "mp3",
+	"A_PCM/INT/LIT":    "pcm_s16le",
+	"A_PCM/INT/BIG":    "pcm_s16be",
+	"A_PCM/FLOAT/IEEE": "pcm_f32le",
+	"S_TEXT/UTF8":      "subrip",
+	"S_TEXT/ASS":       "ass",
+	"S_TEXT/SSA":       "ssa",
+	"S_ASS":            "ass",
+	"S_SSA":            "ssa",
+	"S_TEXT/WEBVTT":    "webvtt",
+	"S_HDMV/PGS":       "hdmv_pgs_subtitle",
+	"S_VOBSUB":         "dvd_subtitle",
+	"S_DVBSUB":         "dvb_subtitle",
+}
+
+// mkvCodecName returns the short name of a Matroska codec, or its ID when unknown.
+func mkvCodecName(codecID string) string {
+	if name, ok := mkvCodecNames[codecID]; ok {
+		return name
+	}
+	if strings.HasPrefix(codecID, "A_AAC") {
+		return "aac"
+	}
+	return codecID
+}
+
+// mp4CodecNames maps MP4 sample entry types to short codec names.
+var mp4CodecNames = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"dvh1": "hevc",
+	"dvhe": "hevc",
+	"av01": "av1",
+	"vp09": "vp9",
+	"mp4v": "mpeg4",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"alac": "alac",
+	".mp3": "mp3",
+	"tx3g": "mov_text",
+	"wvtt": "webvtt",
+	"stpp": "ttml",
+	"c608": "eia_608",
+}
+
+// mp4CodecName returns the short name of an MP4 sample entry type, or the type itself when unknown.
+func mp4CodecName(format string) string {
+	if name, ok := mp4CodecNames[format]; ok {
+		return name
+	}
+	return format
+}
+
+// Probe serves the container, duration, bitrate and tracks of a media file as JSON.
+func Probe(c *gin.Context) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	result, err := ProbeFile(filePath)
+	switch {
+	case err == nil:
+		c.Header("Cache-Control", "private, max-age=3600")
+		c.JSON(http.StatusOK, result)
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, errUnsupportedContainer), errors.Is(err, errNotMatroska), errors.Is(err, mp4.ErrNoMovie):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported container"})
+	default:
+		logger.Error("Failed to probe media", "filePath", filePath, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot probe media: " + err.Error()})
+	}
+}
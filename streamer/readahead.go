@@ -0,0 +1,291 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"sync"
+	"time"
+)
+
+// readAheadChunkSize is the size of the reads issued by a read-ahead.
+const readAheadChunkSize = 1024 * 1024
+
+// minReadAheadDepth is the smallest number of chunks kept ahead of the writer.
+const minReadAheadDepth = 2
+
+// chunkPool recycles read-ahead chunks.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, readAheadChunkSize)
+	},
+}
+
+// readAheadChunk is a chunk of the stream read ahead of the writer.
+type readAheadChunk struct {
+	buf  []byte
+	data []byte // unread part of buf
+}
+
+// readAhead reads a byte range of a file in a goroutine, keeping a bounded
+// ring of chunks ahead of the writer so that upstream stalls are absorbed
+// instead of reaching the client. The ring holds enough chunks for the
+// configured window at the throughput the client has been consuming,
+// within the configured memory bound.
+//
+// A read-ahead is stopped when the request is canceled, releasing its chunks
+// at once even if an upstream read is still in progress, and superseded when
+// the same viewer requests the same file again, which is how players seek.
+// A superseded read-ahead serves what it has buffered and then reads the
+// rest of its range directly.
+type readAhead struct {
+	file     io.ReaderAt
+	ctx      context.Context // request context
+	stop     context.CancelFunc
+	window   time.Duration
+	maxDepth int
+
+	notEmpty chan struct{}
+	notFull  chan struct{}
+	done     chan struct{} // closed when the producer has exited
+
+	mu      sync.Mutex
+	queue   []*readAheadChunk
+	depth   int
+	readErr error // error of the producer, returned once the queue is drained
+
+	offset, end int64 // next byte handed to the writer and end of the range
+	current     *readAheadChunk
+
+	// Client throughput, measured over the lifetime of the stream.
+	startTime time.Time
+	consumed  int64
+	stalls    int
+}
+
+// readAheads holds the active read-ahead of each viewer and file.
+var (
+	readAheadsMu sync.Mutex
+	readAheads   = make(map[string]*readAhead)
+)
+
+// viewerOf identifies the viewer of the stream served to c by its address
+// and the signed link it plays. Viewers behind one NAT or proxy play links
+// of their own and do not supersede each other's read-ahead, while a player
+// seeking requests its link again.
+func viewerOf(c *gin.Context) string {
+	viewer := c.ClientIP()
+	if session := streamSessionOf(c); session != nil {
+		viewer += "\x00" + session.signature
+	}
+	return viewer
+}
+
+// newReader returns a reader of [start, end] of file for a stream served to
+// viewer until ctx is done. It returns a section reader of file when
+// read-ahead is disabled.
+func newReader(ctx context.Context, viewer string, file storage.File, start, end int64) io.Reader {
+	cfg := config.GetConfig()
+	maxDepth := int(cfg.ReadAheadSize / readAheadChunkSize)
+	if cfg.ReadAheadWindow <= 0 || maxDepth < minReadAheadDepth {
+		return io.NewSectionReader(storage.WithContext(ctx, file), start, end-start+1)
+	}
+
+	produceCtx, stop := context.WithCancel(ctx)
+	r := &readAhead{
+		file:      file,
+		ctx:       ctx,
+		stop:      stop,
+		window:    cfg.ReadAheadWindow,
+		maxDepth:  maxDepth,
+		notEmpty:  make(chan struct{}, 1),
+		notFull:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		depth:     minReadAheadDepth,
+		offset:    start,
+		end:       end + 1,
+		startTime: time.Now(),
+	}
+
+	key := viewer + "\x00" + file.Name()
+	readAheadsMu.Lock()
+	if previous, ok := readAheads[key]; ok {
+		logger.Debug("Read-ahead superseded by a new request", "filePath", file.Name())
+		previous.stop()
+	}
+	readAheads[key] = r
+	readAheadsMu.Unlock()
+
+	go func() {
+		defer close(r.done)
+		r.produce(produceCtx, start)
+	}()
+	go func() {
+		<-ctx.Done()
+		stop()
+		readAheadsMu.Lock()
+		if readAheads[key] == r {
+			delete(readAheads, key)
+		}
+		readAheadsMu.Unlock()
+		r.release()
+	}()
+	return r
+}
+
+// produce fills the ring from offset until the end of the range, a read
+// error or ctx is done.
+func (r *readAhead) produce(ctx context.Context, offset int64) {
+	for offset < r.end {
+		r.mu.Lock()
+		for len(r.queue) >= r.depth {
+			r.mu.Unlock()
+			select {
+			case <-r.notFull:
+			case <-ctx.Done():
+				return
+			}
+			r.mu.Lock()
+		}
+		r.mu.Unlock()
+
+		buf := chunkPool.Get().([]byte)
+		n, err := storage.ReadAtContext(ctx, r.file, buf[:min(int64(len(buf)), r.end-offset)], offset)
+		if ctx.Err() != nil {
+			// The chunks were released while the read was in progress.
+			chunkPool.Put(buf)
+			return
+		}
+		if n > 0 {
+			r.mu.Lock()
+			r.queue = append(r.queue, &readAheadChunk{buf: buf, data: buf[:n]})
+			r.mu.Unlock()
+			signal(r.notEmpty)
+			offset += int64(n)
+		} else {
+			chunkPool.Put(buf)
+		}
+		if err != nil && (err != io.EOF || offset < r.end) {
+			r.mu.Lock()
+			r.readErr = err
+			r.mu.Unlock()
+			signal(r.notEmpty)
+			return
+		}
+	}
+}
+
+// signal wakes up the goroutine waiting on ch, if any.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read copies buffered bytes into p, waiting for the producer when the ring
+// is empty.
+func (r *readAhead) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+	if r.current == nil || len(r.current.data) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+		if r.current == nil {
+			// The read-ahead was superseded and has nothing buffered anymore.
+			n, err := storage.ReadAtContext(r.ctx, r.file, p[:min(int64(len(p)), r.end-r.offset)], r.offset)
+			r.offset += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+	}
+	n := copy(p, r.current.data)
+	r.current.data = r.current.data[n:]
+	r.offset += int64(n)
+	r.consumed += int64(n)
+	return n, nil
+}
+
+// next replaces the current chunk with the next buffered one. It leaves
+// current nil once a superseded producer has exited with an empty ring.
+func (r *readAhead) next() error {
+	if r.current != nil {
+		chunkPool.Put(r.current.buf)
+		r.current = nil
+	}
+	stalled := false
+	for {
+		r.mu.Lock()
+		if len(r.queue) > 0 {
+			r.current = r.queue[0]
+			r.queue[0] = nil
+			r.queue = r.queue[1:]
+			if stalled && r.consumed > 0 {
+				// The writer caught up with upstream, so keep more ahead.
+				r.stalls++
+				r.depth = min(r.depth+1, r.maxDepth)
+			} else {
+				r.adapt()
+			}
+			r.mu.Unlock()
+			signal(r.notFull)
+			return nil
+		}
+		readErr := r.readErr
+		r.mu.Unlock()
+		if readErr != nil {
+			return readErr
+		}
+
+		stalled = true
+		select {
+		case <-r.notEmpty:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-r.done:
+			// Chunks queued right before the producer exited are served first.
+			r.mu.Lock()
+			empty, readErr := len(r.queue) == 0, r.readErr
+			r.mu.Unlock()
+			if !empty || readErr != nil {
+				continue
+			}
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// adapt sizes the ring to hold the window at the client throughput, plus a
+// chunk for every stall seen so far. The caller must hold r.mu.
+func (r *readAhead) adapt() {
+	elapsed := time.Since(r.startTime)
+	if elapsed < time.Second {
+		return
+	}
+	rate := float64(r.consumed) / elapsed.Seconds()
+	depth := int(rate*r.window.Seconds()/readAheadChunkSize) + 1
+	r.depth = min(max(depth, minReadAheadDepth+r.stalls), r.maxDepth)
+}
+
+// release returns the buffered chunks to the pool once the request is done.
+func (r *readAhead) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, chunk := range r.queue {
+		chunkPool.Put(chunk.buf)
+	}
+	r.queue = nil
+	if r.stalls > 0 {
+		logger.Debug("Read-ahead finished", "stalls", r.stalls, "depth", r.depth, "consumed", r.consumed)
+	}
+}
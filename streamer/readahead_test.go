@@ -0,0 +1,215 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/storage"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// openFiles returns the number of open file descriptors of the process, or
+// -1 where they cannot be listed.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// activeReadAhead returns the only active read-ahead, or nil.
+func activeReadAhead(t *testing.T) *readAhead {
+	t.Helper()
+	readAheadsMu.Lock()
+	defer readAheadsMu.Unlock()
+	if len(readAheads) > 1 {
+		t.Fatalf("%d read-aheads active, want at most 1", len(readAheads))
+	}
+	for _, r := range readAheads {
+		return r
+	}
+	return nil
+}
+
+// newestReadAhead returns the active read-ahead started last.
+func newestReadAhead(t *testing.T) *readAhead {
+	t.Helper()
+	readAheadsMu.Lock()
+	defer readAheadsMu.Unlock()
+	var newest *readAhead
+	for _, r := range readAheads {
+		if newest == nil || r.startTime.After(newest.startTime) {
+			newest = r
+		}
+	}
+	if newest == nil {
+		t.Fatal("the stream is not read ahead")
+	}
+	return newest
+}
+
+// TestReadAheadStopsOnDisconnect checks that a client going away mid-body
+// stops the read-ahead and leaves no goroutine or file descriptor behind.
+func TestReadAheadStopsOnDisconnect(t *testing.T) {
+	path := writeMedia(t, "readahead.mkv", make([]byte, 48<<20))
+	r := gin.New()
+	r.Use(Drain())
+	r.GET("/stream", Remote)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	target := srv.URL + signedURL(t, "/stream", path, nil)
+
+	// A complete request first, so that the baseline includes whatever is
+	// started once per process.
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-1023")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	srv.Client().CloseIdleConnections()
+	waitFor(t, "the first request is done", func() bool { return ActiveStreamCount() == 0 && activeReadAhead(t) == nil })
+	goroutines, files := runtime.NumGoroutine(), openFiles()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	ring := activeReadAhead(t)
+	if ring == nil {
+		t.Fatal("the stream is not read ahead")
+	}
+
+	cancel()
+	resp.Body.Close()
+	waitFor(t, "the read-ahead producer exits", func() bool {
+		select {
+		case <-ring.done:
+			return true
+		default:
+			return false
+		}
+	})
+	waitFor(t, "the read-ahead is removed", func() bool { return activeReadAhead(t) == nil })
+	waitFor(t, "the stream ends", func() bool { return ActiveStreamCount() == 0 })
+	waitFor(t, "the goroutines of the stream exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+	if files >= 0 {
+		waitFor(t, "the file and connection are closed", func() bool { return openFiles() <= files })
+	}
+}
+
+// TestReadAheadSupersededPerViewer checks that viewers sharing an address do
+// not supersede each other's read-ahead, while a viewer requesting its link
+// again supersedes its own.
+func TestReadAheadSupersededPerViewer(t *testing.T) {
+	path := writeMedia(t, "viewers.mkv", make([]byte, 16<<20))
+	r := gin.New()
+	r.Use(Drain())
+	r.GET("/stream", Remote)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	// Links are signed once: signing again in another second makes another link.
+	links := map[string]string{
+		"first":  srv.URL + signedURLFor(t, "first", "/stream", path, nil),
+		"second": srv.URL + signedURLFor(t, "second", "/stream", path, nil),
+	}
+
+	// open starts a stream of the link of mediaId and returns its read-ahead.
+	open := func(mediaId string) *readAhead {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, links[mediaId], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			cancel()
+			resp.Body.Close()
+		})
+		if _, err := io.ReadFull(resp.Body, make([]byte, 1<<20)); err != nil {
+			t.Fatal(err)
+		}
+		return newestReadAhead(t)
+	}
+	stopped := func(r *readAhead) bool {
+		select {
+		case <-r.done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	first := open("first")
+	second := open("second")
+	if first == second || stopped(first) || stopped(second) {
+		t.Fatal("a viewer at the same address superseded the read-ahead of another")
+	}
+	again := open("first")
+	waitFor(t, "the read-ahead of the first request is superseded", func() bool { return stopped(first) })
+	if stopped(second) || stopped(again) {
+		t.Error("a viewer seeking superseded the read-ahead of another viewer")
+	}
+}
+
+// TestReaderWithoutReadAheadStopsWhenCanceled checks that the section reader
+// used when read-ahead is disabled stops once its request is canceled.
+func TestReaderWithoutReadAheadStopsWhenCanceled(t *testing.T) {
+	t.Setenv(config.EnvName("ReadAhead.window"), "0")
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv(config.EnvName("ReadAhead.window"))
+		if err := config.Reload(); err != nil {
+			t.Error(err)
+		}
+	})
+	file, err := storage.Open(filepath.Join(config.GetConfig().StorageBasePath, writeMedia(t, "direct.mkv", make([]byte, 1<<20))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := newReader(ctx, "viewer", file, 0, 1<<20-1)
+	if _, ok := reader.(*readAhead); ok {
+		t.Fatal("the stream is read ahead with read-ahead disabled")
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n, err := reader.Read(make([]byte, 1024)); !errors.Is(err, context.Canceled) {
+		t.Errorf("read after cancel = %d, %v, want %v", n, err, context.Canceled)
+	}
+}
@@ -0,0 +1,31 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"reflect"
+)
+
+// WatchConfig applies config reloads to the streamer. The MIME type
+// overrides are rebuilt and the signature key is replaced when its secret
+// source returns a new one; the other settings are read from the config on
+// every request, so new requests pick them up while streams in progress
+// keep their files open.
+func WatchConfig() {
+	config.Subscribe(func(old, cfg config.Config) {
+		if !reflect.DeepEqual(old.MimeTypes, cfg.MimeTypes) {
+			InitializeMimeTypes(cfg.MimeTypes)
+			logger.Info("MIME type overrides reloaded", "overrides", len(cfg.MimeTypes))
+		}
+		// The source is read on every reload, as it may return a new key
+		// while the setting naming it is unchanged.
+		if replaced, err := replaceSignature(cfg.Encipher); err != nil {
+			logger.Error("Failed to read the signature key, keeping the previous one", "error", err)
+		} else if replaced {
+			logger.Info("Signature key replaced, links signed with the previous key are refused from now on")
+		}
+		if old.StorageBasePath != cfg.StorageBasePath {
+			logger.Info("Storage base path changed", "from", old.StorageBasePath, "to", cfg.StorageBasePath)
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -31,6 +32,7 @@ func Remote(c *gin.Context) {
 		"itemId", itemId,
 		"mediaId", mediaId,
 		"expireAt", expireAtFormatted,
+		"clientIP", c.ClientIP(),
 	)
 
 	// File info
@@ -38,8 +40,37 @@ func Remote(c *gin.Context) {
 	Stream(c, filepath)
 }
 
+// authenticateRequest authenticates c with its signature query parameter and
+// returns the local path of the requested file. When it returns false the
+// error response has already been written.
+func authenticateRequest(c *gin.Context) (string, bool) {
+	signature := c.Query("signature")
+	path := c.Query("path")
+
+	itemId, mediaId, _, err := authenticate(c, signature)
+	if err != nil {
+		logger.Error("Authentication failed", "error", err)
+		return "", false
+	}
+	logger.Info("Authentication successful", "path", path, "itemId", itemId, "mediaId", mediaId, "clientIP", c.ClientIP())
+
+	return config.GetConfig().StorageBasePath + path, true
+}
+
+// signedQuery returns the path and signature query parameters of c, to build
+// URLs of related resources that authenticate like the request itself.
+func signedQuery(c *gin.Context) url.Values {
+	return url.Values{"path": {c.Query("path")}, "signature": {c.Query("signature")}}
+}
+
 // authenticate verifies the provided signature by decrypting and validating its contents.
 func authenticate(c *gin.Context, signature string) (itemId, mediaId string, expireAt time.Time, err error) {
+	defer func() {
+		if err != nil {
+			recordAuthFailure(c, err)
+		}
+	}()
+
 	sigInstance, initErr := GetSignatureInstance()
 	if initErr != nil {
 		logger.Error("Signature instance is not initialized", "error", initErr)
@@ -47,14 +78,20 @@ func authenticate(c *gin.Context, signature string) (itemId, mediaId string, exp
 		return "", "", time.Time{}, initErr
 	}
 
-	logger.Debug("Start decrypt signature: %s", signature)
-	data, decryptErr := sigInstance.Decrypt(signature)
+	logger.Debug("Start decrypt signature", "signature", signature)
+	data, key, decryptErr := sigInstance.Decrypt(signature)
 	if decryptErr != nil {
 		logger.Error("Failed to decrypt signature", "error", decryptErr)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
 		return "", "", time.Time{}, decryptErr
 	}
 
+	if isRevoked(key) {
+		logger.Error("Authentication failed: signature revoked")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Signature has been revoked"})
+		return "", "", time.Time{}, errors.New("signature revoked")
+	}
+
 	itemIdValue, itemIdExists := data["itemId"].(string)
 	mediaIdValue, mediaIdExists := data["mediaId"].(string)
 	expireAtValue, expireAtExists := data["expireAt"].(float64)
@@ -83,5 +120,13 @@ func authenticate(c *gin.Context, signature string) (itemId, mediaId string, exp
 		return "", "", time.Time{}, errors.New("signature has expired")
 	}
 
+	// Signatures may optionally be bound to the IP of the viewer they were issued for.
+	if boundIP, ok := data["ip"].(string); ok && boundIP != "" && boundIP != c.ClientIP() {
+		logger.Error("Authentication failed: signature bound to another IP", "boundIP", boundIP, "clientIP", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Signature is not valid for this client"})
+		return "", "", time.Time{}, errors.New("signature bound to another IP")
+	}
+
+	c.Set(authContextKey, authInfo{itemId: itemIdValue, mediaId: mediaIdValue, signature: key})
 	return itemIdValue, mediaIdValue, expireAt, nil
 }
@@ -0,0 +1,66 @@
+package streamer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// revokedSignatures holds the keys of revoked signatures until they expire,
+// after which they are refused anyway. Keys are those returned by Decrypt,
+// so that an encoding of a revoked signature other than the one revoked is
+// refused too.
+var (
+	revokedMu         sync.Mutex
+	revokedSignatures = make(map[string]time.Time)
+)
+
+// RevokeSignature refuses signature from now on and stops the streams using
+// it. It returns the number of streams stopped.
+func RevokeSignature(signature string) (int, error) {
+	sigInstance, err := GetSignatureInstance()
+	if err != nil {
+		return 0, err
+	}
+	data, key, err := sigInstance.Decrypt(signature)
+	if err != nil {
+		return 0, err
+	}
+	expireAtValue, ok := data["expireAt"].(float64)
+	if !ok {
+		return 0, errors.New("invalid signature structure")
+	}
+
+	now := time.Now()
+	revokedMu.Lock()
+	for revoked, expireAt := range revokedSignatures {
+		if expireAt.Before(now) {
+			delete(revokedSignatures, revoked)
+		}
+	}
+	revokedSignatures[key] = time.Unix(int64(expireAtValue), 0)
+	revokedMu.Unlock()
+	return killStreamsWithSignature(key), nil
+}
+
+// RevokedSignatureCount returns the number of revoked signatures not expired yet.
+func RevokedSignatureCount() int {
+	now := time.Now()
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+	count := 0
+	for _, expireAt := range revokedSignatures {
+		if expireAt.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// isRevoked reports whether the signature with the given key was revoked.
+func isRevoked(key string) bool {
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+	_, ok := revokedSignatures[key]
+	return ok
+}
@@ -0,0 +1,62 @@
+package streamer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRevokedSignatureReencoded checks that a revoked signature is refused
+// in any encoding, not only in the one it was revoked with.
+func TestRevokedSignatureReencoded(t *testing.T) {
+	signature, err := GetSignatureInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signature.Encrypt("item", "revoked", time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevokeSignature(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same payload with its keys in another order and spaces, and the
+	// original token wrapped like a MIME body.
+	payloadJson, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(payloadJson, &payload); err != nil {
+		t.Fatal(err)
+	}
+	reordered := `{ "signature": "` + payload["signature"] + `", "data": "` + payload["data"] + `" }`
+	tokens := map[string]string{
+		"original":  token,
+		"reordered": base64.StdEncoding.EncodeToString([]byte(reordered)),
+		"wrapped":   token[:16] + "\r\n" + token[16:],
+	}
+
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := signature.Decrypt(token); err != nil {
+				t.Fatalf("the re-encoded signature is invalid: %v", err)
+			}
+			w := serve(func(c *gin.Context) {
+				if _, ok := authenticateRequest(c); ok {
+					c.Status(http.StatusOK)
+				}
+			}, httptest.NewRequest(http.MethodGet, "/auth?"+url.Values{"path": {"revoked.mkv"}, "signature": {token}}.Encode(), nil))
+			if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "revoked") {
+				t.Errorf("got %d %s, want 401 for a revoked signature", w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package streamer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// authContextKey is the gin context key of the signature a request authenticated with.
+const authContextKey = "pilipili.auth"
+
+// sessionContextKey is the gin context key of the stream session of a request.
+const sessionContextKey = "pilipili.session"
+
+// authInfo describes the signature a request authenticated with.
+type authInfo struct {
+	itemId, mediaId string
+	signature       string // key of the signature returned by Decrypt
+}
+
+// StreamInfo describes an active stream.
+type StreamInfo struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"` // stream or transcode
+	Path       string    `json:"path"`
+	ItemID     string    `json:"itemId,omitempty"`
+	MediaID    string    `json:"mediaId,omitempty"`
+	ClientIP   string    `json:"clientIp"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Range      string    `json:"range,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	Bytes      int64     `json:"bytes"`
+	Throughput int64     `json:"throughput"` // bytes per second since the stream started
+}
+
+// streamSession is an active stream that can be listed and killed.
+type streamSession struct {
+	info      StreamInfo
+	signature string
+	bytes     atomic.Int64
+	cancel    context.CancelFunc
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*streamSession)
+
+	// bytesServed counts the bytes sent by every stream since startup.
+	bytesServed atomic.Int64
+)
+
+// registerStream registers the stream served to c and replaces the context
+// of its request with one canceled when the stream is killed. The returned
+// function unregisters the stream.
+func registerStream(c *gin.Context, kind, filePath string) func() {
+	var random [8]byte
+	rand.Read(random[:])
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+
+	session := &streamSession{
+		info: StreamInfo{
+			ID:        hex.EncodeToString(random[:]),
+			Kind:      kind,
+			Path:      filePath,
+			ClientIP:  c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Range:     c.GetHeader("Range"),
+			StartedAt: time.Now(),
+		},
+		cancel: cancel,
+	}
+	if auth, ok := c.Get(authContextKey); ok {
+		session.info.ItemID, session.info.MediaID = auth.(authInfo).itemId, auth.(authInfo).mediaId
+		session.signature = auth.(authInfo).signature
+	}
+	c.Set(sessionContextKey, session)
+
+	sessionsMu.Lock()
+	sessions[session.info.ID] = session
+	sessionsMu.Unlock()
+	return func() {
+		sessionsMu.Lock()
+		delete(sessions, session.info.ID)
+		sessionsMu.Unlock()
+		cancel()
+	}
+}
+
+// streamSessionOf returns the stream session of c, or nil.
+func streamSessionOf(c *gin.Context) *streamSession {
+	if session, ok := c.Get(sessionContextKey); ok {
+		return session.(*streamSession)
+	}
+	return nil
+}
+
+// addBytes records n bytes sent to the client.
+func (s *streamSession) addBytes(n int) {
+	if s != nil {
+		s.bytes.Add(int64(n))
+		bytesServed.Add(int64(n))
+	}
+}
+
+// BytesServed returns the number of bytes sent by every stream since startup.
+func BytesServed() int64 {
+	return bytesServed.Load()
+}
+
+// ActiveStreams returns the active streams, oldest first.
+func ActiveStreams() []StreamInfo {
+	sessionsMu.Lock()
+	streams := make([]StreamInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := session.info
+		info.Bytes = session.bytes.Load()
+		if elapsed := time.Since(info.StartedAt).Seconds(); elapsed > 0 {
+			info.Throughput = int64(float64(info.Bytes) / elapsed)
+		}
+		streams = append(streams, info)
+	}
+	sessionsMu.Unlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].StartedAt.Before(streams[j].StartedAt) })
+	return streams
+}
+
+// KillStream stops the stream with the given ID. It reports whether the stream existed.
+func KillStream(id string) bool {
+	sessionsMu.Lock()
+	session, ok := sessions[id]
+	sessionsMu.Unlock()
+	if ok {
+		session.cancel()
+	}
+	return ok
+}
+
+// killStreamsWithSignature stops the streams authenticated with the
+// signature whose key is given and returns their number.
+func killStreamsWithSignature(key string) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	killed := 0
+	for _, session := range sessions {
+		if session.signature == key {
+			session.cancel()
+			killed++
+		}
+	}
+	return killed
+}
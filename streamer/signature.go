@@ -2,57 +2,81 @@
 package streamer
 
 import (
+	"PiliPili_Backend/secret"
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"sync"
+	"sync/atomic"
 )
 
-var (
-	signatureInstance *Signature
-	once              sync.Once
-)
+// signatureInstance is replaced when the key is rotated through a config reload.
+var signatureInstance atomic.Pointer[Signature]
 
 // Signature provides methods for signing and verifying data using HMAC-SHA256.
 type Signature struct {
 	key []byte
 }
 
-// InitializeSignature initializes the global Signature instance with the provided AES key.
+// InitializeSignature initializes or replaces the global Signature instance
+// with the AES key encipher refers to, the Encipher setting. The key is read
+// from its secret source here and only kept by the Signature.
 // The key length must be 16 bytes for AES-128.
 func InitializeSignature(encipher string) error {
-	var initError error
-	once.Do(func() {
-		key := []byte(encipher)
-		if len(key) != 16 {
-			initError = errors.New("AES key must be 16 bytes long for AES-128")
-			return
-		}
-		signatureInstance = &Signature{key: key}
-	})
-	return initError
+	_, err := replaceSignature(encipher)
+	return err
+}
+
+// replaceSignature reads the key encipher refers to and installs it,
+// reporting whether it differs from the key in use.
+func replaceSignature(encipher string) (bool, error) {
+	resolved, err := secret.Resolve(encipher)
+	if err != nil {
+		return false, err
+	}
+	key := []byte(resolved)
+	if len(key) != 16 {
+		return false, errors.New("AES key must be 16 bytes long for AES-128")
+	}
+	previous := signatureInstance.Swap(&Signature{key: key})
+	return previous == nil || !bytes.Equal(previous.key, key), nil
 }
 
 // GetSignatureInstance returns the global Signature instance.
 func GetSignatureInstance() (*Signature, error) {
-	if signatureInstance == nil {
+	instance := signatureInstance.Load()
+	if instance == nil {
 		return nil, errors.New("signature instance is not initialized")
 	}
-	return signatureInstance, nil
+	return instance, nil
 }
 
 // Encrypt deterministically generates a signature for the given itemId, mediaId and expireAt using HMAC-SHA256.
 // Returns a base64-encoded ciphertext string.
 func (s *Signature) Encrypt(itemId, mediaId string, expireAt int64) (string, error) {
-	// Create a map with the input data
-	data := map[string]interface{}{
+	return s.encrypt(map[string]interface{}{
 		"itemId":   itemId,
 		"mediaId":  mediaId,
 		"expireAt": expireAt,
-	}
+	})
+}
+
+// EncryptForIP generates a signature like Encrypt that is additionally only
+// accepted from the given client IP.
+func (s *Signature) EncryptForIP(itemId, mediaId, clientIP string, expireAt int64) (string, error) {
+	return s.encrypt(map[string]interface{}{
+		"itemId":   itemId,
+		"mediaId":  mediaId,
+		"expireAt": expireAt,
+		"ip":       clientIP,
+	})
+}
 
+// encrypt signs data and returns the base64-encoded payload.
+func (s *Signature) encrypt(data map[string]interface{}) (string, error) {
 	// Serialize the data to JSON
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -81,28 +105,30 @@ func (s *Signature) Encrypt(itemId, mediaId string, expireAt int64) (string, err
 }
 
 // Decrypt verifies the provided base64-encoded signature using HMAC-SHA256.
-// Returns the original data as a map if the signature is valid.
-func (s *Signature) Decrypt(ciphertext string) (map[string]interface{}, error) {
+// Returns the original data as a map if the signature is valid, and the key
+// identifying the signature: the hex-encoded HMAC of its data, which is the
+// same for every encoding of the same signature.
+func (s *Signature) Decrypt(ciphertext string) (map[string]interface{}, string, error) {
 	// Decode the base64-encoded payload
 	payloadJson, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Parse the JSON payload
 	var payload map[string]string
 	if err := json.Unmarshal(payloadJson, &payload); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Decode the data and signature
 	jsonData, err := base64.StdEncoding.DecodeString(payload["data"])
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	signature, err := base64.StdEncoding.DecodeString(payload["signature"])
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Verify the HMAC-SHA256 signature
@@ -110,14 +136,14 @@ func (s *Signature) Decrypt(ciphertext string) (map[string]interface{}, error) {
 	h.Write(jsonData)
 	computedSignature := h.Sum(nil)
 	if !hmac.Equal(signature, computedSignature) {
-		return nil, errors.New("signature verification failed")
+		return nil, "", errors.New("signature verification failed")
 	}
 
 	// Parse the original data
 	var data map[string]interface{}
 	if err := json.Unmarshal(jsonData, &data); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return data, nil
+	return data, hex.EncodeToString(computedSignature), nil
 }
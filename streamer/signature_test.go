@@ -0,0 +1,66 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReloadRereadsSignatureSource checks that a reload reads the key from
+// its source again, so that it picks up a rotated key even though the
+// Encipher setting naming the source is unchanged.
+func TestReloadRereadsSignatureSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	writeKey := func(key string) {
+		if err := os.WriteFile(file, []byte(key+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func() string {
+		signature, err := GetSignatureInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := signature.Encrypt("item", "media", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	writeKey("aaaaaaaaaaaaaaaa")
+	t.Setenv(config.EnvName("Encipher"), "file:"+file)
+	t.Cleanup(func() {
+		os.Unsetenv(config.EnvName("Encipher"))
+		if err := config.Reload(); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	first := sign()
+
+	writeKey("bbbbbbbbbbbbbbbb")
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := sign()
+	if second == first {
+		t.Error("links are still signed with the previous key")
+	}
+
+	// A source that fails rejects the reload and leaves the key in use.
+	writeKey("short")
+	if err := config.Reload(); err == nil {
+		t.Error("a 5 byte key was accepted")
+	}
+	os.Remove(file)
+	if err := config.Reload(); err == nil {
+		t.Error("a missing key file was accepted")
+	}
+	if sign() != second {
+		t.Error("a failed reload replaced the key")
+	}
+}
@@ -0,0 +1,28 @@
+package streamer
+
+// CacheStats describes the usage of one in-memory cache.
+type CacheStats struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"` // bytes, or entries for caches bounded by count
+	MaxSize int64  `json:"maxSize"`
+}
+
+// cacheStats returns the usage of c.
+func cacheStats[K comparable, V any](name string, c *lruCache[K, V]) CacheStats {
+	return CacheStats{Name: name, Entries: c.Len(), Size: c.Size(), MaxSize: c.maxSize}
+}
+
+// CacheStatistics returns the usage of the in-memory caches of the streamer.
+func CacheStatistics() []CacheStats {
+	return []CacheStats{
+		cacheStats("subtitles", getSubtitleCache()),
+		cacheStats("fontSubsets", getFontSubsetCache()),
+		cacheStats("fontNames", fontNameCache),
+		cacheStats("faststart", getFaststartCache()),
+		cacheStats("matroska", mkvCache),
+		cacheStats("hls", hlsSourceCache),
+		cacheStats("dash", dashSourceCache),
+		cacheStats("probe", probeCache),
+	}
+}
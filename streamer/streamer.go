@@ -2,6 +2,7 @@ package streamer
 
 import (
 	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
@@ -29,6 +30,7 @@ func init() {
 
 func Stream(c *gin.Context, filePath string) {
 	startTime := time.Now()
+	defer registerStream(c, "stream", filePath)()
 	logger.Info("Starting file streaming", "filePath", filePath)
 
 	file, err := getFile(c, filePath)
@@ -48,23 +50,26 @@ func Stream(c *gin.Context, filePath string) {
 		return
 	}
 
+	file = faststartView(filePath, file, fileInfo)
+
 	fileSize := fileInfo.Size()
 	logger.Debug("File size retrieved", "filePath", filePath, "fileSize", fileSize, "elapsed", time.Since(startTime))
 
 	start, end := parseRangeHeader(c, fileSize)
+	contentType := getFileContentType(filePath, file, fileInfo)
 
 	if start == 0 && end == fileSize-1 {
 		logger.Info("Full file request", "filePath", filePath)
-		streamFullFile(c, file, fileInfo, start, end)
+		streamFullFile(c, file, fileInfo, contentType, start, end)
 	} else {
 		logger.Info("Partial file request", "filePath", filePath, "start", start, "end", end)
-		streamPartialFile(c, file, fileInfo, start, end)
+		streamPartialFile(c, file, fileInfo, contentType, start, end)
 	}
 }
 
-func getFile(c *gin.Context, filePath string) (*os.File, error) {
+func getFile(c *gin.Context, filePath string) (storage.File, error) {
 	startTime := time.Now()
-	file, err := os.Open(filePath)
+	file, err := storage.Open(filePath)
 	if err != nil {
 		c.AbortWithStatus(http.StatusNotFound)
 		return nil, err
@@ -73,7 +78,7 @@ func getFile(c *gin.Context, filePath string) (*os.File, error) {
 	return file, nil
 }
 
-func getFileInfo(c *gin.Context, file *os.File) (os.FileInfo, error) {
+func getFileInfo(c *gin.Context, file storage.File) (os.FileInfo, error) {
 	startTime := time.Now()
 	fileInfo, err := file.Stat()
 	if err != nil {
@@ -121,9 +126,8 @@ func parseRangeHeader(c *gin.Context, fileSize int64) (int64, int64) {
 	return start, end
 }
 
-func streamFullFile(c *gin.Context, file *os.File, fileInfo os.FileInfo, start, end int64) {
+func streamFullFile(c *gin.Context, file storage.File, fileInfo os.FileInfo, contentType string, start, end int64) {
 	fileSize := fileInfo.Size()
-	contentType := getFileContentType(fileInfo)
 
 	c.Writer.Header().Set("Content-Type", contentType)
 	c.Writer.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
@@ -147,9 +151,8 @@ func streamFullFile(c *gin.Context, file *os.File, fileInfo os.FileInfo, start,
 	streamFile(file, c, start, end)
 }
 
-func streamPartialFile(c *gin.Context, file *os.File, fileInfo os.FileInfo, start, end int64) {
+func streamPartialFile(c *gin.Context, file storage.File, fileInfo os.FileInfo, contentType string, start, end int64) {
 	fileSize := fileInfo.Size()
-	contentType := getFileContentType(fileInfo)
 	contentLength := end - start + 1
 
 	c.Writer.Header().Set("Content-Type", contentType)
@@ -171,7 +174,7 @@ func streamPartialFile(c *gin.Context, file *os.File, fileInfo os.FileInfo, star
 	streamFile(file, c, start, end)
 }
 
-func streamFile(file *os.File, c *gin.Context, start, end int64) {
+func streamFile(file storage.File, c *gin.Context, start, end int64) {
 	startTime := time.Now()
 	// Use smaller buffer for initial chunk to speed up first response
 	bufferSize := 1 * 1024 // 256KB for initial chunk
@@ -188,20 +191,21 @@ func streamFile(file *os.File, c *gin.Context, start, end int64) {
 	logger.Debug("Buffer acquired", "size", bufferSize, "elapsed", time.Since(bufferGetTime))
 	defer bufferPool.Put(buffer)
 
-	// Seek to the start position
-	seekStartTime := time.Now()
-	if _, err := file.Seek(start, io.SeekStart); err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		logger.Error("Error seeking file", "start", start, "error", err, "elapsed", time.Since(seekStartTime))
-		return
-	}
-	logger.Debug("Seek completed", "start", start, "elapsed", time.Since(seekStartTime))
+	// Read only the requested range of the file, ahead of the client
+	reader := newReader(c.Request.Context(), viewerOf(c), file, start, end)
+	prewarm := newPrewarmTrigger(file, start)
 
 	totalBytes := end - start + 1
 	writtenBytes := int64(0)
 	chunkCount := 0
 
+	ctx := c.Request.Context()
+	session := streamSessionOf(c)
 	for totalBytes > 0 {
+		if ctx.Err() != nil {
+			logger.Info("Client connection lost", "chunk", chunkCount, "writtenBytes", writtenBytes)
+			return
+		}
 		chunkStartTime := time.Now()
 		chunkCount++
 		readSize := int64(len(buffer))
@@ -211,12 +215,16 @@ func streamFile(file *os.File, c *gin.Context, start, end int64) {
 
 		// Read from file
 		readStartTime := time.Now()
-		n, err := file.Read(buffer[:readSize])
+		n, err := reader.Read(buffer[:readSize])
 		if err != nil {
 			if err == io.EOF {
 				logger.Debug("Read EOF", "chunk", chunkCount, "elapsed", time.Since(readStartTime))
 				break
 			}
+			if ctx.Err() != nil {
+				logger.Info("Client connection lost", "chunk", chunkCount, "writtenBytes", writtenBytes)
+				return
+			}
 			c.AbortWithStatus(http.StatusInternalServerError)
 			logger.Error("Error reading file", "error", err, "chunk", chunkCount, "elapsed", time.Since(readStartTime))
 			return
@@ -238,6 +246,8 @@ func streamFile(file *os.File, c *gin.Context, start, end int64) {
 
 		writtenBytes += int64(n)
 		totalBytes -= int64(n)
+		session.addBytes(n)
+		prewarm.advance(start + writtenBytes)
 
 		// Flush strategically
 		flushStartTime := time.Now()
@@ -257,46 +267,8 @@ func streamFile(file *os.File, c *gin.Context, start, end int64) {
 	logger.Info("File streaming completed", "start", start, "end", end, "totalBytes", end-start+1, "totalElapsed", time.Since(startTime))
 }
 
-func getFileContentType(fileInfo os.FileInfo) string {
-	name := strings.ToLower(fileInfo.Name())
-	switch {
-	case strings.HasSuffix(name, ".mp4"):
-		return "video/mp4"
-	case strings.HasSuffix(name, ".mkv"):
-		return "video/x-matroska"
-	case strings.HasSuffix(name, ".avi"):
-		return "video/x-msvideo"
-	case strings.HasSuffix(name, ".mov"):
-		return "video/quicktime"
-	case strings.HasSuffix(name, ".flv"):
-		return "video/x-flv"
-	case strings.HasSuffix(name, ".rmvb"):
-		return "application/vnd.rn-realmedia-vbr"
-	case strings.HasSuffix(name, ".rm"):
-		return "application/vnd.rn-realmedia"
-	case strings.HasSuffix(name, ".mka"):
-		return "audio/x-matroska"
-	case strings.HasSuffix(name, ".aac"):
-		return "audio/aac"
-	case strings.HasSuffix(name, ".mp3"):
-		return "audio/mpeg"
-	case strings.HasSuffix(name, ".wav"):
-		return "audio/wav"
-	case strings.HasSuffix(name, ".ogg"):
-		return "audio/ogg"
-	case strings.HasSuffix(name, ".srt"):
-		return "application/x-subrip"
-	case strings.HasSuffix(name, ".vtt"):
-		return "text/vtt"
-	case strings.HasSuffix(name, ".ass"):
-		return "text/x-ssa"
-	case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
-		return "image/jpeg"
-	case strings.HasSuffix(name, ".png"):
-		return "image/png"
-	case strings.HasSuffix(name, ".gif"):
-		return "image/gif"
-	default:
-		return "application/octet-stream"
-	}
+// getFileContentType resolves the content type of file from its name and
+// leading bytes, which are only read on the first request for its version.
+func getFileContentType(filePath string, file io.ReaderAt, fileInfo os.FileInfo) string {
+	return GetMimeRegistry().DetectFileContentType(newFileKey(filePath, fileInfo), file)
 }
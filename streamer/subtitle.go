@@ -0,0 +1,108 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/subtitle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxSubtitleSize bounds the size of subtitle files converted in memory.
+const maxSubtitleSize = 32 * 1024 * 1024
+
+// subtitleCacheKey identifies a converted or extracted subtitle.
+type subtitleCacheKey struct {
+	file    fileKey
+	charset string
+	track   uint64 // Matroska track number, 0 for external subtitle files
+	format  string
+}
+
+var (
+	subtitleCache     *lruCache[subtitleCacheKey, []byte]
+	subtitleCacheOnce sync.Once
+)
+
+// getSubtitleCache returns the cache of converted subtitles, sized from the config on first use.
+func getSubtitleCache() *lruCache[subtitleCacheKey, []byte] {
+	subtitleCacheOnce.Do(func() {
+		subtitleCache = newLRUCache[subtitleCacheKey, []byte](config.GetConfig().SubtitleCacheSize, func(data []byte) int64 {
+			return int64(len(data))
+		})
+	})
+	return subtitleCache
+}
+
+// Subtitle serves an external SRT, ASS/SSA or WebVTT subtitle converted to
+// UTF-8 WebVTT. It is authenticated with the same signature as Remote; the
+// optional charset query parameter overrides encoding detection.
+func Subtitle(c *gin.Context) {
+	charset := strings.ToLower(c.Query("charset"))
+
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+	logger.Info("Subtitle conversion requested", "filePath", filePath, "format", format)
+
+	switch format {
+	case "srt", "ass", "ssa", "vtt":
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported subtitle format"})
+		return
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil || fileInfo.IsDir() {
+		logger.Error("Subtitle file not found", "filePath", filePath, "error", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle not found"})
+		return
+	}
+	if fileInfo.Size() > maxSubtitleSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Subtitle file is too large"})
+		return
+	}
+
+	key := subtitleCacheKey{file: newFileKey(filePath, fileInfo), charset: charset}
+	etag := key.file.etag()
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=3600")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	cache := getSubtitleCache()
+	vtt, ok := cache.Get(key)
+	if !ok {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			logger.Error("Failed to read subtitle", "filePath", filePath, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read subtitle"})
+			return
+		}
+
+		vtt, err = subtitle.ToWebVTT(data, format, charset)
+		if err != nil {
+			logger.Error("Failed to convert subtitle", "filePath", filePath, "error", err)
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, subtitle.ErrUnsupportedFormat) {
+				status = http.StatusUnsupportedMediaType
+			}
+			c.JSON(status, gin.H{"error": "Failed to convert subtitle: " + err.Error()})
+			return
+		}
+		cache.Add(key, vtt)
+	}
+
+	logger.Debug("Serving converted subtitle", "filePath", filePath, "bytes", len(vtt), "cached", ok)
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", vtt)
+}
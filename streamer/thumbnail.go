@@ -0,0 +1,268 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thumbnailTimeout bounds the extraction of a single thumbnail.
+const thumbnailTimeout = 30 * time.Second
+
+// Bounds of the width query parameter of thumbnails.
+const (
+	minThumbnailWidth = 32
+	maxThumbnailWidth = 1920
+)
+
+var errFFmpegUnavailable = errors.New("ffmpeg is not available")
+
+// frameExtractor decodes keyframes of a video into JPEG images.
+type frameExtractor interface {
+	// thumbnail returns the keyframe at or before at, scaled to width.
+	thumbnail(ctx context.Context, input string, at time.Duration, width int) ([]byte, error)
+	// trickplay writes a keyframe every interval, scaled to width, into dir
+	// as numbered files starting at 00001.jpg.
+	trickplay(ctx context.Context, input string, interval time.Duration, width int, dir string) error
+}
+
+// extractor is the frame extractor used by the thumbnail endpoints. Tests
+// replace it with a stand-in that does not need ffmpeg.
+var extractor frameExtractor = ffmpegExtractor{}
+
+// ffmpegExtractor runs the configured ffmpeg binary. The decoder skips
+// every frame but keyframes, which keeps extraction cheap on long videos.
+type ffmpegExtractor struct{}
+
+// ffmpegSlots bounds the number of concurrent ffmpeg processes.
+var (
+	ffmpegSlots     chan struct{}
+	ffmpegSlotsOnce sync.Once
+)
+
+// acquireFFmpeg waits for a free ffmpeg slot, sized from the configuration.
+func acquireFFmpeg(ctx context.Context) (func(), error) {
+	ffmpegSlotsOnce.Do(func() {
+		ffmpegSlots = make(chan struct{}, max(config.GetConfig().ThumbnailConcurrency, 1))
+	})
+	select {
+	case ffmpegSlots <- struct{}{}:
+		return func() { <-ffmpegSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ffmpegPath returns the path of the ffmpeg binary.
+func ffmpegPath() (string, error) {
+	name := config.GetConfig().FFmpegPath
+	if name == "" {
+		name = "ffmpeg"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errFFmpegUnavailable, err)
+	}
+	return path, nil
+}
+
+// run executes ffmpeg with args and returns its standard output.
+func (ffmpegExtractor) run(ctx context.Context, args ...string) ([]byte, error) {
+	path, err := ffmpegPath()
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquireFFmpeg(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, append([]string{"-hide_banner", "-loglevel", "error", "-nostdin"}, args...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (f ffmpegExtractor) thumbnail(ctx context.Context, input string, at time.Duration, width int) ([]byte, error) {
+	image, err := f.run(ctx,
+		"-skip_frame", "nokey", "-noaccurate_seek", "-ss", formatSeconds(at), "-i", input,
+		"-an", "-sn", "-dn", "-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", width),
+		"-q:v", "3", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	if err == nil && len(image) == 0 {
+		err = errors.New("ffmpeg returned no frame")
+	}
+	return image, err
+}
+
+func (f ffmpegExtractor) trickplay(ctx context.Context, input string, interval time.Duration, width int, dir string) error {
+	_, err := f.run(ctx,
+		"-skip_frame", "nokey", "-i", input,
+		"-an", "-sn", "-dn", "-vf", fmt.Sprintf("fps=1/%s,scale=%d:-2", formatSeconds(interval), width),
+		"-q:v", "5", "-f", "image2", filepath.Join(dir, "%05d.jpg"))
+	return err
+}
+
+// formatSeconds formats d as fractional seconds for ffmpeg.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// thumbnailCacheDirectory returns the directory of cached images.
+func thumbnailCacheDirectory() string {
+	if dir := config.GetConfig().ThumbnailCacheDirectory; dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "pilipili-thumbnails")
+}
+
+// thumbnailDirectoryMu serializes the creation of cache directories, so that
+// a new version is never removed as stale by a concurrent request.
+var thumbnailDirectoryMu sync.Mutex
+
+// thumbnailDirectory returns the cache directory of one file version,
+// creating it if needed. Directories of older versions of the same file
+// are removed when a new version is first seen.
+func thumbnailDirectory(key fileKey) (string, error) {
+	thumbnailDirectoryMu.Lock()
+	defer thumbnailDirectoryMu.Unlock()
+
+	parent := filepath.Join(thumbnailCacheDirectory(), fmt.Sprintf("%x", sha1.Sum([]byte(key.path))))
+	dir := filepath.Join(parent, fmt.Sprintf("%x-%x", key.modTime, key.size))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	if entries, err := os.ReadDir(parent); err == nil {
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(parent, entry.Name())); err != nil {
+				logger.Warn("Failed to remove stale thumbnails", "dir", entry.Name(), "error", err)
+			}
+		}
+	}
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that
+// concurrent readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// openThumbnailSource authenticates c and stats the requested media file.
+// When it returns false the error response has already been written.
+func openThumbnailSource(c *gin.Context) (string, fileKey, bool) {
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return "", fileKey{}, false
+	}
+	fileInfo, err := storage.Stat(filePath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return "", fileKey{}, false
+	}
+	return filePath, newFileKey(filePath, fileInfo), true
+}
+
+// writeExtractionError maps a frame extraction error to a response.
+func writeExtractionError(c *gin.Context, filePath string, err error) {
+	switch {
+	case errors.Is(err, errFFmpegUnavailable):
+		logger.Error("Thumbnail requested but ffmpeg is unavailable", "error", err)
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Thumbnail extraction is not available"})
+	case errors.Is(err, context.Canceled):
+		logger.Debug("Thumbnail extraction canceled", "filePath", filePath)
+	default:
+		logger.Error("Failed to extract thumbnails", "filePath", filePath, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot extract thumbnails"})
+	}
+}
+
+// Thumbnail serves a JPEG of the keyframe at or before the t query
+// parameter, in seconds, scaled to the optional width parameter.
+func Thumbnail(c *gin.Context) {
+	filePath, key, ok := openThumbnailSource(c)
+	if !ok {
+		return
+	}
+
+	seconds, err := strconv.ParseFloat(c.DefaultQuery("t", "0"), 64)
+	if err != nil || seconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timestamp"})
+		return
+	}
+	width := config.GetConfig().ThumbnailWidth
+	if value := c.Query("width"); value != "" {
+		if width, err = strconv.Atoi(value); err != nil || width < minThumbnailWidth || width > maxThumbnailWidth {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid width"})
+			return
+		}
+	}
+	at := time.Duration(seconds * float64(time.Second)).Truncate(time.Millisecond)
+
+	etag := fmt.Sprintf(`"%x-%x-%x-%x"`, key.modTime, key.size, at.Milliseconds(), width)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=86400")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	dir, err := thumbnailDirectory(key)
+	if err != nil {
+		logger.Error("Failed to create thumbnail cache directory", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	cached := filepath.Join(dir, fmt.Sprintf("thumb-%d-%d.jpg", at.Milliseconds(), width))
+	if image, err := os.ReadFile(cached); err == nil {
+		c.Data(http.StatusOK, "image/jpeg", image)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), thumbnailTimeout)
+	defer cancel()
+	startTime := time.Now()
+	image, err := extractor.thumbnail(ctx, filePath, at, width)
+	if err != nil {
+		writeExtractionError(c, filePath, err)
+		return
+	}
+	logger.Info("Thumbnail extracted", "filePath", filePath, "at", at, "width", width, "elapsed", time.Since(startTime))
+	if err := writeFileAtomic(cached, image); err != nil {
+		logger.Warn("Failed to cache thumbnail", "error", err)
+	}
+	c.Data(http.StatusOK, "image/jpeg", image)
+}
@@ -0,0 +1,197 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubExtractor stands in for ffmpeg, producing solid-colored frames.
+type stubExtractor struct {
+	frames int // number of trickplay images
+	calls  atomic.Int32
+}
+
+// encodeFrame returns a JPEG of a frame of the given size.
+func encodeFrame(width, height int, shade uint8) []byte {
+	frame := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range frame.Pix {
+		frame.Pix[i] = shade
+	}
+	var b bytes.Buffer
+	jpeg.Encode(&b, frame, nil)
+	return b.Bytes()
+}
+
+func (s *stubExtractor) thumbnail(ctx context.Context, input string, at time.Duration, width int) ([]byte, error) {
+	s.calls.Add(1)
+	return encodeFrame(width, width*9/16, uint8(at/time.Second)), nil
+}
+
+func (s *stubExtractor) trickplay(ctx context.Context, input string, interval time.Duration, width int, dir string) error {
+	s.calls.Add(1)
+	for i := 1; i <= s.frames; i++ {
+		frame := encodeFrame(width, width*9/16, uint8(i*40))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%05d.jpg", i)), frame, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useExtractor replaces the frame extractor for the duration of the test.
+func useExtractor(t *testing.T, e frameExtractor) {
+	previous := extractor
+	extractor = e
+	t.Cleanup(func() { extractor = previous })
+}
+
+func TestThumbnail(t *testing.T) {
+	stub := &stubExtractor{}
+	useExtractor(t, stub)
+	path := writeMedia(t, "thumbnail.mkv", []byte("video"))
+
+	target := signedURL(t, "/thumbnail", path, url.Values{"t": {"12.5"}, "width": {"160"}})
+	w := serve(Thumbnail, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("got %d %s, want 200 image/jpeg", w.Code, w.Header().Get("Content-Type"))
+	}
+	frame, err := jpeg.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Width != 160 {
+		t.Errorf("thumbnail is %d pixels wide, want 160", frame.Width)
+	}
+
+	// The second request is served from the cache, the third is not modified.
+	w = serve(Thumbnail, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK || stub.calls.Load() != 1 {
+		t.Errorf("cached thumbnail: got %d after %d extractions, want 200 after 1", w.Code, stub.calls.Load())
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	if w = serve(Thumbnail, req); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d, want 304", w.Code)
+	}
+
+	w = serve(Thumbnail, httptest.NewRequest(http.MethodGet, signedURL(t, "/thumbnail", path, url.Values{"width": {"8"}}), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("width 8: got %d, want 400", w.Code)
+	}
+	w = serve(Thumbnail, httptest.NewRequest(http.MethodGet, "/thumbnail?path="+path, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: got %d, want 401", w.Code)
+	}
+}
+
+func TestTrickplayBIF(t *testing.T) {
+	stub := &stubExtractor{frames: 3}
+	useExtractor(t, stub)
+	path := writeMedia(t, "bif.mkv", []byte("video"))
+
+	w := serve(TrickplayBIF, httptest.NewRequest(http.MethodGet, signedURL(t, "/trickplay/index.bif", path, nil), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	bif := w.Body.Bytes()
+	if !bytes.HasPrefix(bif, bifMagic) {
+		t.Fatalf("missing BIF magic: % x", bif[:min(len(bif), 8)])
+	}
+	if count := binary.LittleEndian.Uint32(bif[12:]); count != 3 {
+		t.Errorf("BIF holds %d images, want 3", count)
+	}
+	if interval := binary.LittleEndian.Uint32(bif[16:]); interval != 10000 {
+		t.Errorf("BIF interval is %d ms, want 10000", interval)
+	}
+
+	// The index lists each image and ends with 0xFFFFFFFF and the end offset.
+	for i := 0; i < 3; i++ {
+		entry := bif[64+8*i:]
+		start, end := binary.LittleEndian.Uint32(entry[4:]), binary.LittleEndian.Uint32(entry[12:])
+		if index := binary.LittleEndian.Uint32(entry); index != uint32(i) {
+			t.Errorf("entry %d has index %d", i, index)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(bif[start:end])); err != nil {
+			t.Errorf("image %d: %v", i, err)
+		}
+	}
+	if last := binary.LittleEndian.Uint32(bif[64+8*3:]); last != 0xFFFFFFFF {
+		t.Errorf("index ends with %#x, want 0xFFFFFFFF", last)
+	}
+	if end := binary.LittleEndian.Uint32(bif[64+8*3+4:]); int(end) != len(bif) {
+		t.Errorf("index ends at %d, file is %d bytes", end, len(bif))
+	}
+
+	// Images are extracted once per file version.
+	serve(TrickplayBIF, httptest.NewRequest(http.MethodGet, signedURL(t, "/trickplay/index.bif", path, nil), nil))
+	if calls := stub.calls.Load(); calls != 1 {
+		t.Errorf("trickplay images extracted %d times, want 1", calls)
+	}
+}
+
+func TestTrickplaySprites(t *testing.T) {
+	useExtractor(t, &stubExtractor{frames: 5})
+	path := writeMedia(t, "sprites.mkv", []byte("video"))
+
+	w := serve(TrickplaySprites, httptest.NewRequest(http.MethodGet, signedURL(t, "/trickplay/sprites.vtt", path, nil), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	vtt := w.Body.String()
+	if !strings.HasPrefix(vtt, "WEBVTT\n") || strings.Count(vtt, " --> ") != 5 {
+		t.Fatalf("expected 5 cues:\n%s", vtt)
+	}
+	// With 2x2 sheets, the fifth image is the first tile of the second sheet.
+	width, height := 320, 180
+	for _, want := range []string{
+		"00:00:00.000 --> 00:00:10.000",
+		"sheet=0",
+		fmt.Sprintf("#xywh=%d,%d,%d,%d", width, height, width, height),
+		"00:00:40.000 --> 00:00:50.000",
+		"sheet=1",
+	} {
+		if !strings.Contains(vtt, want) {
+			t.Errorf("sprites.vtt does not contain %q:\n%s", want, vtt)
+		}
+	}
+
+	for sheet, rows := range []int{2, 1} {
+		w := serve(TrickplaySprite, httptest.NewRequest(http.MethodGet, signedURL(t, "/trickplay/sprite.jpg", path, url.Values{"sheet": {fmt.Sprint(sheet)}}), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("sheet %d: got %d: %s", sheet, w.Code, w.Body)
+		}
+		sprite, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("sheet %d: %v", sheet, err)
+		}
+		if size := sprite.Bounds().Size(); size != image.Pt(2*width, rows*height) {
+			t.Errorf("sheet %d is %v, want %dx%d", sheet, size, 2*width, rows*height)
+		}
+		// Tiles keep the order of the images: the first tile of the first sheet is the darkest.
+		if sheet == 0 {
+			first, second := color.GrayModel.Convert(sprite.At(10, 10)).(color.Gray), color.GrayModel.Convert(sprite.At(width+10, 10)).(color.Gray)
+			if first.Y >= second.Y {
+				t.Errorf("tiles out of order: first tile %d, second tile %d", first.Y, second.Y)
+			}
+		}
+	}
+
+	w = serve(TrickplaySprite, httptest.NewRequest(http.MethodGet, signedURL(t, "/trickplay/sprite.jpg", path, url.Values{"sheet": {"2"}}), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("sheet 2: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,469 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/storage"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcodeWaitDelay bounds the wait for ffmpeg output pipes once the process was killed.
+const transcodeWaitDelay = 5 * time.Second
+
+// transcodePlaylistTimeout bounds the wait for the first HLS segment of a new session.
+const transcodePlaylistTimeout = 30 * time.Second
+
+// transcodeProfile describes the output of a software transcode.
+type transcodeProfile struct {
+	maxHeight    int    // 0 keeps the source height
+	videoBitrate string // peak video bitrate
+	audioBitrate string
+	copyVideo    bool // pass the video through and only convert the audio
+}
+
+// transcodeProfiles are the profiles clients can select with the profile query parameter.
+var transcodeProfiles = map[string]transcodeProfile{
+	"1080p": {maxHeight: 1080, videoBitrate: "8M", audioBitrate: "192k"},
+	"720p":  {maxHeight: 720, videoBitrate: "4M", audioBitrate: "160k"},
+	"480p":  {maxHeight: 480, videoBitrate: "1500k", audioBitrate: "128k"},
+	"audio": {copyVideo: true, audioBitrate: "192k"},
+}
+
+// defaultTranscodeProfile is used when the profile query parameter is absent.
+const defaultTranscodeProfile = "1080p"
+
+// transcodeSlots bounds the number of concurrent transcodes.
+var (
+	transcodeSlots     chan struct{}
+	transcodeSlotsOnce sync.Once
+)
+
+// tryAcquireTranscode takes a transcode slot without waiting. A transcode is
+// refused rather than queued, since a client would rather fall back than stall.
+func tryAcquireTranscode() (func(), bool) {
+	transcodeSlotsOnce.Do(func() {
+		transcodeSlots = make(chan struct{}, max(config.GetConfig().TranscodeMaxConcurrent, 1))
+	})
+	select {
+	case transcodeSlots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-transcodeSlots }) }, true
+	default:
+		return nil, false
+	}
+}
+
+// transcodeArgs returns the ffmpeg arguments that read input from start
+// and encode it with profile. The output arguments are appended by the caller.
+func transcodeArgs(input string, start time.Duration, audio int, profile transcodeProfile) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if start > 0 {
+		args = append(args, "-ss", formatSeconds(start))
+	}
+	args = append(args, "-i", input,
+		"-map", "0:v:0?", "-map", fmt.Sprintf("0:a:%d?", audio), "-sn", "-dn")
+
+	if profile.copyVideo {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args,
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-profile:v", "high", "-pix_fmt", "yuv420p",
+			"-maxrate", profile.videoBitrate, "-bufsize", profile.videoBitrate,
+			"-vf", fmt.Sprintf("scale=-2:min(ih\\,%d)", profile.maxHeight),
+			// Regular keyframes let the output be cut into fragments and segments.
+			"-force_key_frames", "expr:gte(t,n_forced*2)")
+	}
+	return append(args, "-c:a", "aac", "-b:a", profile.audioBitrate, "-ac", "2")
+}
+
+// transcodeRequest holds the parsed parameters of a transcode request.
+type transcodeRequest struct {
+	filePath    string
+	profileName string
+	profile     transcodeProfile
+	start       time.Duration
+	audio       int
+}
+
+// parseTranscodeRequest authenticates c and parses its parameters. When it
+// returns false the error response has already been written.
+func parseTranscodeRequest(c *gin.Context) (transcodeRequest, bool) {
+	if !config.GetConfig().TranscodeEnabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcoding is disabled"})
+		return transcodeRequest{}, false
+	}
+	filePath, ok := authenticateRequest(c)
+	if !ok {
+		return transcodeRequest{}, false
+	}
+	if _, err := storage.Stat(filePath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return transcodeRequest{}, false
+	}
+
+	req := transcodeRequest{filePath: filePath, profileName: c.DefaultQuery("profile", defaultTranscodeProfile)}
+	profile, ok := transcodeProfiles[req.profileName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown transcode profile"})
+		return transcodeRequest{}, false
+	}
+	req.profile = profile
+
+	seconds, err := strconv.ParseFloat(c.DefaultQuery("start", "0"), 64)
+	if err != nil || seconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start"})
+		return transcodeRequest{}, false
+	}
+	req.start = time.Duration(seconds * float64(time.Second))
+	if req.audio, err = strconv.Atoi(c.DefaultQuery("audio", "0")); err != nil || req.audio < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid audio track"})
+		return transcodeRequest{}, false
+	}
+	return req, true
+}
+
+// writeTranscodeError maps an error starting a transcode to a response.
+func writeTranscodeError(c *gin.Context, filePath string, err error) {
+	if errors.Is(err, errFFmpegUnavailable) {
+		logger.Error("Transcode requested but ffmpeg is unavailable", "error", err)
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Transcoding is not available"})
+		return
+	}
+	logger.Error("Failed to start transcode", "filePath", filePath, "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+}
+
+// refuseTranscode answers a request that found no free transcode slot.
+func refuseTranscode(c *gin.Context, filePath string) {
+	logger.Warn("Transcode refused, all slots are busy", "filePath", filePath, "maxConcurrent", config.GetConfig().TranscodeMaxConcurrent)
+	c.Header("Retry-After", "10")
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many transcodes in progress"})
+}
+
+// Transcode streams a media file converted by a CPU-only ffmpeg as
+// fragmented MP4, for clients that cannot play the source codecs. The
+// profile, start (seconds) and audio (audio track index) query parameters
+// select the output. The process is killed when the client disconnects.
+func Transcode(c *gin.Context) {
+	req, ok := parseTranscodeRequest(c)
+	if !ok {
+		return
+	}
+	path, err := ffmpegPath()
+	if err != nil {
+		writeTranscodeError(c, req.filePath, err)
+		return
+	}
+	release, ok := tryAcquireTranscode()
+	if !ok {
+		refuseTranscode(c, req.filePath)
+		return
+	}
+	defer release()
+	defer registerStream(c, "transcode", req.filePath)()
+
+	args := append(transcodeArgs(req.filePath, req.start, req.audio, req.profile),
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "pipe:1")
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = transcodeWaitDelay
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		writeTranscodeError(c, req.filePath, err)
+		return
+	}
+	startTime := time.Now()
+	logger.Info("Transcode started", "filePath", req.filePath, "profile", req.profileName, "start", req.start, "pid", cmd.Process.Pid)
+
+	c.Header("Content-Type", "video/mp4")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	buffer := make([]byte, 256*1024)
+	written, copyErr := io.CopyBuffer(flushWriter{c.Writer, streamSessionOf(c)}, stdout, buffer)
+	if copyErr != nil {
+		// The client went away: stop ffmpeg rather than encoding for nobody.
+		cancel()
+	}
+	waitErr := cmd.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		logger.Info("Transcode stopped before completion", "filePath", req.filePath, "bytes", written, "elapsed", time.Since(startTime))
+	case waitErr != nil:
+		logger.Error("Transcode failed", "filePath", req.filePath, "error", waitErr, "stderr", strings.TrimSpace(stderr.String()))
+		if written == 0 {
+			// Nothing was sent yet, so the status can still report the failure.
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot transcode media"})
+		}
+	default:
+		logger.Info("Transcode completed", "filePath", req.filePath, "bytes", written, "elapsed", time.Since(startTime))
+	}
+}
+
+// flushWriter flushes every write, so transcoded fragments reach the client
+// as soon as ffmpeg produces them.
+type flushWriter struct {
+	w       gin.ResponseWriter
+	session *streamSession
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	f.session.addBytes(n)
+	return n, err
+}
+
+// transcodeSession is an ffmpeg process writing HLS segments to a directory.
+// Sessions are stopped once their segments have not been requested for the
+// configured idle timeout, since HLS clients hold no connection open.
+type transcodeSession struct {
+	id       string
+	dir      string
+	filePath string
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when ffmpeg has exited
+	stopped  chan struct{} // closed when the session has been stopped
+	stopOnce sync.Once
+
+	mu         sync.Mutex
+	lastAccess time.Time
+}
+
+// touch records a request for the session.
+func (s *transcodeSession) touch() {
+	s.mu.Lock()
+	s.lastAccess = time.Now()
+	s.mu.Unlock()
+}
+
+// idleSince returns how long the session has not been requested.
+func (s *transcodeSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastAccess)
+}
+
+var (
+	transcodeSessionsMu sync.Mutex
+	transcodeSessions   = make(map[string]*transcodeSession)
+)
+
+// sessionFilePattern matches the files ffmpeg writes in a session directory.
+var sessionFilePattern = regexp.MustCompile(`^(index\.m3u8|init\.mp4|seg_\d+\.m4s)$`)
+
+// transcodeDirectory returns the directory holding HLS session directories.
+func transcodeDirectory() string {
+	if dir := config.GetConfig().TranscodeDirectory; dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "pilipili-transcodes")
+}
+
+// startTranscodeSession starts ffmpeg writing HLS output for req. The
+// transcode slot is released when the session ends.
+func startTranscodeSession(req transcodeRequest, release func()) (*transcodeSession, error) {
+	path, err := ffmpegPath()
+	if err != nil {
+		return nil, err
+	}
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(transcodeDirectory(), 0o755); err != nil {
+		return nil, err
+	}
+	session := &transcodeSession{
+		id:         hex.EncodeToString(random[:]),
+		filePath:   req.filePath,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	session.dir = filepath.Join(transcodeDirectory(), session.id)
+	if err := os.Mkdir(session.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	args := append(transcodeArgs(req.filePath, req.start, req.audio, req.profile),
+		"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "event",
+		"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", filepath.Join(session.dir, "seg_%05d.m4s"),
+		filepath.Join(session.dir, "index.m3u8"))
+	ctx, cancel := context.WithCancel(context.Background())
+	session.cancel = cancel
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = transcodeWaitDelay
+	if err := cmd.Start(); err != nil {
+		cancel()
+		os.RemoveAll(session.dir)
+		return nil, err
+	}
+	logger.Info("HLS transcode session started", "session", session.id, "filePath", req.filePath, "profile", req.profileName, "pid", cmd.Process.Pid)
+
+	transcodeSessionsMu.Lock()
+	transcodeSessions[session.id] = session
+	transcodeSessionsMu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		release()
+		if err != nil && ctx.Err() == nil {
+			logger.Error("HLS transcode failed", "session", session.id, "error", err, "stderr", strings.TrimSpace(stderr.String()))
+		}
+		close(session.done)
+	}()
+	go session.reap()
+	return session, nil
+}
+
+// reap stops the session once it has been idle for the configured timeout
+// and removes its files.
+func (s *transcodeSession) reap() {
+	timeout := config.GetConfig().TranscodeIdleTimeout
+	ticker := time.NewTicker(min(timeout/4, 5*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+			if s.idleSince() >= timeout {
+				s.stop()
+				logger.Info("HLS transcode session closed after idling", "session", s.id, "filePath", s.filePath)
+				return
+			}
+		}
+	}
+}
+
+// stop kills ffmpeg, waits for it to exit and removes the session.
+func (s *transcodeSession) stop() {
+	s.stopOnce.Do(func() {
+		transcodeSessionsMu.Lock()
+		delete(transcodeSessions, s.id)
+		transcodeSessionsMu.Unlock()
+
+		s.cancel()
+		<-s.done
+		if err := os.RemoveAll(s.dir); err != nil {
+			logger.Warn("Failed to remove transcode session files", "session", s.id, "error", err)
+		}
+		close(s.stopped)
+	})
+}
+
+// StopTranscodes stops every HLS transcode session. It is called on shutdown
+// so that no ffmpeg process outlives the server.
+func StopTranscodes() {
+	transcodeSessionsMu.Lock()
+	sessions := make([]*transcodeSession, 0, len(transcodeSessions))
+	for _, session := range transcodeSessions {
+		sessions = append(sessions, session)
+	}
+	transcodeSessionsMu.Unlock()
+	for _, session := range sessions {
+		session.stop()
+	}
+}
+
+// TranscodeHLS starts an HLS transcode session with the same parameters as
+// Transcode and redirects to its playlist, which grows as ffmpeg encodes.
+func TranscodeHLS(c *gin.Context) {
+	req, ok := parseTranscodeRequest(c)
+	if !ok {
+		return
+	}
+	release, ok := tryAcquireTranscode()
+	if !ok {
+		refuseTranscode(c, req.filePath)
+		return
+	}
+	session, err := startTranscodeSession(req, release)
+	if err != nil {
+		release()
+		writeTranscodeError(c, req.filePath, err)
+		return
+	}
+
+	// Players give up on a playlist that does not exist yet, so wait for the first segment.
+	ctx, cancel := context.WithTimeout(c.Request.Context(), transcodePlaylistTimeout)
+	defer cancel()
+	playlist := filepath.Join(session.dir, "index.m3u8")
+	for {
+		if _, err := os.Stat(playlist); err == nil {
+			break
+		}
+		select {
+		case <-session.done:
+			go session.stop()
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Cannot transcode media"})
+			return
+		case <-ctx.Done():
+			go session.stop()
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Transcode did not start in time"})
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	c.Redirect(http.StatusFound, "hls/"+session.id+"/index.m3u8")
+}
+
+// TranscodeHLSFile serves the playlist, initialization segment and media
+// segments of an HLS transcode session. The random session ID authorizes
+// the request, as segment URLs carry no signature.
+func TranscodeHLSFile(c *gin.Context) {
+	transcodeSessionsMu.Lock()
+	session, ok := transcodeSessions[c.Param("session")]
+	transcodeSessionsMu.Unlock()
+	name := c.Param("file")
+	if !ok || !sessionFilePattern.MatchString(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcode session not found"})
+		return
+	}
+	session.touch()
+
+	data, err := os.ReadFile(filepath.Join(session.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not ready"})
+		return
+	} else if err != nil {
+		logger.Error("Failed to read transcode output", "session", session.id, "file", name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	switch filepath.Ext(name) {
+	case ".m3u8":
+		c.Data(http.StatusOK, playlistContentType, data)
+	default:
+		c.Data(http.StatusOK, videoSegmentType, data)
+	}
+}
@@ -0,0 +1,200 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg stands in for ffmpeg. It records its PID next to itself, then
+// either streams filler to standard output until it is killed, or writes an
+// HLS playlist to its last argument and waits to be killed.
+const fakeFFmpeg = `#!/bin/sh
+for last; do :; done
+echo $$ > "$(dirname "$0")/ffmpeg.pid"
+if [ "$last" = "pipe:1" ]; then
+	while :; do echo fragment; done
+fi
+printf '#EXTM3U\n' > "$last"
+printf 'init' > "$(dirname "$last")/init.mp4"
+exec sleep 600
+`
+
+// ffmpegPID returns the PID the fake ffmpeg recorded, after removing the
+// record of an earlier run.
+func ffmpegPID(t *testing.T) int {
+	t.Helper()
+	file := filepath.Join(testDir, "ffmpeg.pid")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(file)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+// processExists reports whether pid is a process that has not been reaped.
+func processExists(pid int) bool {
+	return !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// waitFor fails the test unless cond holds within five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// slotFree reports whether a transcode could start now.
+func slotFree() bool {
+	release, ok := tryAcquireTranscode()
+	if ok {
+		release()
+	}
+	return ok
+}
+
+// startTranscode requests a transcode of path from srv and reads the start
+// of the output. It returns the PID of ffmpeg and a function disconnecting
+// the client.
+func startTranscode(t *testing.T, srv *httptest.Server, path string) (int, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+signedURL(t, "/transcode", path, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnect := func() {
+		cancel()
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/mp4" {
+		disconnect()
+		t.Fatalf("got %d %s, want 200 video/mp4", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 64*1024)); err != nil {
+		disconnect()
+		t.Fatal(err)
+	}
+	return ffmpegPID(t), disconnect
+}
+
+// transcodeServer returns a server for the transcode endpoints.
+func transcodeServer(t *testing.T) *httptest.Server {
+	r := gin.New()
+	r.Use(Drain())
+	r.GET("/transcode", Transcode)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTranscodeKillsFFmpegOnDisconnect(t *testing.T) {
+	path := writeMedia(t, "disconnect.mkv", []byte("video"))
+	pid, disconnect := startTranscode(t, transcodeServer(t), path)
+	if !processExists(pid) {
+		t.Fatalf("ffmpeg %d is not running while its output is read", pid)
+	}
+
+	disconnect()
+	waitFor(t, "ffmpeg is killed", func() bool { return !processExists(pid) })
+	waitFor(t, "the transcode slot is released", slotFree)
+}
+
+func TestTranscodeConcurrencyCap(t *testing.T) {
+	path := writeMedia(t, "cap.mkv", []byte("video"))
+	pid, disconnect := startTranscode(t, transcodeServer(t), path)
+	defer func() {
+		disconnect()
+		waitFor(t, "ffmpeg is killed", func() bool { return !processExists(pid) })
+		waitFor(t, "the transcode slot is released", slotFree)
+	}()
+
+	// maxConcurrent is 1, so further transcodes of either kind are refused.
+	for _, endpoint := range []struct {
+		target  string
+		handler gin.HandlerFunc
+	}{
+		{"/transcode", Transcode},
+		{"/transcode/hls", TranscodeHLS},
+	} {
+		w := serve(endpoint.handler, httptest.NewRequest(http.MethodGet, signedURL(t, endpoint.target, path, nil), nil))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: got %d with Retry-After %q, want 503 with Retry-After", endpoint.target, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestTranscodeHLSSessionReaper(t *testing.T) {
+	t.Cleanup(StopTranscodes)
+	path := writeMedia(t, "hls.mkv", []byte("video"))
+	r := gin.New()
+	r.GET("/transcode/hls", TranscodeHLS)
+	r.GET("/transcode/hls/:session/:file", TranscodeHLSFile)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get(signedURL(t, "/transcode/hls", path, nil))
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, "/transcode/hls/") {
+		t.Fatalf("got %d to %q, want 302 to the session playlist", w.Code, location)
+	}
+	playlist := location
+	id := strings.Split(location, "/")[3]
+	pid := ffmpegPID(t)
+	dir := filepath.Join(testDir, "transcodes", id)
+
+	// Requests keep the session alive past the idle timeout of one second.
+	for end := time.Now().Add(1500 * time.Millisecond); time.Now().Before(end); time.Sleep(250 * time.Millisecond) {
+		if w := get(playlist); w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "#EXTM3U") {
+			t.Fatalf("playlist: got %d %q", w.Code, w.Body)
+		}
+	}
+	if w := get("/transcode/hls/" + id + "/init.mp4"); w.Code != http.StatusOK {
+		t.Errorf("init.mp4: got %d, want 200", w.Code)
+	}
+	if !processExists(pid) {
+		t.Fatalf("ffmpeg %d of a requested session was stopped", pid)
+	}
+
+	// Once requests stop, the session is closed and its files removed.
+	waitFor(t, "the idle session is closed", func() bool {
+		transcodeSessionsMu.Lock()
+		defer transcodeSessionsMu.Unlock()
+		return transcodeSessions[id] == nil
+	})
+	if w := get(playlist); w.Code != http.StatusNotFound {
+		t.Errorf("playlist of a closed session: got %d, want 404", w.Code)
+	}
+	waitFor(t, "ffmpeg is killed", func() bool { return !processExists(pid) })
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("session directory was not removed: %v", err)
+	}
+	waitFor(t, "the transcode slot is released", slotFree)
+}
@@ -0,0 +1,276 @@
+package streamer
+
+import (
+	"PiliPili_Backend/config"
+	"PiliPili_Backend/logger"
+	"PiliPili_Backend/subtitle"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trickplayTimeout bounds the extraction of the trickplay images of a file.
+const trickplayTimeout = 30 * time.Minute
+
+// spriteQuality is the JPEG quality of sprite sheets.
+const spriteQuality = 80
+
+// bifMagic starts every BIF file.
+var bifMagic = []byte{0x89, 'B', 'I', 'F', 0x0D, 0x0A, 0x1A, 0x0A}
+
+// trickplaySet is the keyframes of a file extracted at a fixed interval.
+type trickplaySet struct {
+	dir      string
+	images   []string // file names in playback order
+	interval time.Duration
+	width    int
+	height   int
+}
+
+// trickplayLocks serializes the extraction and assembly of each trickplay directory.
+var trickplayLocks sync.Map
+
+// lockTrickplay locks the trickplay directory dir and returns its unlock function.
+func lockTrickplay(dir string) func() {
+	mu, _ := trickplayLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// loadTrickplay returns the trickplay images of a file version, extracting
+// them on first use. Extraction is shared by concurrent requests and runs to
+// completion even if the request that started it goes away.
+func loadTrickplay(filePath string, key fileKey) (*trickplaySet, error) {
+	cfg := config.GetConfig()
+	set := &trickplaySet{interval: cfg.TrickplayInterval, width: cfg.ThumbnailWidth}
+	if set.interval <= 0 {
+		set.interval = 10 * time.Second
+	}
+
+	parent, err := thumbnailDirectory(key)
+	if err != nil {
+		return nil, err
+	}
+	set.dir = filepath.Join(parent, fmt.Sprintf("trickplay-%d-%d", set.interval.Milliseconds(), set.width))
+	unlock := lockTrickplay(set.dir)
+	defer unlock()
+
+	if _, err := os.Stat(set.dir); errors.Is(err, os.ErrNotExist) {
+		tmp, err := os.MkdirTemp(parent, ".trickplay-*")
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), trickplayTimeout)
+		defer cancel()
+		startTime := time.Now()
+		if err := extractor.trickplay(ctx, filePath, set.interval, set.width, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+		if err := os.Rename(tmp, set.dir); err != nil {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+		logger.Info("Trickplay images extracted", "filePath", filePath, "interval", set.interval, "elapsed", time.Since(startTime))
+	}
+
+	entries, err := os.ReadDir(set.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".jpg") && !strings.HasPrefix(name, "sprite-") {
+			set.images = append(set.images, name)
+		}
+	}
+	sort.Strings(set.images)
+	if len(set.images) == 0 {
+		return nil, errors.New("no trickplay images were extracted")
+	}
+
+	first, err := os.Open(filepath.Join(set.dir, set.images[0]))
+	if err != nil {
+		return nil, err
+	}
+	defer first.Close()
+	imageConfig, err := jpeg.DecodeConfig(first)
+	if err != nil {
+		return nil, err
+	}
+	set.width, set.height = imageConfig.Width, imageConfig.Height
+	return set, nil
+}
+
+// buildBIF assembles the images of set into a BIF file, the trickplay format of Roku and Emby.
+func (s *trickplaySet) buildBIF() ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(bifMagic)
+	binary.Write(&b, binary.LittleEndian, []uint32{0, uint32(len(s.images)), uint32(s.interval.Milliseconds())})
+	b.Write(make([]byte, 64-b.Len()))
+
+	offset := uint32(64 + 8*(len(s.images)+1))
+	var data bytes.Buffer
+	for i, name := range s.images {
+		image, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(i), offset + uint32(data.Len())})
+		data.Write(image)
+	}
+	binary.Write(&b, binary.LittleEndian, []uint32{0xFFFFFFFF, offset + uint32(data.Len())})
+	b.Write(data.Bytes())
+	return b.Bytes(), nil
+}
+
+// spriteGrid returns the number of columns and rows of sprite sheets.
+func spriteGrid() (int, int) {
+	cfg := config.GetConfig()
+	return max(cfg.TrickplayColumns, 1), max(cfg.TrickplayRows, 1)
+}
+
+// buildSprite tiles the images of one sprite sheet into a JPEG.
+func (s *trickplaySet) buildSprite(sheet int) ([]byte, error) {
+	columns, rows := spriteGrid()
+	first := sheet * columns * rows
+	names := s.images[first:min(first+columns*rows, len(s.images))]
+	usedRows := (len(names) + columns - 1) / columns
+	sprite := image.NewRGBA(image.Rect(0, 0, columns*s.width, usedRows*s.height))
+	for i, name := range names {
+		file, err := os.Open(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		tile, err := jpeg.Decode(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		at := image.Pt(i%columns*s.width, i/columns*s.height)
+		draw.Draw(sprite, image.Rectangle{Min: at, Max: at.Add(image.Pt(s.width, s.height))}, tile, tile.Bounds().Min, draw.Src)
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, sprite, &jpeg.Options{Quality: spriteQuality}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// cachedAsset returns the file name in the trickplay directory, building and
+// caching it on first use.
+func (s *trickplaySet) cachedAsset(name string, build func() ([]byte, error)) (string, error) {
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	unlock := lockTrickplay(s.dir)
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	data, err := build()
+	if err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, data)
+}
+
+// openTrickplayForRequest authenticates c and loads the trickplay images of
+// the requested file. When it returns false the error response has already
+// been written.
+func openTrickplayForRequest(c *gin.Context) (*trickplaySet, fileKey, bool) {
+	filePath, key, ok := openThumbnailSource(c)
+	if !ok {
+		return nil, fileKey{}, false
+	}
+	set, err := loadTrickplay(filePath, key)
+	if err != nil {
+		writeExtractionError(c, filePath, err)
+		return nil, fileKey{}, false
+	}
+	return set, key, true
+}
+
+// TrickplayBIF serves the trickplay images of a video as a BIF file.
+func TrickplayBIF(c *gin.Context) {
+	set, key, ok := openTrickplayForRequest(c)
+	if !ok {
+		return
+	}
+	path, err := set.cachedAsset("index.bif", set.buildBIF)
+	if err != nil {
+		logger.Error("Failed to build BIF", "dir", set.dir, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	c.Header("ETag", key.etag())
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("Content-Type", "application/octet-stream")
+	c.File(path)
+}
+
+// TrickplaySprites serves a WebVTT track mapping playback intervals to
+// regions of the sprite sheets, as used by web players for scrubbing previews.
+func TrickplaySprites(c *gin.Context) {
+	set, key, ok := openTrickplayForRequest(c)
+	if !ok {
+		return
+	}
+
+	columns, rows := spriteGrid()
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := range set.images {
+		start := time.Duration(i) * set.interval
+		sheet, position := i/(columns*rows), i%(columns*rows)
+		query := signedQuery(c)
+		query.Set("sheet", strconv.Itoa(sheet))
+		fmt.Fprintf(&b, "\n%s --> %s\nsprite.jpg?%s#xywh=%d,%d,%d,%d\n",
+			subtitle.FormatTimestamp(start), subtitle.FormatTimestamp(start+set.interval), query.Encode(),
+			position%columns*set.width, position/columns*set.height, set.width, set.height)
+	}
+
+	c.Header("ETag", key.etag())
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(b.String()))
+}
+
+// TrickplaySprite serves the sprite sheet selected by the sheet query parameter.
+func TrickplaySprite(c *gin.Context) {
+	set, key, ok := openTrickplayForRequest(c)
+	if !ok {
+		return
+	}
+	columns, rows := spriteGrid()
+	sheet, err := strconv.Atoi(c.Query("sheet"))
+	if err != nil || sheet < 0 || sheet*columns*rows >= len(set.images) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sprite sheet not found"})
+		return
+	}
+	path, err := set.cachedAsset(fmt.Sprintf("sprite-%d-%dx%d.jpg", sheet, columns, rows), func() ([]byte, error) {
+		return set.buildSprite(sheet)
+	})
+	if err != nil {
+		logger.Error("Failed to build sprite sheet", "dir", set.dir, "sheet", sheet, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	c.Header("ETag", key.etag())
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.File(path)
+}
@@ -0,0 +1,132 @@
+// Package subtitle converts text subtitles (SRT, ASS/SSA) to WebVTT, the only
+// format browsers accept in a <track> element.
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"strings"
+	"unicode/utf8"
+)
+
+// commonHanzi holds frequent characters in both simplified and traditional
+// script. A correct decoding of Chinese text hits them often, a wrong one rarely.
+const commonHanzi = "的一是不了人我在有他这這为為之大来來以个個中上们們到说說国國和地也子时時道出而要于於就下得可你年生自会會那后後能对對着著事其里裡所去行过過家十用发發天如然作方成者多日都三小军軍二无無同么麼经經法当當起与與好看学學进進种種将將还還分此心前面又定见見只主没沒公从從"
+
+// DecodeText converts subtitle bytes to a UTF-8 string. A BOM takes precedence;
+// otherwise UTF-16 without BOM, valid UTF-8, GB18030 (GBK) and Big5 are tried.
+// It returns the decoded text and the name of the detected encoding.
+func DecodeText(data []byte) (string, string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), "utf-8", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), data, "utf-16le")
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeWith(unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), data, "utf-16be")
+	}
+
+	if endian, ok := detectUTF16(data); ok {
+		if endian == unicode.LittleEndian {
+			return decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), data, "utf-16le")
+		}
+		return decodeWith(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), data, "utf-16be")
+	}
+
+	if utf8.Valid(data) {
+		return string(data), "utf-8", nil
+	}
+
+	gbk, gbkErrors := decodeLenient(simplifiedchinese.GB18030, data)
+	big5, big5Errors := decodeLenient(traditionalchinese.Big5, data)
+	switch {
+	case gbkErrors < big5Errors:
+		return gbk, "gb18030", nil
+	case big5Errors < gbkErrors:
+		return big5, "big5", nil
+	case hanziScore(big5) > hanziScore(gbk):
+		return big5, "big5", nil
+	default:
+		return gbk, "gb18030", nil
+	}
+}
+
+// DecodeTextAs converts subtitle bytes to a UTF-8 string using the named
+// encoding (any WHATWG label such as "gbk", "big5" or "shift_jis").
+func DecodeTextAs(data []byte, charset string) (string, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", errors.New("unsupported charset: " + charset)
+	}
+	text, _, err := decodeWith(enc, data, charset)
+	return strings.TrimPrefix(text, "\uFEFF"), err
+}
+
+// decodeWith decodes data with enc.
+func decodeWith(enc encoding.Encoding, data []byte, name string) (string, string, error) {
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", name, err
+	}
+	return string(decoded), name, nil
+}
+
+// decodeLenient decodes data with enc and counts the replacement characters
+// produced for invalid sequences.
+func decodeLenient(enc encoding.Encoding, data []byte) (string, int) {
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", len(data)
+	}
+	text := string(decoded)
+	return text, strings.Count(text, "\uFFFD")
+}
+
+// hanziScore counts how many runes of text are frequent Chinese characters.
+func hanziScore(text string) int {
+	score := 0
+	for _, r := range text {
+		if r > 0x2E80 && strings.ContainsRune(commonHanzi, r) {
+			score++
+		}
+	}
+	return score
+}
+
+// detectUTF16 recognizes UTF-16 without a BOM from the zero bytes that ASCII
+// characters leave in every other position.
+func detectUTF16(data []byte) (unicode.Endianness, bool) {
+	sample := data
+	if len(sample) > 4096 {
+		sample = sample[:4096]
+	}
+	if len(sample) < 4 {
+		return unicode.LittleEndian, false
+	}
+
+	var evenZeros, oddZeros int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+
+	half := len(sample) / 2
+	switch {
+	case oddZeros > half*2/5 && evenZeros < half/20:
+		return unicode.LittleEndian, true
+	case evenZeros > half*2/5 && oddZeros < half/20:
+		return unicode.BigEndian, true
+	}
+	return unicode.LittleEndian, false
+}
@@ -0,0 +1,202 @@
+package subtitle
+
+import (
+	"sort"
+	"strings"
+)
+
+// FontUsage maps the font families an ASS/SSA script draws with, keyed by
+// lower-cased family name, to the characters drawn in each of them.
+type FontUsage map[string]map[rune]bool
+
+// defaultStyleFont is what renderers use for events whose style is undefined.
+const defaultStyleFont = "Arial"
+
+// ParseASSFonts collects the fonts referenced by the styles and \fn override
+// tags of an ASS/SSA script together with the characters each one draws.
+// Fonts of styles that no event uses are still listed, without characters.
+func ParseASSFonts(text string) FontUsage {
+	usage := FontUsage{}
+	styleFonts := map[string]string{}
+	var styleFormat, eventFormat []string
+	section := ""
+
+	for _, line := range strings.Split(normalizeNewlines(text), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line)
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+
+		switch section {
+		case "[v4+ styles]", "[v4 styles]":
+			switch key {
+			case "Format":
+				styleFormat = splitFields(value, -1)
+			case "Style":
+				fields := splitFields(value, len(styleFormat))
+				name, font := fieldValue(styleFormat, fields, "Name"), fieldValue(styleFormat, fields, "Fontname")
+				if font = normalizeFontName(font); font != "" {
+					styleFonts[strings.ToLower(name)] = font
+					usage.add(font, "")
+				}
+			}
+		case "[events]":
+			switch key {
+			case "Format":
+				eventFormat = splitFields(value, -1)
+			case "Dialogue":
+				format := eventFormat
+				if format == nil {
+					format = defaultEventFormat
+				}
+				fields := splitFields(value, len(format))
+				if len(fields) != len(format) {
+					continue
+				}
+				styleFont := func(style string) string {
+					style = strings.TrimPrefix(strings.TrimSpace(style), "*")
+					if font, ok := styleFonts[strings.ToLower(style)]; ok {
+						return font
+					}
+					if font, ok := styleFonts["default"]; ok {
+						return font
+					}
+					return defaultStyleFont
+				}
+				usage.addEvent(fieldValue(format, fields, "Text"), styleFont(fieldValue(format, fields, "Style")), styleFont)
+			}
+		}
+	}
+	return usage
+}
+
+// addEvent records the characters of one event's text, following \fn and \r
+// tags. Vector drawings (\p1 and above) draw no characters.
+func (u FontUsage) addEvent(raw, font string, styleFont func(string) string) {
+	current := font
+	drawing := false
+	for len(raw) > 0 {
+		start := strings.IndexByte(raw, '{')
+		end := -1
+		if start >= 0 {
+			end = strings.IndexByte(raw[start:], '}')
+		}
+		if start < 0 || end < 0 {
+			if !drawing {
+				u.add(current, raw)
+			}
+			return
+		}
+		if !drawing {
+			u.add(current, raw[:start])
+		}
+
+		for _, tag := range strings.Split(raw[start+1:start+end], `\`)[1:] {
+			tag = strings.TrimSpace(tag)
+			switch {
+			case strings.HasPrefix(tag, "fn"):
+				if name := normalizeFontName(tag[2:]); name != "" {
+					current = name
+				} else {
+					current = font
+				}
+			case strings.HasPrefix(tag, "r") && !strings.HasPrefix(tag, "rnd"):
+				if tag == "r" {
+					current = font
+				} else {
+					current = styleFont(tag[1:])
+				}
+			case strings.HasPrefix(tag, "p") && !strings.HasPrefix(tag, "pos") && !strings.HasPrefix(tag, "pbo"):
+				drawing = strings.TrimLeft(tag[1:], "0") != ""
+			}
+		}
+		raw = raw[start+end+1:]
+	}
+}
+
+// add records the characters of text as drawn with font.
+func (u FontUsage) add(font, text string) {
+	key := strings.ToLower(font)
+	runes, ok := u[key]
+	if !ok {
+		runes = map[rune]bool{}
+		u[key] = runes
+	}
+	text = strings.NewReplacer(`\N`, "", `\n`, "", `\h`, "\u00A0").Replace(text)
+	for _, r := range text {
+		runes[r] = true
+	}
+}
+
+// Merge adds the fonts and characters of other to u.
+func (u FontUsage) Merge(other FontUsage) {
+	for font, runes := range other {
+		if u[font] == nil {
+			u[font] = map[rune]bool{}
+		}
+		for r := range runes {
+			u[font][r] = true
+		}
+	}
+}
+
+// Families returns the referenced font families, sorted.
+func (u FontUsage) Families() []string {
+	families := make([]string, 0, len(u))
+	for font := range u {
+		families = append(families, font)
+	}
+	sort.Strings(families)
+	return families
+}
+
+// Runes returns the characters drawn with any of the given family names.
+// When none of them is referenced, the characters of every font are returned
+// so that a font picked up through fallback still covers the text.
+func (u FontUsage) Runes(families []string) []rune {
+	set := map[rune]bool{}
+	matched := false
+	for _, family := range families {
+		if runes, ok := u[strings.ToLower(family)]; ok {
+			matched = true
+			for r := range runes {
+				set[r] = true
+			}
+		}
+	}
+	if !matched {
+		for _, runes := range u {
+			for r := range runes {
+				set[r] = true
+			}
+		}
+	}
+
+	result := make([]rune, 0, len(set))
+	for r := range set {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// fieldValue returns the field called name according to format.
+func fieldValue(format, fields []string, name string) string {
+	for i, field := range format {
+		if strings.EqualFold(field, name) && i < len(fields) {
+			return fields[i]
+		}
+	}
+	return ""
+}
+
+// normalizeFontName strips the "@" prefix that selects vertical layout.
+func normalizeFontName(name string) string {
+	return strings.TrimPrefix(strings.TrimSpace(name), "@")
+}
@@ -0,0 +1,376 @@
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is a single timed subtitle entry.
+type Cue struct {
+	Start    time.Duration
+	End      time.Duration
+	Text     string // WebVTT cue payload, lines separated by "\n"
+	Settings string // WebVTT cue settings such as "line:0"
+}
+
+// ErrUnsupportedFormat is returned for subtitle formats that cannot be converted.
+var ErrUnsupportedFormat = errors.New("unsupported subtitle format")
+
+var (
+	srtTimingPattern = regexp.MustCompile(`(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+	srtFontPattern   = regexp.MustCompile(`(?i)</?font[^>]*>`)
+	overridePattern  = regexp.MustCompile(`\{[^}]*\}`)
+	alignmentPattern = regexp.MustCompile(`\\an?(\d+)`)
+)
+
+// ToWebVTT converts subtitle data in the given format ("srt", "ass", "ssa" or
+// "vtt") to WebVTT. The charset is detected unless one is given explicitly.
+func ToWebVTT(data []byte, format, charset string) ([]byte, error) {
+	var text string
+	var err error
+	if charset != "" {
+		text, err = DecodeTextAs(data, charset)
+	} else {
+		text, _, err = DecodeText(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	text = normalizeNewlines(text)
+
+	var cues []Cue
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "srt":
+		cues = ParseSRT(text)
+	case "ass", "ssa":
+		cues, err = ParseASS(text)
+	case "vtt":
+		// Already WebVTT, only the encoding and line endings needed fixing.
+		return []byte(text), nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return FormatWebVTT(cues), nil
+}
+
+// ParseSRT parses SubRip text into cues. Malformed blocks are skipped.
+func ParseSRT(text string) []Cue {
+	var cues []Cue
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// The numeric index line is optional in practice.
+		timingLine := -1
+		for i := 0; i < len(lines) && i < 2; i++ {
+			if srtTimingPattern.MatchString(lines[i]) {
+				timingLine = i
+				break
+			}
+		}
+		if timingLine < 0 {
+			continue
+		}
+
+		m := srtTimingPattern.FindStringSubmatch(lines[timingLine])
+		cue := Cue{
+			Start: parseClock(m[1], m[2], m[3], m[4]),
+			End:   parseClock(m[5], m[6], m[7], m[8]),
+		}
+
+		body := strings.Join(lines[timingLine+1:], "\n")
+		if align := alignmentPattern.FindStringSubmatch(body); align != nil && strings.Contains(body, "{") {
+			cue.Settings = alignmentSettings(align[0], align[1])
+		}
+		body = overridePattern.ReplaceAllString(body, "")
+		body = srtFontPattern.ReplaceAllString(body, "")
+		cue.Text = escapeSRTText(body)
+		if strings.TrimSpace(cue.Text) != "" {
+			cues = append(cues, cue)
+		}
+	}
+	return cues
+}
+
+// ParseASS parses the [Events] section of an ASS/SSA script into cues.
+// Comments and vector drawings are dropped and override tags are translated
+// to WebVTT markup where possible.
+func ParseASS(text string) ([]Cue, error) {
+	var format []string
+	inEvents := false
+	var cues []Cue
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			format = splitFields(value, -1)
+		case "Dialogue":
+			if format == nil {
+				format = defaultEventFormat
+			}
+			if cue, ok := parseDialogue(value, format); ok {
+				cues = append(cues, cue)
+			}
+		}
+	}
+
+	if format == nil {
+		return nil, errors.New("no [Events] section found")
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// defaultEventFormat is the ASS v4+ event format used when a script omits its Format line.
+var defaultEventFormat = []string{"Layer", "Start", "End", "Style", "Name", "MarginL", "MarginR", "MarginV", "Effect", "Text"}
+
+// parseDialogue parses the value of a "Dialogue:" line according to format.
+func parseDialogue(value string, format []string) (Cue, bool) {
+	fields := splitFields(value, len(format))
+	if len(fields) != len(format) {
+		return Cue{}, false
+	}
+
+	var cue Cue
+	var raw string
+	for i, name := range format {
+		switch strings.ToLower(name) {
+		case "start":
+			cue.Start = ParseASSTimestamp(fields[i])
+		case "end":
+			cue.End = ParseASSTimestamp(fields[i])
+		case "text":
+			raw = fields[i]
+		}
+	}
+	if cue.End <= cue.Start {
+		return Cue{}, false
+	}
+
+	text, settings, ok := convertASSText(raw)
+	if !ok || strings.TrimSpace(text) == "" {
+		return Cue{}, false
+	}
+	cue.Text = text
+	cue.Settings = settings
+	return cue, true
+}
+
+// convertASSText turns ASS event text into WebVTT cue text and settings. It
+// returns false for vector drawings, which have no textual representation.
+func convertASSText(raw string) (string, string, bool) {
+	var b strings.Builder
+	var settings string
+	open := map[string]bool{}
+
+	for len(raw) > 0 {
+		start := strings.IndexByte(raw, '{')
+		if start < 0 {
+			b.WriteString(escapeText(raw))
+			break
+		}
+		b.WriteString(escapeText(raw[:start]))
+		end := strings.IndexByte(raw[start:], '}')
+		if end < 0 {
+			b.WriteString(escapeText(raw[start:]))
+			break
+		}
+		block := raw[start+1 : start+end]
+		raw = raw[start+end+1:]
+
+		for _, tag := range strings.Split(block, `\`)[1:] {
+			switch {
+			case strings.HasPrefix(tag, "p") && len(tag) > 1 && tag[1] >= '1' && tag[1] <= '9':
+				return "", "", false
+			case strings.HasPrefix(tag, "an") || (strings.HasPrefix(tag, "a") && len(tag) > 1 && tag[1] >= '0' && tag[1] <= '9'):
+				if m := alignmentPattern.FindStringSubmatch(`\` + tag); m != nil {
+					settings = alignmentSettings(m[0], m[1])
+				}
+			case tag == "i1" || tag == "b1" || tag == "u1":
+				name := tag[:1]
+				if !open[name] {
+					b.WriteString("<" + name + ">")
+					open[name] = true
+				}
+			case tag == "i0" || tag == "b0" || tag == "u0" || tag == "i" || tag == "b" || tag == "u":
+				name := tag[:1]
+				if open[name] {
+					b.WriteString("</" + name + ">")
+					open[name] = false
+				}
+			}
+		}
+	}
+
+	for _, name := range []string{"u", "b", "i"} {
+		if open[name] {
+			b.WriteString("</" + name + ">")
+		}
+	}
+
+	text := b.String()
+	text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, "\u00A0").Replace(text)
+	return text, settings, true
+}
+
+// alignmentSettings maps an ASS numpad alignment (\anN) or legacy SSA
+// alignment (\aN) to WebVTT cue settings.
+func alignmentSettings(tag, value string) string {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(tag, `\an`) {
+		// Legacy SSA: 1-3 bottom, 5-7 top (+4), 9-11 middle (+8).
+		switch {
+		case n >= 9:
+			n -= 5
+		case n >= 5:
+			n += 2
+		}
+	}
+
+	var settings []string
+	switch {
+	case n >= 7:
+		settings = append(settings, "line:0")
+	case n >= 4:
+		settings = append(settings, "line:50%")
+	}
+	switch n % 3 {
+	case 1:
+		settings = append(settings, "align:start")
+	case 0:
+		settings = append(settings, "align:end")
+	}
+	return strings.Join(settings, " ")
+}
+
+// FormatWebVTT serializes cues as a WebVTT document.
+func FormatWebVTT(cues []Cue) []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		b.WriteString(FormatTimestamp(cue.Start))
+		b.WriteString(" --> ")
+		b.WriteString(FormatTimestamp(cue.End))
+		if cue.Settings != "" {
+			b.WriteString(" ")
+			b.WriteString(cue.Settings)
+		}
+		b.WriteString("\n")
+		// Blank lines would terminate the cue early.
+		for _, line := range strings.Split(cue.Text, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// FormatTimestamp formats d as a WebVTT timestamp (HH:MM:SS.mmm).
+func FormatTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// FormatASSTimestamp formats d as an ASS timestamp (H:MM:SS.cc).
+func FormatASSTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	cs := d.Milliseconds() / 10
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// ParseASSTimestamp parses an ASS timestamp (H:MM:SS.cc), returning 0 when malformed.
+func ParseASSTimestamp(value string) time.Duration {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	seconds, fraction, _ := strings.Cut(parts[2], ".")
+	return parseClock(parts[0], parts[1], seconds, fraction)
+}
+
+// parseClock combines clock components into a duration. The fraction is
+// interpreted by its number of digits (".5" is 500ms, ".05" is 50ms).
+func parseClock(hours, minutes, seconds, fraction string) time.Duration {
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+	s, _ := strconv.Atoi(seconds)
+	for len(fraction) < 3 {
+		fraction += "0"
+	}
+	ms, _ := strconv.Atoi(fraction[:3])
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(ms)*time.Millisecond
+}
+
+// splitFields splits a comma-separated ASS line into at most n trimmed
+// fields; the last field keeps any remaining commas. n < 0 means no limit.
+func splitFields(value string, n int) []string {
+	fields := strings.SplitN(value, ",", n)
+	for i := range fields {
+		if i == n-1 {
+			// Text is the last field and may legitimately end with spaces.
+			fields[i] = strings.TrimLeft(fields[i], " ")
+		} else {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+	}
+	return fields
+}
+
+// escapeText escapes characters that have a meaning in WebVTT cue text.
+func escapeText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// escapeSRTText escapes WebVTT special characters while keeping the <i>, <b>
+// and <u> tags that SRT and WebVTT share.
+func escapeSRTText(text string) string {
+	text = escapeText(text)
+	for _, tag := range []string{"i", "b", "u"} {
+		text = strings.ReplaceAll(text, "&lt;"+tag+"&gt;", "<"+tag+">")
+		text = strings.ReplaceAll(text, "&lt;/"+tag+"&gt;", "</"+tag+">")
+		upper := strings.ToUpper(tag)
+		text = strings.ReplaceAll(text, "&lt;"+upper+"&gt;", "<"+tag+">")
+		text = strings.ReplaceAll(text, "&lt;/"+upper+"&gt;", "</"+tag+">")
+	}
+	return text
+}
+
+// normalizeNewlines converts CRLF and CR line endings to LF and drops a leading BOM.
+func normalizeNewlines(text string) string {
+	text = strings.TrimPrefix(text, "\uFEFF")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}